@@ -1,9 +1,8 @@
-package main
+package kv
 
 import (
 	"encoding/binary"
-	"errors"
-	"kv-database/data"
+	"github.com/RainbowSorcery/kv-project/data"
 	"sync"
 	"sync/atomic"
 )
@@ -32,8 +31,8 @@ func NewBatchWrite(db *Db) *BatchWrite {
 
 func (batch *BatchWrite) Put(key []byte, value []byte) error {
 	// 校验key是否合法
-	if len(key) == 0 {
-		return errors.New("empty key")
+	if err := validateKey(key); err != nil {
+		return err
 	}
 
 	batch.Lock.Lock()
@@ -51,8 +50,8 @@ func (batch *BatchWrite) Put(key []byte, value []byte) error {
 
 func (batch *BatchWrite) Delete(key []byte) error {
 	// 判断key是否合法
-	if len(key) == 0 {
-		return errors.New("empty key")
+	if err := validateKey(key); err != nil {
+		return err
 	}
 
 	batch.Lock.Lock()
@@ -69,12 +68,14 @@ func (batch *BatchWrite) Delete(key []byte) error {
 			return err
 		}
 		if logRecord == nil {
-			return errors.New("数据不存在")
+			return ErrKeyNotFound
 		}
 	}
-	// 将元素标志位设置为已删除
-	logRecord.Type = data.Deleted
-	batch.PendingWrites[string(key)] = logRecord
+	// 将元素标志位设置为已删除 墓碑记录不需要保存value
+	batch.PendingWrites[string(key)] = &data.LogRecord{
+		Key:  key,
+		Type: data.Deleted,
+	}
 
 	return nil
 
@@ -84,25 +85,65 @@ func (batch *BatchWrite) Commit() error {
 	batch.Lock.Lock()
 	defer batch.Lock.Unlock()
 
-	tranNum := atomic.AddInt64(batch.Db.TranNum, 1)
+	batch.Db.lock.Lock()
+	defer batch.Db.lock.Unlock()
+
+	batch.Db.metrics.batchSize.Observe(float64(len(batch.PendingWrites)))
+	writes, err := batch.Db.withMemberDeletes(batch.PendingWrites)
+	if err != nil {
+		return err
+	}
+	return batch.Db.commit(writes, true, true)
+}
+
+// commit 在一个事务中写入所有记录 withIndexes为true时同时维护二级索引条目 syncWrite为true时提交前刷盘 调用方需要持有锁
+// 不刷盘时仍然是原子的 宕机后没有事务完成记录的事务在启动时被丢弃
+func (db *Db) commit(writes map[string]*data.LogRecord, withIndexes bool, syncWrite bool) error {
+	if withIndexes && len(db.secondaryIndexes) > 0 {
+		var err error
+		writes, err = db.indexWrites(writes)
+		if err != nil {
+			return err
+		}
+	}
+
+	tranNum := atomic.AddInt64(db.TranNum, 1)
 
 	logRecordPositionMap := make(map[string]*data.LogRecordPos)
+	blobPositionMap := make(map[string]*data.BlobPos)
 
-	for key := range batch.PendingWrites {
-		record := batch.PendingWrites[key]
+	for key := range writes {
+		record := writes[key]
 		if record != nil {
-			_, realKey := DecodingTranKey(record.Key)
-			position, err := batch.Db.AppendLogRecord(&data.LogRecord{
-				Key:   EncodingTranKey(realKey, tranNum),
-				Type:  record.Type,
-				Value: record.Value,
-			})
+			recordType, value := record.Type, record.Value
+			// 大value写入blob文件 数据文件中只保存blob文件中的位置 流式写入的value已经写入blob文件
+			if record.Type == data.BlobIndex {
+				blobPos, err := data.DecodingBlobPos(record.Value)
+				if err != nil {
+					return err
+				}
+				blobPositionMap[key] = blobPos
+			} else if record.Type == data.Normal && db.isBlobValue(record.Value) {
+				blobRecord, blobPos, err := db.writeBlob([]byte(key), record.Value)
+				if err != nil {
+					return err
+				}
+				recordType, value = blobRecord.Type, blobRecord.Value
+				blobPositionMap[key] = blobPos
+			}
 
-			// 记录索引偏移信息 以便于保存到硬盘中
-			logRecordPositionMap[string(record.Key)] = position
+			position, err := db.AppendLogRecord(&data.LogRecord{
+				Key:   EncodingTranKey([]byte(key), tranNum),
+				Type:  recordType,
+				Value: value,
+				Seq:   record.Seq,
+			})
 			if err != nil {
 				return err
 			}
+
+			// 记录索引偏移信息 以便于保存到硬盘中
+			logRecordPositionMap[key] = position
 		}
 	}
 
@@ -113,29 +154,35 @@ func (batch *BatchWrite) Commit() error {
 		Type:  data.TxComplete,
 	}
 
-	txCompRecordPos, err := batch.Db.AppendLogRecord(txCompRecord)
+	txCompRecordPos, err := db.AppendLogRecord(txCompRecord)
 	if err != nil {
 		return err
 	}
 
-	logRecordPositionMap[string(txCompRecord.Key)] = txCompRecordPos
-
-	// 强制刷盘
-	err = batch.Db.activeFile.FileManage.Sync()
-	if err != nil {
-		return err
+	// 强制刷盘 blob文件需要先于数据文件刷盘
+	if syncWrite {
+		err = db.syncBlob()
+		if err != nil {
+			return err
+		}
+		err = db.syncFile(db.activeFile.FileManage)
+		if err != nil {
+			return err
+		}
 	}
 
 	// 将更改的索引信息刷新到内存中 判断索引是否被删除如果被删除则删除内存索引否则则添加内存索引
-	for key := range batch.PendingWrites {
-		record := batch.PendingWrites[key]
+	for key := range writes {
+		record := writes[key]
 		pos := logRecordPositionMap[key]
-		if record.Type == data.Normal {
-			batch.Db.index.Put([]byte(key), pos)
+		if record.Type == data.Normal || record.Type == data.BlobIndex {
+			db.indexPut([]byte(key), pos, blobPositionMap[key])
 		} else if record.Type == data.Deleted {
-			batch.Db.index.Delete([]byte(key))
+			db.indexDelete([]byte(key), pos)
 		}
 	}
+	// 事务完成记录只用于标记事务提交 本身可以回收
+	db.reclaimable[txCompRecordPos.FileId] += int64(txCompRecordPos.Size)
 
 	return nil
 }
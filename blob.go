@@ -0,0 +1,253 @@
+package kv
+
+import (
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultBlobFileSize 默认blob文件大小阈值
+const DefaultBlobFileSize = 256 * 1024 * 1024
+
+// loadBlobFiles 打开目录下所有blob文件 id最大的文件为活动blob文件
+func (db *Db) loadBlobFiles() error {
+	entries, err := os.ReadDir(db.option.DirPath)
+	if err != nil {
+		return err
+	}
+
+	fileIds := make([]uint32, 0)
+	for _, entry := range entries {
+		// 流式写入中断遗留的临时文件没有被引用 直接删除
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), data.BlobTmpFileSuffix) && !db.option.ReadOnly {
+			if err := os.Remove(db.option.DirPath + entry.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), data.BlobFileSuffix) {
+			continue
+		}
+		fileId, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), data.BlobFileSuffix), 10, 32)
+		if err != nil {
+			return err
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+
+	openBlobFile := data.OpenBlobFile
+	if db.option.ReadOnly {
+		openBlobFile = data.OpenBlobFileReadOnly
+	}
+	for _, fileId := range fileIds {
+		blobFile, err := openBlobFile(db.option.DirPath, fileId)
+		if err != nil {
+			return err
+		}
+		db.blobFiles[fileId] = blobFile
+		db.activeBlobFile = blobFile
+		db.nextBlobFileId = fileId + 1
+	}
+
+	return nil
+}
+
+// isBlobValue 判断value是否需要单独存放到blob文件中
+func (db *Db) isBlobValue(value []byte) bool {
+	return db.option.BlobThreshold > 0 && int64(len(value)) >= db.option.BlobThreshold
+}
+
+// writeBlob 将大value写入活动blob文件 返回用于保存到数据文件中的BlobIndex记录 调用方需要持有锁
+func (db *Db) writeBlob(key []byte, value []byte) (*data.LogRecord, *data.BlobPos, error) {
+	blobFile, err := db.getActiveBlobFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blobPos, err := blobFile.Write(key, value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &data.LogRecord{
+		Key:   key,
+		Value: data.EncodingBlobPos(blobPos),
+		Type:  data.BlobIndex,
+	}, blobPos, nil
+}
+
+// getActiveBlobFile 获取活动blob文件 文件不存在或者达到阈值时创建新的blob文件
+func (db *Db) getActiveBlobFile() (*data.BlobFile, error) {
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+	if db.activeBlobFile != nil && db.activeBlobFile.WriteOffset < db.option.BlobFileSize {
+		return db.activeBlobFile, nil
+	}
+
+	if db.activeBlobFile != nil {
+		// 归档前将数据刷到磁盘
+		if err := db.syncFile(db.activeBlobFile.FileManage); err != nil {
+			return nil, err
+		}
+	}
+
+	fileId := db.nextBlobFileId
+	db.nextBlobFileId++
+	blobFile, err := data.OpenBlobFile(db.option.DirPath, fileId)
+	if err != nil {
+		return nil, err
+	}
+	db.blobFiles[fileId] = blobFile
+	db.activeBlobFile = blobFile
+
+	return blobFile, nil
+}
+
+// readBlob 读取BlobIndex记录指向的value
+func (db *Db) readBlob(record *data.LogRecord) ([]byte, error) {
+	blobPos, err := data.DecodingBlobPos(record.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	blobFile := db.blobFiles[blobPos.FileId]
+	if blobFile == nil {
+		return nil, fmt.Errorf("blob文件%d不存在", blobPos.FileId)
+	}
+
+	_, value, err := blobFile.Read(blobPos)
+	return value, err
+}
+
+// syncBlob 将活动blob文件刷到磁盘 数据文件中的BlobIndex记录刷盘前调用
+func (db *Db) syncBlob() error {
+	if db.activeBlobFile == nil {
+		return nil
+	}
+	return db.syncFile(db.activeBlobFile.FileManage)
+}
+
+// trackBlob 记录key当前引用的blob 旧的blob计入blob文件的可回收空间
+func (db *Db) trackBlob(key []byte, blobPos *data.BlobPos) {
+	if oldBlobPos, ok := db.blobRefs[string(key)]; ok {
+		db.blobReclaimable[oldBlobPos.FileId] += oldBlobPos.Size
+		delete(db.blobRefs, string(key))
+	}
+	if blobPos != nil {
+		db.blobRefs[string(key)] = blobPos
+	}
+}
+
+// BlobGC 回收blob文件 将可回收空间占比达到阈值的blob文件中仍然有效的value写入活动blob文件后删除旧文件
+func (db *Db) BlobGC() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+
+	gcFiles := db.pickBlobGCFiles()
+	if len(gcFiles) == 0 {
+		return nil
+	}
+
+	gcFileIds := make(map[uint32]struct{}, len(gcFiles))
+	for _, blobFile := range gcFiles {
+		gcFileIds[blobFile.FileId] = struct{}{}
+	}
+
+	// 重新写入仍然引用旧blob文件的key 写入新的BlobIndex记录后旧记录失效
+	liveKeys := make([]string, 0)
+	for key, blobPos := range db.blobRefs {
+		if _, ok := gcFileIds[blobPos.FileId]; ok {
+			liveKeys = append(liveKeys, key)
+		}
+	}
+
+	for _, key := range liveKeys {
+		// 存在操作数时直接折叠为新的value 折叠后的value按大小重新写入
+		if _, ok := db.operandChains[key]; ok {
+			if err := db.collapseOperands([]byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		blobPos := db.blobRefs[key]
+		_, value, err := db.blobFiles[blobPos.FileId].Read(blobPos)
+		if err != nil {
+			return err
+		}
+		logRecord, newBlobPos, err := db.writeBlob([]byte(key), value)
+		if err != nil {
+			return err
+		}
+		// value没有变化 保留原记录的序列号
+		pos, err := db.AppendLogRecord(&data.LogRecord{
+			Key:   EncodingTranKey([]byte(key), 0),
+			Value: logRecord.Value,
+			Type:  data.BlobIndex,
+			Seq:   db.index.Get([]byte(key)).Seq,
+		})
+		if err != nil {
+			return err
+		}
+		db.indexPut([]byte(key), pos, newBlobPos)
+	}
+
+	// 新的记录刷盘后才能删除旧的blob文件
+	if err := db.syncBlob(); err != nil {
+		return err
+	}
+	if err := db.syncFile(db.activeFile.FileManage); err != nil {
+		return err
+	}
+
+	for _, blobFile := range gcFiles {
+		if err := blobFile.FileManage.Remove(); err != nil {
+			return err
+		}
+		delete(db.blobFiles, blobFile.FileId)
+		delete(db.blobReclaimable, blobFile.FileId)
+		db.option.Logger.Info("blob file collected", PhaseField(MergePhaseBlobGC), FileIdField(blobFile.FileId))
+	}
+
+	return nil
+}
+
+// pickBlobGCFiles 挑选可回收空间占比达到阈值的非活动blob文件 调用方需要持有锁
+func (db *Db) pickBlobGCFiles() []*data.BlobFile {
+	gcFiles := make([]*data.BlobFile, 0)
+	for fileId, blobFile := range db.blobFiles {
+		if blobFile == db.activeBlobFile || blobFile.WriteOffset == 0 {
+			continue
+		}
+		reclaimableSize := db.blobReclaimable[fileId]
+		if reclaimableSize <= 0 {
+			continue
+		}
+		if float64(reclaimableSize)/float64(blobFile.WriteOffset) >= db.option.BlobGCRatio {
+			gcFiles = append(gcFiles, blobFile)
+		}
+	}
+	return gcFiles
+}
+
+// needBlobGC 判断是否有blob文件需要回收
+func (db *Db) needBlobGC() bool {
+	if db.option.BlobGCRatio <= 0 {
+		return false
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return len(db.pickBlobGCFiles()) > 0
+}
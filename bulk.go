@@ -0,0 +1,547 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/RainbowSorcery/kv-project/data"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	BulkPath = "/bulk/"
+
+	// bulkSeqBlock 在线导入时每次从数据库预留的序列号数量
+	bulkSeqBlock = 4096
+	// bulkWriteBufferSize 导入时写入数据文件的缓冲区大小
+	bulkWriteBufferSize = 1024 * 1024
+)
+
+// BulkLoader 批量导入 按key升序写入的kv直接写成数据文件、hint文件以及布隆过滤器 不经过锁以及内存索引
+// 提交时将文件以大于活动文件的文件id挂载到数据库 同名key按序列号保留较新的写入
+// 创建导入之前写入的key会被覆盖 导入期间写入或者删除的key序列号可能更大 挂载后不会被覆盖
+// 大value不会分离到blob文件中
+type BulkLoader struct {
+	// 在线导入的数据库 离线导入时为nil 下次打开数据库时挂载
+	db     *Db
+	option Options
+	// 导入目录 数据文件id从0开始
+	bulkPath string
+	// 当前写入的数据文件以及文件中的hint记录
+	activeFile *data.FileData
+	hints      []*data.HintRecord
+	// 还未写入数据文件的记录
+	buffer    bytes.Buffer
+	fileCount uint32
+	lastKey   []byte
+	// 最近分配的序列号以及预留的序列号上限
+	seq      uint64
+	seqLimit uint64
+	// 是否已经提交或者放弃
+	done bool
+}
+
+// NewBulkLoader 为打开的数据库创建批量导入 同一时间只能有一个批量导入
+func NewBulkLoader(db *Db) (*BulkLoader, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
+	if db.bulkLoading {
+		return nil, errors.New("正在批量导入中")
+	}
+
+	loader, err := newBulkLoader(db.option)
+	if err != nil {
+		return nil, err
+	}
+	loader.db = db
+	db.bulkLoading = true
+	db.tombstoneSeqs = make(map[string]uint64)
+	return loader, nil
+}
+
+// NewOfflineBulkLoader 为未打开的数据库创建批量导入 提交后在下次打开数据库时挂载 导入期间不能打开数据库
+func NewOfflineBulkLoader(options Options, opts ...Option) (*BulkLoader, error) {
+	option, err := buildOptions(options, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 序列号从已有数据中最大的序列号开始分配
+	seq, err := maxDataFileSeq(option.DirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	loader, err := newBulkLoader(option)
+	if err != nil {
+		return nil, err
+	}
+	loader.seq, loader.seqLimit = seq, math.MaxUint64
+	return loader, nil
+}
+
+func newBulkLoader(option Options) (*BulkLoader, error) {
+	bulkPath := option.DirPath + BulkPath
+	if _, err := os.Stat(bulkPath + data.BulkFinishFileName); err == nil {
+		return nil, errors.New("存在未挂载的批量导入")
+	}
+
+	// 清空上次未提交的导入
+	if err := os.RemoveAll(bulkPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(bulkPath, 0755); err != nil {
+		return nil, err
+	}
+
+	return &BulkLoader{option: option, bulkPath: bulkPath}, nil
+}
+
+// Add 写入一条kv key需要严格按升序写入
+func (loader *BulkLoader) Add(key []byte, value []byte) error {
+	if loader.done {
+		return errors.New("批量导入已结束")
+	}
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if loader.lastKey != nil && bytes.Compare(key, loader.lastKey) <= 0 {
+		return errors.New("key需要按升序写入")
+	}
+
+	// 数据文件达到阈值时写入下一个数据文件
+	if loader.activeFile == nil || loader.offset() >= loader.option.FileDataSize {
+		if err := loader.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seq := loader.nextSeq()
+	encodingData, size := data.EncodingLogRecord(&data.LogRecord{
+		Key:   EncodingTranKey(key, 0),
+		Value: value,
+		Type:  data.Normal,
+		Seq:   seq,
+	})
+	pos := &data.LogRecordPos{
+		FileId: loader.activeFile.FileId,
+		Pos:    loader.offset(),
+		Size:   uint32(size),
+		Seq:    seq,
+	}
+	loader.buffer.Write(encodingData)
+	if loader.buffer.Len() >= bulkWriteBufferSize {
+		if err := loader.flush(); err != nil {
+			return err
+		}
+	}
+
+	loader.lastKey = append([]byte{}, key...)
+	loader.hints = append(loader.hints, &data.HintRecord{Key: loader.lastKey, Type: data.Normal, Pos: pos})
+	return nil
+}
+
+// Commit 完成所有文件的写入并挂载到数据库 离线导入在下次打开数据库时挂载
+// 挂载过程中出错时数据库不再允许写入 重新打开数据库时继续挂载
+func (loader *BulkLoader) Commit() error {
+	if loader.done {
+		return errors.New("批量导入已结束")
+	}
+
+	// 文件没有全部写完时放弃导入 释放在线导入的占用
+	record, err := loader.finish()
+	if err != nil {
+		_ = loader.Abort()
+		return err
+	}
+	loader.done = true
+	if loader.db == nil {
+		return nil
+	}
+
+	db := loader.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.bulkLoading = false
+	defer func() {
+		db.tombstoneSeqs = nil
+	}()
+
+	if loader.fileCount == 0 {
+		return os.RemoveAll(loader.bulkPath)
+	}
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	return db.attachBulkFiles(record)
+}
+
+// Abort 放弃导入 删除已写入的文件
+func (loader *BulkLoader) Abort() error {
+	if loader.done {
+		return nil
+	}
+	loader.done = true
+
+	if loader.activeFile != nil {
+		_ = loader.activeFile.FileManage.Close()
+	}
+	if loader.db != nil {
+		loader.db.lock.Lock()
+		loader.db.bulkLoading = false
+		loader.db.tombstoneSeqs = nil
+		loader.db.lock.Unlock()
+	}
+	return os.RemoveAll(loader.bulkPath)
+}
+
+// finish 完成最后一个数据文件 并写入导入完成文件
+func (loader *BulkLoader) finish() (*data.BulkFinishRecord, error) {
+	if loader.activeFile != nil {
+		if err := loader.finishFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	record := &data.BulkFinishRecord{FileCount: loader.fileCount}
+	if loader.fileCount > 0 {
+		if err := data.WriteBulkFinishFile(loader.bulkPath, record); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// offset 当前数据文件的写入偏移 包括缓冲区中的记录
+func (loader *BulkLoader) offset() int64 {
+	return loader.activeFile.WriteOffset + int64(loader.buffer.Len())
+}
+
+func (loader *BulkLoader) flush() error {
+	if loader.buffer.Len() == 0 {
+		return nil
+	}
+	err := loader.activeFile.Write(loader.buffer.Bytes())
+	loader.buffer.Reset()
+	return err
+}
+
+// rotate 完成当前数据文件并创建下一个数据文件
+func (loader *BulkLoader) rotate() error {
+	if loader.activeFile != nil {
+		if err := loader.finishFile(); err != nil {
+			return err
+		}
+	}
+
+	fileData, err := data.OpenFileData(loader.bulkPath, loader.fileCount, nil)
+	if err != nil {
+		return err
+	}
+	loader.activeFile = fileData
+	loader.fileCount++
+	return nil
+}
+
+// finishFile 将当前数据文件刷盘 并写入对应的hint文件以及布隆过滤器
+func (loader *BulkLoader) finishFile() error {
+	if err := loader.flush(); err != nil {
+		return err
+	}
+	if err := loader.activeFile.FileManage.Sync(); err != nil {
+		return err
+	}
+	if err := loader.activeFile.FileManage.Close(); err != nil {
+		return err
+	}
+
+	fileId := loader.activeFile.FileId
+	if err := data.WriteHintFile(loader.bulkPath, fileId, loader.hints); err != nil {
+		return err
+	}
+	filter := data.NewBloomFilter(len(loader.hints), loader.option.BloomFalsePositive)
+	for _, hint := range loader.hints {
+		filter.Add(hint.Key)
+	}
+	if err := data.WriteBloomFile(loader.bulkPath, fileId, filter); err != nil {
+		return err
+	}
+
+	loader.activeFile = nil
+	loader.hints = nil
+	return nil
+}
+
+// nextSeq 分配序列号 在线导入时每次从数据库预留一批序列号 与其他写入不会重复
+func (loader *BulkLoader) nextSeq() uint64 {
+	if loader.seq >= loader.seqLimit {
+		db := loader.db
+		db.lock.Lock()
+		loader.seq = db.seq
+		db.seq += bulkSeqBlock
+		loader.seqLimit = db.seq
+		db.lock.Unlock()
+	}
+	loader.seq++
+	return loader.seq
+}
+
+// attachBulkFiles 归档活动文件后将导入的文件依次挂载到活动文件之后 并根据hint文件更新内存索引 调用方需要持有锁
+func (db *Db) attachBulkFiles(record *data.BulkFinishRecord) error {
+	err := db.archiveActiveFile()
+	if err != nil {
+		return err
+	}
+
+	// 活动文件已经归档 之后出错时不允许继续写入 避免写入已归档的文件
+	defer func() {
+		if err != nil {
+			db.attachErr = err
+		}
+	}()
+
+	// 先记录挂载后的文件id 移动文件中断时重新打开数据库可以继续挂载
+	record.Assigned = true
+	record.BaseFileId = db.activeFile.FileId + 1
+	bulkPath := db.getBulkPath()
+	err = data.WriteBulkFinishFile(bulkPath, record)
+	if err != nil {
+		return err
+	}
+
+	txCache := make(map[int64]map[string]*data.HintRecord)
+	for i := uint32(0); i < record.FileCount; i++ {
+		fileId := record.BaseFileId + i
+		err = moveBulkFile(bulkPath, db.option.DirPath, i, fileId)
+		if err != nil {
+			return err
+		}
+
+		var fileData *data.FileData
+		fileData, err = data.OpenFileData(db.option.DirPath, fileId, db.blockCache)
+		if err != nil {
+			return err
+		}
+		var records []*data.HintRecord
+		records, err = db.LoadHintFile(fileData)
+		if err != nil {
+			return err
+		}
+		err = db.loadBloomFilter(fileData, records)
+		if err != nil {
+			return err
+		}
+		for _, hintRecord := range records {
+			db.loadRecord(hintRecord, txCache)
+		}
+		db.oldFile[fileId] = fileData
+	}
+
+	// 在导入的文件之后创建新的活动文件
+	var activeFile *data.FileData
+	activeFile, err = data.OpenFileData(db.option.DirPath, record.BaseFileId+record.FileCount, db.blockCache)
+	if err != nil {
+		return err
+	}
+	db.activeFile = activeFile
+	db.option.Logger.Info("bulk files attached", FileIdField(record.BaseFileId), Field{Key: FieldCount, Value: record.FileCount})
+
+	err = os.RemoveAll(bulkPath)
+	if err != nil {
+		return err
+	}
+
+	err = db.writeShadowedTombstones()
+	if err != nil {
+		return err
+	}
+	err = db.deleteAttachedMembers(record)
+	if err != nil {
+		return err
+	}
+
+	// 导入的数据没有二级索引条目 需要重建
+	for name := range db.secondaryIndexes {
+		err = db.rebuildIndex(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeShadowedTombstones 在导入的文件之后重新写入被忽略的key的墓碑 合并删除了更早的墓碑后导入的记录仍然不会生效 调用方需要持有锁
+func (db *Db) writeShadowedTombstones() error {
+	keys := db.shadowedKeys
+	db.shadowedKeys = nil
+	for _, key := range keys {
+		if db.index.Get(key) != nil {
+			continue
+		}
+		pos, err := db.AppendLogRecord(&data.LogRecord{
+			Key:  EncodingTranKey(key, 0),
+			Type: data.Deleted,
+		})
+		if err != nil {
+			return err
+		}
+		db.indexDelete(key, pos)
+	}
+	return nil
+}
+
+// deleteAttachedMembers 导入的记录覆盖了数据结构的key时删除所有成员 调用方需要持有锁
+// 导入的数据不包含成员 key当前的记录位于导入的文件中时 之前的成员全部失效
+func (db *Db) deleteAttachedMembers(record *data.BulkFinishRecord) error {
+	writes := make(map[string]*data.LogRecord)
+	prefix := []byte(dataStructurePrefix)
+	err := db.rangeMemberKeys(prefix, prefixUpperBound(prefix), func(memberKey []byte) {
+		keySize, index := binary.Uvarint(memberKey[len(prefix):])
+		start := len(prefix) + index
+		if index <= 0 || uint64(len(memberKey)-start) < keySize {
+			return
+		}
+		pos := db.index.Get(memberKey[start : start+int(keySize)])
+		if pos != nil && pos.FileId >= record.BaseFileId && pos.FileId < record.BaseFileId+record.FileCount {
+			writes[string(memberKey)] = deleteRecord(memberKey)
+		}
+	})
+	if err != nil || len(writes) == 0 {
+		return err
+	}
+	return db.commit(writes, false, false)
+}
+
+// recoverBulk 启动时处理批量导入目录 已提交的导入挂载到现有数据文件之后 未提交的导入直接丢弃
+func (db *Db) recoverBulk() error {
+	bulkPath := db.getBulkPath()
+	if _, err := os.Stat(bulkPath); os.IsNotExist(err) {
+		return nil
+	}
+	// 只读模式不修改数据目录 导入的数据在下次以读写模式打开时挂载
+	if db.option.ReadOnly {
+		db.option.Logger.Warn("bulk load not attached in read only mode", Field{Key: FieldPath, Value: bulkPath})
+		return nil
+	}
+
+	record, err := data.ReadBulkFinishFile(bulkPath)
+	if os.IsNotExist(err) {
+		db.option.Logger.Warn("uncommitted bulk load discarded", Field{Key: FieldPath, Value: bulkPath})
+		return os.RemoveAll(bulkPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !record.Assigned {
+		fileIds, err := dataFileIds(db.option.DirPath)
+		if err != nil {
+			return err
+		}
+		record.Assigned = true
+		if len(fileIds) > 0 {
+			record.BaseFileId = fileIds[len(fileIds)-1] + 1
+		}
+		err = data.WriteBulkFinishFile(bulkPath, record)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := uint32(0); i < record.FileCount; i++ {
+		err = moveBulkFile(bulkPath, db.option.DirPath, i, record.BaseFileId+i)
+		if err != nil {
+			return err
+		}
+	}
+	db.attachedBulk = record
+	db.option.Logger.Info("bulk files attached", FileIdField(record.BaseFileId), Field{Key: FieldCount, Value: record.FileCount})
+
+	return os.RemoveAll(bulkPath)
+}
+
+func (db *Db) getBulkPath() string {
+	return db.option.DirPath + BulkPath
+}
+
+// moveBulkFile 将导入目录中的数据文件以及对应的hint文件、布隆过滤器移动到数据目录并修改文件id 已移动的文件跳过
+func moveBulkFile(bulkPath string, dirPath string, fromFileId uint32, toFileId uint32) error {
+	fileNames := [][2]string{
+		{data.DataFileName(fromFileId), data.DataFileName(toFileId)},
+		{data.HintFileName(fromFileId), data.HintFileName(toFileId)},
+		{data.BloomFileName(fromFileId), data.BloomFileName(toFileId)},
+	}
+	for _, fileName := range fileNames {
+		err := os.Rename(bulkPath+fileName[0], dirPath+fileName[1])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataFileIds 获取目录下所有数据文件的id 按升序排列
+func dataFileIds(dirPath string) ([]uint32, error) {
+	entries, err := os.ReadDir(dirPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fileIds := make([]uint32, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), data.DataFileSuffix) {
+			continue
+		}
+		fileId, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), data.DataFileSuffix), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		fileIds = append(fileIds, uint32(fileId))
+	}
+	sort.Slice(fileIds, func(i, j int) bool {
+		return fileIds[i] < fileIds[j]
+	})
+	return fileIds, nil
+}
+
+// maxDataFileSeq 获取目录下数据文件中最大的序列号 序列号按写入顺序递增 只需要读取最后一个非空数据文件
+func maxDataFileSeq(dirPath string) (uint64, error) {
+	fileIds, err := dataFileIds(dirPath)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(fileIds) - 1; i >= 0; i-- {
+		fileData, err := data.OpenFileData(dirPath, fileIds[i], nil)
+		if err != nil {
+			return 0, err
+		}
+		_, records, err := readFileData(fileData)
+		_ = fileData.FileManage.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		var seq uint64 = 0
+		for _, record := range records {
+			if record.Pos.Seq > seq {
+				seq = record.Pos.Seq
+			}
+		}
+		if seq > 0 {
+			return seq, nil
+		}
+	}
+	return 0, nil
+}
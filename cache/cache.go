@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"github.com/RainbowSorcery/kv-project/data"
+	"sync/atomic"
+)
+
+const (
+	// PolicyLRU 最近最少使用淘汰
+	PolicyLRU = "lru"
+	// PolicyTinyLFU W-TinyLFU淘汰 根据访问频率决定新数据是否进入缓存 适合热点集中的场景
+	PolicyTinyLFU = "tinylfu"
+
+	// entryOverhead 每个缓存条目除key value之外的内存占用估算
+	entryOverhead = 64
+)
+
+// Key 缓存key 使用记录在文件中的位置 key被覆盖后会产生新的位置 旧的缓存不会再被访问
+type Key struct {
+	FileId uint32
+	Pos    int64
+}
+
+// Stat 缓存统计信息
+type Stat struct {
+	// 命中次数
+	Hits uint64
+	// 未命中次数
+	Misses uint64
+	// 缓存条目数
+	Count int
+	// 缓存占用字节数
+	Size int64
+}
+
+// Cache value缓存 容量以字节为单位
+type Cache interface {
+	// Get 获取缓存的记录
+	Get(key Key) (*data.LogRecord, bool)
+	// Put 添加记录到缓存中
+	Put(key Key, record *data.LogRecord)
+	// RemoveFile 删除指定数据文件的所有缓存 数据文件被合并重写后位置会被复用
+	RemoveFile(fileId uint32)
+	// Stat 获取缓存统计信息
+	Stat() Stat
+}
+
+// NewCache 根据淘汰策略创建缓存 未知的策略使用LRU
+func NewCache(policy string, capacity int64) Cache {
+	if policy == PolicyTinyLFU {
+		return NewTinyLFUCache(capacity)
+	}
+	return NewLRUCache(capacity)
+}
+
+// counter 缓存命中统计
+type counter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (counter *counter) record(hit bool) {
+	if hit {
+		atomic.AddUint64(&counter.hits, 1)
+	} else {
+		atomic.AddUint64(&counter.misses, 1)
+	}
+}
+
+func (counter *counter) stat(count int, size int64) Stat {
+	return Stat{
+		Hits:   atomic.LoadUint64(&counter.hits),
+		Misses: atomic.LoadUint64(&counter.misses),
+		Count:  count,
+		Size:   size,
+	}
+}
+
+// entry 缓存条目
+type entry struct {
+	key     Key
+	record  *data.LogRecord
+	size    int64
+	segment int
+}
+
+func newEntry(key Key, record *data.LogRecord) *entry {
+	return &entry{
+		key:    key,
+		record: record,
+		size:   int64(len(record.Key)+len(record.Value)) + entryOverhead,
+	}
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"github.com/RainbowSorcery/kv-project/data"
+	"testing"
+)
+
+func newRecord(value string) *data.LogRecord {
+	return &data.LogRecord{Key: []byte("k"), Value: []byte(value), Type: data.Normal}
+}
+
+func TestLRUCache_Evict(t *testing.T) {
+	cache := NewLRUCache(3 * (entryOverhead + 2))
+	for i := 0; i < 3; i++ {
+		cache.Put(Key{Pos: int64(i)}, newRecord("v"))
+	}
+	// 访问第一个key后 最久未使用的是第二个key
+	if _, ok := cache.Get(Key{Pos: 0}); !ok {
+		t.Fatal("缓存未命中")
+	}
+	cache.Put(Key{Pos: 3}, newRecord("v"))
+
+	if _, ok := cache.Get(Key{Pos: 1}); ok {
+		t.Fatal("最久未使用的key需要被淘汰")
+	}
+	stat := cache.Stat()
+	if stat.Count != 3 || stat.Hits != 1 || stat.Misses != 1 {
+		t.Fatalf("统计信息错误: %+v", stat)
+	}
+
+	cache.RemoveFile(0)
+	if cache.Stat().Count != 0 {
+		t.Fatal("删除文件缓存失败")
+	}
+}
+
+func TestTinyLFUCache_KeepHotKey(t *testing.T) {
+	cache := NewTinyLFUCache(100 * (entryOverhead + 2))
+	hotKey := Key{FileId: 1, Pos: 1}
+	cache.Put(hotKey, newRecord("v"))
+	for i := 0; i < 10; i++ {
+		cache.Get(hotKey)
+	}
+
+	// 大量只访问一次的数据不能把热点数据挤出缓存
+	for i := 0; i < 10000; i++ {
+		key := Key{FileId: 2, Pos: int64(i)}
+		cache.Get(key)
+		cache.Put(key, newRecord("v"))
+	}
+
+	if _, ok := cache.Get(hotKey); !ok {
+		t.Fatal("热点数据被淘汰")
+	}
+	if cache.Stat().Size > 100*(entryOverhead+2) {
+		t.Fatalf("缓存超出容量: %d", cache.Stat().Size)
+	}
+}
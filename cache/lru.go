@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/RainbowSorcery/kv-project/data"
+	"sync"
+)
+
+// LRUCache 最近最少使用淘汰的缓存
+type LRUCache struct {
+	counter
+	lock     *sync.Mutex
+	capacity int64
+	size     int64
+	items    map[Key]*list.Element
+	list     *list.List
+}
+
+// NewLRUCache 创建LRU缓存 capacity为缓存最大字节数
+func NewLRUCache(capacity int64) *LRUCache {
+	return &LRUCache{
+		lock:     new(sync.Mutex),
+		capacity: capacity,
+		items:    make(map[Key]*list.Element),
+		list:     list.New(),
+	}
+}
+
+func (cache *LRUCache) Get(key Key) (*data.LogRecord, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.items[key]
+	cache.record(ok)
+	if !ok {
+		return nil, false
+	}
+
+	cache.list.MoveToFront(element)
+	return element.Value.(*entry).record, true
+}
+
+func (cache *LRUCache) Put(key Key, record *data.LogRecord) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	newItem := newEntry(key, record)
+	// 超过缓存容量的记录不缓存
+	if newItem.size > cache.capacity {
+		return
+	}
+
+	if element, ok := cache.items[key]; ok {
+		cache.size -= element.Value.(*entry).size
+		element.Value = newItem
+		cache.size += newItem.size
+		cache.list.MoveToFront(element)
+	} else {
+		cache.items[key] = cache.list.PushFront(newItem)
+		cache.size += newItem.size
+	}
+
+	// 淘汰最久未使用的记录
+	for cache.size > cache.capacity {
+		cache.removeElement(cache.list.Back())
+	}
+}
+
+func (cache *LRUCache) RemoveFile(fileId uint32) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key, element := range cache.items {
+		if key.FileId == fileId {
+			cache.removeElement(element)
+		}
+	}
+}
+
+func (cache *LRUCache) Stat() Stat {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.stat(len(cache.items), cache.size)
+}
+
+func (cache *LRUCache) removeElement(element *list.Element) {
+	item := cache.list.Remove(element).(*entry)
+	delete(cache.items, item.key)
+	cache.size -= item.size
+}
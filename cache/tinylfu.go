@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/RainbowSorcery/kv-project/data"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// 窗口区 新数据先进入窗口区
+	segmentWindow = iota
+	// 试用区 从窗口区淘汰并通过频率准入的数据
+	segmentProbation
+	// 保护区 在试用区再次被访问的数据
+	segmentProtected
+)
+
+// TinyLFUCache W-TinyLFU淘汰的缓存
+// 新数据先进入容量为1%的窗口区 窗口区淘汰的数据与主缓存中即将被淘汰的数据比较访问频率 频率更高的数据才能进入主缓存
+// 主缓存分为试用区和保护区 在试用区中再次被访问的数据会晋升到保护区
+type TinyLFUCache struct {
+	counter
+	lock *sync.Mutex
+
+	capacity          int64
+	windowCapacity    int64
+	protectedCapacity int64
+
+	// 各区占用字节数
+	sizes [3]int64
+	lists [3]*list.List
+	items map[Key]*list.Element
+
+	sketch *countMinSketch
+}
+
+// NewTinyLFUCache 创建W-TinyLFU缓存 capacity为缓存最大字节数
+func NewTinyLFUCache(capacity int64) *TinyLFUCache {
+	windowCapacity := capacity / 100
+	if windowCapacity < 1 {
+		windowCapacity = 1
+	}
+
+	return &TinyLFUCache{
+		lock:              new(sync.Mutex),
+		capacity:          capacity,
+		windowCapacity:    windowCapacity,
+		protectedCapacity: (capacity - windowCapacity) * 8 / 10,
+		lists:             [3]*list.List{list.New(), list.New(), list.New()},
+		items:             make(map[Key]*list.Element),
+		// 按每条记录平均占用512字节估算条目数
+		sketch: newCountMinSketch(capacity / 512),
+	}
+}
+
+func (cache *TinyLFUCache) Get(key Key) (*data.LogRecord, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.sketch.increment(key)
+	element, ok := cache.items[key]
+	cache.record(ok)
+	if !ok {
+		return nil, false
+	}
+
+	item := element.Value.(*entry)
+	switch item.segment {
+	case segmentWindow, segmentProtected:
+		cache.lists[item.segment].MoveToFront(element)
+	case segmentProbation:
+		// 试用区中再次被访问的数据晋升到保护区
+		cache.move(element, segmentProtected)
+		// 保护区超出容量时将最久未使用的数据降级到试用区
+		for cache.sizes[segmentProtected] > cache.protectedCapacity {
+			cache.move(cache.lists[segmentProtected].Back(), segmentProbation)
+		}
+	}
+
+	return item.record, true
+}
+
+func (cache *TinyLFUCache) Put(key Key, record *data.LogRecord) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	newItem := newEntry(key, record)
+	if newItem.size > cache.capacity {
+		return
+	}
+	if element, ok := cache.items[key]; ok {
+		cache.removeElement(element)
+	}
+
+	newItem.segment = segmentWindow
+	cache.items[key] = cache.lists[segmentWindow].PushFront(newItem)
+	cache.sizes[segmentWindow] += newItem.size
+
+	// 窗口区超出容量时 淘汰的数据尝试进入主缓存
+	for cache.sizes[segmentWindow] > cache.windowCapacity && cache.lists[segmentWindow].Len() > 1 {
+		candidate := cache.lists[segmentWindow].Back()
+		cache.move(candidate, segmentProbation)
+		cache.admit(candidate)
+	}
+}
+
+// admit 主缓存超出容量时 比较候选数据与主缓存中即将被淘汰数据的访问频率 淘汰频率低的数据
+func (cache *TinyLFUCache) admit(candidate *list.Element) {
+	candidateItem := candidate.Value.(*entry)
+	candidateFrequency := cache.sketch.estimate(candidateItem.key)
+
+	for cache.mainSize() > cache.capacity-cache.sizes[segmentWindow] {
+		victim := cache.lists[segmentProbation].Back()
+		if victim == candidate {
+			victim = victim.Prev()
+		}
+		if victim == nil {
+			victim = cache.lists[segmentProtected].Back()
+		}
+		if victim == nil {
+			cache.removeElement(candidate)
+			return
+		}
+
+		if candidateFrequency <= cache.sketch.estimate(victim.Value.(*entry).key) {
+			cache.removeElement(candidate)
+			return
+		}
+		cache.removeElement(victim)
+	}
+}
+
+func (cache *TinyLFUCache) RemoveFile(fileId uint32) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key, element := range cache.items {
+		if key.FileId == fileId {
+			cache.removeElement(element)
+		}
+	}
+}
+
+func (cache *TinyLFUCache) Stat() Stat {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.stat(len(cache.items), cache.sizes[segmentWindow]+cache.mainSize())
+}
+
+func (cache *TinyLFUCache) mainSize() int64 {
+	return cache.sizes[segmentProbation] + cache.sizes[segmentProtected]
+}
+
+// move 将条目移动到指定区的头部
+func (cache *TinyLFUCache) move(element *list.Element, segment int) {
+	item := element.Value.(*entry)
+	cache.lists[item.segment].Remove(element)
+	cache.sizes[item.segment] -= item.size
+
+	item.segment = segment
+	cache.items[item.key] = cache.lists[segment].PushFront(item)
+	cache.sizes[segment] += item.size
+}
+
+func (cache *TinyLFUCache) removeElement(element *list.Element) {
+	item := element.Value.(*entry)
+	cache.lists[item.segment].Remove(element)
+	cache.sizes[item.segment] -= item.size
+	delete(cache.items, item.key)
+}
+
+// countMinSketch 使用多行计数器估算key的访问频率 计数达到采样数后所有计数减半 使频率随时间衰减
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int64
+	sampleSize int64
+}
+
+func newCountMinSketch(expectedCount int64) *countMinSketch {
+	width := int64(1024)
+	for width < expectedCount && width < 1<<22 {
+		width <<= 1
+	}
+
+	sketch := &countMinSketch{
+		mask:       uint64(width - 1),
+		sampleSize: width * 10,
+	}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, width)
+	}
+	return sketch
+}
+
+func (sketch *countMinSketch) increment(key Key) {
+	h1, h2 := sketchHash(key)
+	for i := range sketch.rows {
+		index := (h1 + uint64(i)*h2) & sketch.mask
+		if sketch.rows[i][index] < 15 {
+			sketch.rows[i][index]++
+		}
+	}
+
+	sketch.additions++
+	if sketch.additions >= sketch.sampleSize {
+		sketch.reset()
+	}
+}
+
+func (sketch *countMinSketch) estimate(key Key) uint8 {
+	h1, h2 := sketchHash(key)
+	var frequency uint8 = 15
+	for i := range sketch.rows {
+		index := (h1 + uint64(i)*h2) & sketch.mask
+		if sketch.rows[i][index] < frequency {
+			frequency = sketch.rows[i][index]
+		}
+	}
+	return frequency
+}
+
+func (sketch *countMinSketch) reset() {
+	for i := range sketch.rows {
+		for j := range sketch.rows[i] {
+			sketch.rows[i][j] >>= 1
+		}
+	}
+	sketch.additions /= 2
+}
+
+func sketchHash(key Key) (uint64, uint64) {
+	hash := fnv.New64a()
+	var buffer [12]byte
+	for i := 0; i < 4; i++ {
+		buffer[i] = byte(key.FileId >> (8 * i))
+	}
+	for i := 0; i < 8; i++ {
+		buffer[4+i] = byte(key.Pos >> (8 * i))
+	}
+	_, _ = hash.Write(buffer[:])
+	sum := hash.Sum64()
+	return sum, sum>>32 | 1
+}
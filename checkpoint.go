@@ -0,0 +1,157 @@
+package kv
+
+import (
+	"errors"
+	"github.com/RainbowSorcery/kv-project/data"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// checkpointCopy 需要复制的文件 活动文件只复制到创建检查点时的写入偏移
+type checkpointCopy struct {
+	file *os.File
+	name string
+	size int64
+}
+
+// Checkpoint 在dir中创建数据库当前时间点的副本 可以直接作为数据目录打开
+// 非活动的数据文件、hint文件、布隆过滤器文件以及blob文件通过硬链接创建 不在同一个文件系统时复制
+// 活动文件复制到当前的写入偏移 创建期间会短暂阻塞读写 dir需要不存在或者为空目录
+func (db *Db) Checkpoint(dir string) error {
+	if err := prepareCheckpointDir(dir); err != nil {
+		return err
+	}
+
+	copies, err := db.linkCheckpointFiles(dir)
+	for _, fileCopy := range copies {
+		if err == nil {
+			err = copyFileRange(fileCopy.file, filepath.Join(dir, fileCopy.name), fileCopy.size)
+		}
+		_ = fileCopy.file.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	db.option.Logger.Info("checkpoint created", Field{Key: FieldPath, Value: dir})
+	return syncDir(dir)
+}
+
+// linkCheckpointFiles 持有锁将活动文件刷盘并链接非活动文件 合并替换文件以及blob回收删除文件都需要持有锁 链接期间文件不会被删除
+// 返回需要复制的文件的只读句柄以及复制长度 包括活动文件以及无法链接的非活动文件 持有锁时只打开文件 释放锁之后再复制
+// 文件之后被替换或者删除时句柄仍然指向原文件 活动文件只会追加 复制也只会读取到创建检查点时的数据
+func (db *Db) linkCheckpointFiles(dir string) ([]*checkpointCopy, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	// 数据文件中的BlobIndex记录依赖blob文件 先刷blob文件
+	if err := db.syncBlob(); err != nil {
+		return nil, err
+	}
+	if err := db.syncFile(db.activeFile.FileManage); err != nil {
+		return nil, err
+	}
+
+	fileNames := []string{data.MergeFinishFileName}
+	for fileId := range db.oldFile {
+		fileNames = append(fileNames, data.DataFileName(fileId), data.HintFileName(fileId), data.BloomFileName(fileId))
+	}
+	for fileId, blobFile := range db.blobFiles {
+		if blobFile != db.activeBlobFile {
+			fileNames = append(fileNames, data.BlobFileName(fileId))
+		}
+	}
+
+	copies := make([]*checkpointCopy, 0, 2)
+	// openCopy 打开需要复制的文件 size小于0时复制整个文件
+	openCopy := func(name string, size int64) error {
+		file, err := os.Open(db.option.DirPath + name)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			stat, err := file.Stat()
+			if err != nil {
+				_ = file.Close()
+				return err
+			}
+			size = stat.Size()
+		}
+		copies = append(copies, &checkpointCopy{file: file, name: name, size: size})
+		return nil
+	}
+
+	err := linkFiles(db.option.DirPath, dir, fileNames, openCopy)
+	if err == nil {
+		err = openCopy(data.DataFileName(db.activeFile.FileId), db.activeFile.WriteOffset)
+	}
+	if err == nil && db.activeBlobFile != nil {
+		err = openCopy(data.BlobFileName(db.activeBlobFile.FileId), db.activeBlobFile.WriteOffset)
+	}
+	if err != nil {
+		for _, fileCopy := range copies {
+			_ = fileCopy.file.Close()
+		}
+		return nil, err
+	}
+	return copies, nil
+}
+
+// linkFiles 创建硬链接 不支持硬链接时通过openCopy打开文件等待复制
+func linkFiles(dirPath string, dir string, fileNames []string, openCopy func(name string, size int64) error) error {
+	for _, fileName := range fileNames {
+		err := os.Link(dirPath+fileName, filepath.Join(dir, fileName))
+		// 非活动文件不一定存在hint文件以及布隆过滤器文件 没有合并过时也不存在合并完成文件
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		if err := openCopy(fileName, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareCheckpointDir 创建检查点目录 目录已存在时需要为空
+func prepareCheckpointDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return errors.New("检查点目录不为空")
+	}
+	return nil
+}
+
+// copyFileRange 将文件开头size字节复制到新文件并刷盘
+func copyFileRange(file *os.File, to string, size int64) error {
+	target, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	if _, err := io.Copy(target, io.NewSectionReader(file, 0, size)); err != nil {
+		return err
+	}
+	return target.Sync()
+}
+
+// syncDir 刷新目录 保证目录中新建的文件持久化
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
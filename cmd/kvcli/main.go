@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	kv "github.com/RainbowSorcery/kv-project"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+func main() {
+	dirPath := flag.String("dir", "", "数据目录")
+	format := flag.String("format", formatText, "value显示格式 text、hex或者base64")
+	readOnly := flag.Bool("readonly", false, "以只读模式打开")
+	flag.Parse()
+
+	if *dirPath == "" {
+		fmt.Fprintln(os.Stderr, "用法: kvcli -dir <数据目录> [-format text|hex|base64] [-readonly]")
+		os.Exit(2)
+	}
+
+	opts := []kv.Option{kv.WithDirPath(*dirPath)}
+	if *readOnly {
+		opts = append(opts, kv.WithReadOnly())
+	}
+	db, err := kv.Open(kv.DefaultOptions, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	shell := newShell(db)
+	if err := shell.setFormat(*format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// 标准输入不是终端时按行执行命令 用于脚本
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		runScript(shell, os.Stdin)
+		return
+	}
+	if err := runTerminal(shell); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// runTerminal 交互式执行命令 支持历史记录以及tab补全
+func runTerminal(shell *shell) error {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "kv> ")
+	terminal.AutoCompleteCallback = shell.complete
+	if width, height, err := term.GetSize(fd); err == nil {
+		_ = terminal.SetSize(width, height)
+	}
+	shell.out = terminal
+
+	for {
+		line, err := terminal.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		exit, err := shell.execute(line)
+		if err != nil {
+			fmt.Fprintf(terminal, "错误: %v\n", err)
+		}
+		if exit {
+			return nil
+		}
+		terminal.SetPrompt(shell.prompt())
+	}
+}
+
+// runScript 逐行执行reader中的命令
+func runScript(shell *shell, reader io.Reader) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		exit, err := shell.execute(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "错误: %v\n", err)
+		}
+		if exit {
+			return
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	kv "github.com/RainbowSorcery/kv-project"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	formatText   = "text"
+	formatHex    = "hex"
+	formatBase64 = "base64"
+
+	// maxCompleteKeys tab补全时最多读取的key数量
+	maxCompleteKeys = 256
+	// defaultScanLimit scan默认返回的key数量
+	defaultScanLimit = 100
+)
+
+// commands 支持的命令以及说明 用于help以及补全
+var commands = map[string]string{
+	"get":    "get <key>                          读取key",
+	"put":    "put <key> <value>                  写入key 批量写入中时加入批次",
+	"del":    "del <key>                          删除key 批量写入中时加入批次",
+	"scan":   "scan [--prefix p] [--reverse] [--limit n]  遍历key",
+	"batch":  "batch begin|commit|discard          开始、提交或者放弃批量写入",
+	"merge":  "merge                              合并数据文件",
+	"stat":   "stat                               查看统计信息",
+	"dump":   "dump                               输出所有key、value以及序列号",
+	"format": "format text|hex|base64             设置value显示格式",
+	"help":   "help                               查看帮助",
+	"exit":   "exit                               退出",
+}
+
+// keyCommands 第一个参数为key的命令 补全时补全key
+var keyCommands = map[string]struct{}{"get": {}, "put": {}, "del": {}}
+
+// shell 解析并执行命令
+type shell struct {
+	db     *kv.Db
+	out    io.Writer
+	format string
+	// 当前批量写入 为nil表示不在批量写入中
+	batch *kv.BatchWrite
+}
+
+func newShell(db *kv.Db) *shell {
+	return &shell{db: db, out: os.Stdout, format: formatText}
+}
+
+func (shell *shell) prompt() string {
+	if shell.batch != nil {
+		return fmt.Sprintf("kv(batch %d)> ", len(shell.batch.PendingWrites))
+	}
+	return "kv> "
+}
+
+func (shell *shell) setFormat(format string) error {
+	switch format {
+	case formatText, formatHex, formatBase64:
+		shell.format = format
+		return nil
+	}
+	return fmt.Errorf("不支持的显示格式: %s", format)
+}
+
+// execute 执行一行命令 返回是否退出
+func (shell *shell) execute(line string) (bool, error) {
+	args, err := splitArgs(line)
+	if err != nil || len(args) == 0 {
+		return false, err
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "get":
+		return false, shell.get(args)
+	case "put":
+		return false, shell.put(args)
+	case "del":
+		return false, shell.del(args)
+	case "scan":
+		return false, shell.scan(args)
+	case "batch":
+		return false, shell.batchCommand(args)
+	case "merge":
+		if err := shell.db.Merge(); err != nil {
+			return false, err
+		}
+		fmt.Fprintln(shell.out, "OK")
+		return false, nil
+	case "stat":
+		shell.stat()
+		return false, nil
+	case "dump":
+		return false, shell.dump()
+	case "format":
+		if len(args) != 1 {
+			return false, errors.New("用法: " + commands["format"])
+		}
+		return false, shell.setFormat(args[0])
+	case "help":
+		shell.help()
+		return false, nil
+	case "exit", "quit":
+		if shell.batch != nil {
+			fmt.Fprintf(shell.out, "放弃未提交的批量写入 共%d条\n", len(shell.batch.PendingWrites))
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("未知命令: %s 输入help查看帮助", command)
+}
+
+func (shell *shell) get(args []string) error {
+	if len(args) != 1 {
+		return errors.New("用法: " + commands["get"])
+	}
+	record, err := shell.db.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(shell.out, shell.formatValue(record.Value))
+	return nil
+}
+
+func (shell *shell) put(args []string) error {
+	if len(args) != 2 {
+		return errors.New("用法: " + commands["put"])
+	}
+	var err error
+	if shell.batch != nil {
+		err = shell.batch.Put([]byte(args[0]), []byte(args[1]))
+	} else {
+		err = shell.db.Put([]byte(args[0]), []byte(args[1]))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(shell.out, "OK")
+	return nil
+}
+
+func (shell *shell) del(args []string) error {
+	if len(args) != 1 {
+		return errors.New("用法: " + commands["del"])
+	}
+	var err error
+	if shell.batch != nil {
+		err = shell.batch.Delete([]byte(args[0]))
+	} else {
+		err = shell.db.Delete([]byte(args[0]))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(shell.out, "OK")
+	return nil
+}
+
+func (shell *shell) scan(args []string) error {
+	flagSet := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	prefix := flagSet.String("prefix", "", "key前缀")
+	reverse := flagSet.Bool("reverse", false, "倒序遍历")
+	limit := flagSet.Int("limit", defaultScanLimit, "最多返回的key数量 小于等于0表示不限制")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() > 0 {
+		return errors.New("用法: " + commands["scan"])
+	}
+
+	iterator := kv.NewDbIterator(shell.db, kv.IteratorOption{Prefix: []byte(*prefix), Reverse: *reverse})
+	defer iterator.Close()
+
+	count := 0
+	for ; iterator.HasNext(); iterator.Next() {
+		if *limit > 0 && count >= *limit {
+			fmt.Fprintf(shell.out, "... 超过%d条 使用--limit调整\n", *limit)
+			break
+		}
+		key, err := iterator.Key()
+		if err != nil {
+			return err
+		}
+		record, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(shell.out, "%s\t%s\n", formatKey(key), shell.formatValue(record.Value))
+		count++
+	}
+	fmt.Fprintf(shell.out, "共%d条\n", count)
+	return nil
+}
+
+func (shell *shell) batchCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("用法: " + commands["batch"])
+	}
+	switch args[0] {
+	case "begin":
+		if shell.batch != nil {
+			return errors.New("已经在批量写入中")
+		}
+		shell.batch = kv.NewBatchWrite(shell.db)
+	case "commit":
+		if shell.batch == nil {
+			return errors.New("没有进行中的批量写入")
+		}
+		count := len(shell.batch.PendingWrites)
+		if err := shell.batch.Commit(); err != nil {
+			return err
+		}
+		fmt.Fprintf(shell.out, "已提交%d条\n", count)
+		shell.batch = nil
+		return nil
+	case "discard":
+		if shell.batch == nil {
+			return errors.New("没有进行中的批量写入")
+		}
+		shell.batch = nil
+	default:
+		return errors.New("用法: " + commands["batch"])
+	}
+	fmt.Fprintln(shell.out, "OK")
+	return nil
+}
+
+func (shell *shell) stat() {
+	stat := shell.db.Stat()
+	fmt.Fprintf(shell.out, "key数量: %d\n", stat.KeyNum)
+	fmt.Fprintf(shell.out, "数据文件: %d个 %d字节 有效数据%d字节 可回收%d字节\n", stat.DataFileNum, stat.DiskSize, stat.LiveSize, stat.ReclaimableSize)
+	fmt.Fprintf(shell.out, "活动文件: %d 写入偏移%d\n", stat.ActiveFileId, stat.ActiveFileOffset)
+	fmt.Fprintf(shell.out, "blob文件: %d个 %d字节 可回收%d字节\n", stat.BlobFileNum, stat.BlobSize, stat.BlobReclaimableSize)
+	if stat.LastMergeTime.IsZero() {
+		fmt.Fprintf(shell.out, "最近合并: 无 合并中: %t\n", stat.MergeIng)
+	} else {
+		fmt.Fprintf(shell.out, "最近合并: %s 合并中: %t\n", stat.LastMergeTime.Format("2006-01-02 15:04:05"), stat.MergeIng)
+	}
+}
+
+// dump 边遍历边输出 不需要将所有记录读入内存
+func (shell *shell) dump() error {
+	iterator := kv.NewDbIterator(shell.db, kv.IteratorOption{})
+	defer iterator.Close()
+
+	for ; iterator.HasNext(); iterator.Next() {
+		key, err := iterator.Key()
+		if err != nil {
+			return err
+		}
+		record, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(shell.out, "%d\t%s\t%s\n", record.Seq, formatKey(key), shell.formatValue(record.Value))
+	}
+	return nil
+}
+
+func (shell *shell) help() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(shell.out, "  "+commands[name])
+	}
+	fmt.Fprintln(shell.out, "  key以及value中包含空格或者不可见字符时使用双引号 支持Go字符串转义")
+}
+
+// complete tab补全 第一个参数补全命令 get、put、del的key参数补全已存在的key
+func (shell *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	head := line[:pos]
+	start := strings.LastIndexByte(head, ' ') + 1
+	word := head[start:]
+	fields := strings.Fields(head[:start])
+
+	candidates := make([]string, 0)
+	switch {
+	case len(fields) == 0:
+		for name := range commands {
+			if strings.HasPrefix(name, word) {
+				candidates = append(candidates, name)
+			}
+		}
+	case len(fields) == 1:
+		if _, ok := keyCommands[fields[0]]; !ok || strings.HasPrefix(word, `"`) {
+			return "", 0, false
+		}
+		iterator := kv.NewDbIterator(shell.db, kv.IteratorOption{Prefix: []byte(word)})
+		for ; iterator.HasNext() && len(candidates) < maxCompleteKeys; iterator.Next() {
+			key, err := iterator.Key()
+			if err != nil {
+				break
+			}
+			// 包含空格或者不可见字符的key需要加引号 不参与补全
+			if isPlainKey(key) {
+				candidates = append(candidates, string(key))
+			}
+		}
+		_ = iterator.Close()
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 {
+		completion += " "
+	}
+	if len(completion) <= len(word) {
+		return "", 0, false
+	}
+	return head[:start] + completion + line[pos:], start + len(completion), true
+}
+
+// formatValue 按显示格式输出value
+func (shell *shell) formatValue(value []byte) string {
+	switch shell.format {
+	case formatHex:
+		return hex.EncodeToString(value)
+	case formatBase64:
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	if utf8.Valid(value) {
+		return string(value)
+	}
+	return strconv.Quote(string(value))
+}
+
+// formatKey 输出key 包含空格或者不可见字符时加引号
+func formatKey(key []byte) string {
+	if isPlainKey(key) {
+		return string(key)
+	}
+	return strconv.Quote(string(key))
+}
+
+// isPlainKey 判断key是否可以不加引号输入
+func isPlainKey(key []byte) bool {
+	if !utf8.Valid(key) || strings.HasPrefix(string(key), `"`) {
+		return false
+	}
+	for _, r := range string(key) {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// commonPrefix 获取字符串的公共前缀
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(value, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	// 截断时不能拆开多字节字符
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
+
+// splitArgs 按空白拆分命令参数 双引号内的内容作为一个参数并按Go字符串转义
+func splitArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return args, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("引号不匹配: %s", line)
+		}
+		arg, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		line = line[len(quoted):]
+	}
+}
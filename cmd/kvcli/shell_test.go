@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	kv "github.com/RainbowSorcery/kv-project"
+	"strings"
+	"testing"
+)
+
+func TestShell_Execute(t *testing.T) {
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	out := &bytes.Buffer{}
+	shell := newShell(db)
+	shell.out = out
+	for _, line := range []string{
+		`put user:1 alice`,
+		`put "user:2" "bob smith"`,
+		`batch begin`,
+		`put order:1 "\x00\x01"`,
+		`del user:1`,
+		`batch commit`,
+		`format hex`,
+		`get order:1`,
+	} {
+		if _, err := shell.execute(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	if !strings.HasSuffix(out.String(), "0001\n") {
+		t.Fatalf("hex格式输出错误: %q", out.String())
+	}
+
+	out.Reset()
+	shell.format = formatText
+	if _, err := shell.execute(`scan --prefix user: --limit 10`); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "user:2\tbob smith\n共1条\n" {
+		t.Fatalf("scan输出错误: %q", out.String())
+	}
+
+	out.Reset()
+	if _, err := shell.execute(`dump`); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[1], "\tuser:2\tbob smith") {
+		t.Fatalf("dump输出错误: %q", out.String())
+	}
+
+	if _, err := shell.execute(`get user:1`); err == nil {
+		t.Fatal("批量删除的key不能读取")
+	}
+	if exit, _ := shell.execute("exit"); !exit {
+		t.Fatal("exit需要退出")
+	}
+}
+
+func TestShell_Complete(t *testing.T) {
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"user:100", "user:101", "order:1"} {
+		if err := db.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shell := newShell(db)
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"me", "merge "},
+		{"get us", "get user:10"},
+		{"del or", "del order:1 "},
+	}
+	for _, c := range cases {
+		line, pos, ok := shell.complete(c.line, len(c.line), '\t')
+		if !ok || line != c.expected || pos != len(c.expected) {
+			t.Fatalf("%q 补全结果错误: %q", c.line, line)
+		}
+	}
+	if _, _, ok := shell.complete("scan us", len("scan us"), '\t'); ok {
+		t.Fatal("scan参数不补全key")
+	}
+}
@@ -2,14 +2,14 @@ package main
 
 import (
 	"fmt"
+	kv "github.com/RainbowSorcery/kv-project"
+	"os"
+	"path/filepath"
 	"strconv"
 )
 
 func main() {
-	db, err := open(option{
-		DirPath:      "d://kv/",
-		FileDataSize: 1024,
-	})
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(filepath.Join(os.TempDir(), "kv-database")), kv.WithFileDataSize(1024))
 	if err != nil {
 		panic(err)
 	}
@@ -29,12 +29,12 @@ func main() {
 
 }
 
-func creatData(db *Db, index int) {
+func creatData(db *kv.Db, index int) {
 	for i := 0; i < index; i++ {
 		_ = db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i)))
 	}
 }
-func getData(db *Db, index int) {
+func getData(db *kv.Db, index int) {
 	for i := 0; i < index; i++ {
 		get, err := db.Get([]byte(strconv.Itoa(i)))
 		if err != nil {
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	kv "github.com/RainbowSorcery/kv-project"
+	"github.com/RainbowSorcery/kv-project/data"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// filter 记录过滤条件
+type filter struct {
+	// 只输出key相同的记录 为nil表示不过滤
+	key []byte
+	// 只输出key为指定前缀的记录
+	prefix []byte
+	// 只输出偏移在[from, to)范围内的记录 to小于等于0表示不限制
+	from int64
+	to   int64
+	// 是否输出value
+	values bool
+}
+
+func (filter *filter) match(offset int64, key []byte) bool {
+	if offset < filter.from || (filter.to > 0 && offset >= filter.to) {
+		return false
+	}
+	if filter.key != nil && !bytes.Equal(key, filter.key) {
+		return false
+	}
+	return bytes.HasPrefix(key, filter.prefix)
+}
+
+// valueColumn 输出value时的表头
+func (filter *filter) valueColumn() string {
+	if filter.values {
+		return "\tVALUE"
+	}
+	return ""
+}
+
+func main() {
+	key := flag.String("key", "", "只输出指定key的记录")
+	prefix := flag.String("prefix", "", "只输出key为指定前缀的记录")
+	from := flag.Int64("from", 0, "起始偏移 包含")
+	to := flag.Int64("to", 0, "结束偏移 不包含 为0表示到文件末尾")
+	values := flag.Bool("values", false, "输出value")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "用法: kvdump [选项] <.data文件|.hint文件|merge-finish.done>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	recordFilter := &filter{prefix: []byte(*prefix), from: *from, to: *to, values: *values}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "key" {
+			recordFilter.key = []byte(*key)
+		}
+	})
+
+	ok, err := dumpFile(os.Stdout, flag.Arg(0), recordFilter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// 存在损坏的记录时返回非0状态码 便于脚本判断
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// dumpFile 根据文件名称选择解析方式 返回文件中的记录是否全部完好
+func dumpFile(out io.Writer, path string, recordFilter *filter) (bool, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer writer.Flush()
+
+	name := filepath.Base(path)
+	switch {
+	case strings.HasSuffix(name, data.DataFileSuffix):
+		return dumpDataFile(writer, buffer, recordFilter), nil
+	case strings.HasSuffix(name, data.HintFileSuffix):
+		return dumpHintFile(writer, buffer, recordFilter), nil
+	case name == data.MergeFinishFileName:
+		return dumpMergeFinishFile(writer, buffer)
+	}
+	return false, fmt.Errorf("不支持的文件类型: %s", name)
+}
+
+// dumpDataFile 逐条解析数据文件 crc校验失败的记录标记后继续解析
+func dumpDataFile(out io.Writer, buffer []byte, recordFilter *filter) bool {
+	fmt.Fprintln(out, "OFFSET\tCRC\tTYPE\tTX\tSEQ\tKEY_SIZE\tVALUE_SIZE\tKEY\tSTATUS"+recordFilter.valueColumn())
+
+	ok := true
+	var offset int64 = 0
+	for offset < int64(len(buffer)) {
+		// 文件末尾不足一个最大记录头时补0解析 与数据文件读取保持一致
+		headerBuffer := make([]byte, data.MaxLogRecordHeaderSize)
+		copy(headerBuffer, buffer[offset:])
+		header, headerSize := data.DecodingLogRecordHeader(headerBuffer)
+		if header.Crc == 0 && header.KeySize == 0 && header.ValueSize == 0 {
+			break
+		}
+
+		recordSize := headerSize + int64(header.KeySize) + int64(header.ValueSize)
+		if offset+recordSize > int64(len(buffer)) {
+			fmt.Fprintf(out, "%d\t%08x\t%s\t\t%d\t%d\t%d\t\t记录不完整 剩余%d字节\n", offset, header.Crc, typeName(header.Type),
+				header.Seq, header.KeySize, header.ValueSize, int64(len(buffer))-offset)
+			return false
+		}
+
+		record := &data.LogRecord{
+			Key:   buffer[offset+headerSize : offset+headerSize+int64(header.KeySize)],
+			Value: buffer[offset+headerSize+int64(header.KeySize) : offset+recordSize],
+			Type:  header.Type,
+			Seq:   header.Seq,
+		}
+		status := "OK"
+		if data.GetLogRecordCRC(record, headerBuffer[4:headerSize]) != header.Crc {
+			status = "CRC错误"
+			ok = false
+		}
+
+		tranNum, key := kv.DecodingTranKey(record.Key)
+		if recordFilter.match(offset, key) || status != "OK" {
+			fmt.Fprintf(out, "%d\t%08x\t%s\t%d\t%d\t%d\t%d\t%s\t%s", offset, header.Crc, typeName(header.Type),
+				tranNum, header.Seq, len(key), header.ValueSize, quote(key), status)
+			if recordFilter.values {
+				fmt.Fprintf(out, "\t%s", quote(record.Value))
+			}
+			fmt.Fprintln(out)
+		}
+
+		offset += recordSize
+	}
+	return ok
+}
+
+// dumpHintFile 逐条解析hint文件
+func dumpHintFile(out io.Writer, buffer []byte, recordFilter *filter) bool {
+	fmt.Fprintln(out, "OFFSET\tTYPE\tTX\tSEQ\tFILE_ID\tPOS\tSIZE\tKEY"+recordFilter.valueColumn())
+
+	if !bytes.HasPrefix(buffer, []byte(data.HintFileHeader)) {
+		fmt.Fprintf(out, "0\t%v\n", data.ErrStaleHint)
+		return false
+	}
+
+	var offset = int64(len(data.HintFileHeader))
+	for offset < int64(len(buffer)) {
+		record, size, err := data.DecodingHintRecord(buffer[offset:])
+		if err != nil {
+			fmt.Fprintf(out, "%d\t%v\n", offset, err)
+			return false
+		}
+
+		if recordFilter.match(offset, record.Key) {
+			fmt.Fprintf(out, "%d\t%s\t%d\t%d\t%d\t%d\t%d\t%s", offset, typeName(record.Type), record.TranNum,
+				record.Pos.Seq, record.Pos.FileId, record.Pos.Pos, record.Pos.Size, quote(record.Key))
+			// hint文件只有BlobIndex记录保存value 内容为blob文件中的位置
+			if recordFilter.values && record.Type == data.BlobIndex {
+				if blobPos, err := data.DecodingBlobPos(record.Value); err == nil {
+					fmt.Fprintf(out, "\tblob=%d offset=%d size=%d", blobPos.FileId, blobPos.Offset, blobPos.Size)
+				}
+			}
+			fmt.Fprintln(out)
+		}
+		offset += size
+	}
+	return true
+}
+
+// dumpMergeFinishFile 解析合并完成记录
+func dumpMergeFinishFile(out io.Writer, buffer []byte) (bool, error) {
+	record, err := data.DecodingMergeFinishRecord(buffer)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(out, "FINISH_COUNT\t%d\n", record.FinishCount)
+	fileIds := make([]string, 0, len(record.MergerFinishFileIds))
+	for _, fileId := range record.MergerFinishFileIds {
+		fileIds = append(fileIds, strconv.FormatUint(uint64(fileId), 10))
+	}
+	fmt.Fprintf(out, "FILE_IDS\t%s\n", strings.Join(fileIds, ","))
+	return true, nil
+}
+
+func typeName(recordType data.LogRecordType) string {
+	switch recordType {
+	case data.Deleted:
+		return "Deleted"
+	case data.Normal:
+		return "Normal"
+	case data.TxComplete:
+		return "TxComplete"
+	case data.BlobIndex:
+		return "BlobIndex"
+	case data.MergeOperand:
+		return "MergeOperand"
+	}
+	return fmt.Sprintf("Unknown(%d)", recordType)
+}
+
+// quote 输出key或者value 不可见字符转义
+func quote(value []byte) string {
+	return strconv.Quote(string(value))
+}
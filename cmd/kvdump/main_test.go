@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	kv "github.com/RainbowSorcery/kv-project"
+	"github.com/RainbowSorcery/kv-project/data"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpDataFile(t *testing.T) {
+	dirPath := t.TempDir()
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(dirPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("user:1"), []byte("alice")); err != nil {
+		t.Fatal(err)
+	}
+	batch := kv.NewBatchWrite(db)
+	if err := batch.Put([]byte("user:2"), []byte("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("user:1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dirPath, data.DataFileName(0))
+	out := &bytes.Buffer{}
+	ok, err := dumpFile(out, path, &filter{prefix: []byte("user:"), values: true})
+	if err != nil || !ok {
+		t.Fatalf("解析失败: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("记录数错误: %s", out.String())
+	}
+	for i, expected := range []string{"Normal", "Normal", "Deleted"} {
+		if fields := strings.Fields(lines[i+1]); fields[2] != expected {
+			t.Fatalf("第%d条记录类型错误: %s", i, lines[i+1])
+		}
+	}
+	// 批量写入的记录带有事务编号
+	if fields := strings.Fields(lines[2]); fields[3] == "0" || fields[7] != `"user:2"` || fields[9] != `"bob"` {
+		t.Fatalf("事务记录解析错误: %s", lines[2])
+	}
+
+	// 破坏第一条记录的value 该记录标记为crc错误 后续记录继续解析
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[bytes.Index(content, []byte("alice"))] ^= 0xff
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	ok, err = dumpFile(out, path, &filter{key: []byte("user:2")})
+	if err != nil || ok {
+		t.Fatalf("需要返回记录损坏: %v", err)
+	}
+	if !strings.Contains(out.String(), "CRC错误") || !strings.Contains(out.String(), `"user:2"`) {
+		t.Fatalf("损坏记录输出错误: %s", out.String())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	kv "github.com/RainbowSorcery/kv-project"
+	"io"
+	"os"
+)
+
+const usage = `用法:
+  kvport export -dir <数据目录> [-format jsonl|csv|sorted] [-o 文件]
+  kvport import -dir <数据目录> [-format jsonl|csv|sorted] [-i 文件]
+未指定文件时导出到标准输出 从标准输入导入`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = load(os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func export(args []string) error {
+	flagSet := flag.NewFlagSet("export", flag.ExitOnError)
+	dirPath := flagSet.String("dir", "", "数据目录")
+	format := flagSet.String("format", string(kv.FormatJSONL), "导出格式 jsonl、csv或者sorted")
+	output := flagSet.String("o", "", "导出文件 为空时输出到标准输出")
+	_ = flagSet.Parse(args)
+	if *dirPath == "" {
+		return fmt.Errorf("缺少-dir参数\n%s", usage)
+	}
+
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(*dirPath), kv.WithReadOnly())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var writer io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	count, err := db.Export(writer, kv.ExportFormat(*format))
+	if err != nil {
+		return err
+	}
+	if file, ok := writer.(*os.File); ok && file != os.Stdout {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "已导出%d条\n", count)
+	return nil
+}
+
+func load(args []string) error {
+	flagSet := flag.NewFlagSet("import", flag.ExitOnError)
+	dirPath := flagSet.String("dir", "", "数据目录")
+	format := flagSet.String("format", string(kv.FormatJSONL), "导入格式 jsonl、csv或者sorted")
+	input := flagSet.String("i", "", "导入文件 为空时从标准输入读取")
+	_ = flagSet.Parse(args)
+	if *dirPath == "" {
+		return fmt.Errorf("缺少-dir参数\n%s", usage)
+	}
+
+	db, err := kv.Open(kv.DefaultOptions, kv.WithDirPath(*dirPath))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var reader io.Reader = os.Stdin
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	count, err := db.Import(reader, kv.ExportFormat(*format))
+	// 导入失败时之前的批次已经提交 同样输出已导入的数量
+	fmt.Fprintf(os.Stderr, "已导入%d条\n", count)
+	return err
+}
@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ConflictError 条件写入时key当前的value或者版本号与期望不一致
+type ConflictError struct {
+	// 冲突的key
+	Key []byte
+	// key当前是否存在
+	Exists bool
+	// 当前value key不存在或者按版本号比较时为nil
+	Current []byte
+	// 当前版本号 key不存在或者旧版本写入的记录没有序列号时为0
+	Version uint64
+}
+
+func (err *ConflictError) Error() string {
+	if !err.Exists {
+		return fmt.Sprintf("key %q 不存在", err.Key)
+	}
+	return fmt.Sprintf("key %q 当前版本%d与期望不一致", err.Key, err.Version)
+}
+
+// CompareAndSwap 当前value与expected一致时写入value expected为nil表示期望key不存在 不一致时返回*ConflictError
+func (db *Db) CompareAndSwap(key []byte, expected []byte, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	// 检查与写入在同一次加锁中完成
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.checkValue(key, expected); err != nil {
+		return err
+	}
+	return db.put(key, value, 0)
+}
+
+// CompareAndSwapVersion 当前版本号与version一致时写入value version为0表示期望key不存在 不一致时返回*ConflictError
+// 只比较内存索引中的版本号 不需要读取value 旧版本写入的key没有版本号 需要重新写入后才能按版本号比较
+func (db *Db) CompareAndSwapVersion(key []byte, version uint64, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	pos := db.index.Get(key)
+	if pos == nil {
+		if version != 0 {
+			return &ConflictError{Key: key}
+		}
+	} else if version == 0 || pos.Seq != version {
+		return &ConflictError{Key: key, Exists: true, Version: pos.Seq}
+	}
+	return db.put(key, value, 0)
+}
+
+// PutIfAbsent key不存在时写入value 已存在时返回*ConflictError
+func (db *Db) PutIfAbsent(key []byte, value []byte) error {
+	return db.CompareAndSwap(key, nil, value)
+}
+
+// DeleteIfEquals 当前value与expected一致时删除key 不一致或者key不存在时返回*ConflictError
+func (db *Db) DeleteIfEquals(key []byte, expected []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if expected == nil {
+		return errors.New("期望value为空")
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if err := db.checkValue(key, expected); err != nil {
+		return err
+	}
+	return db.delete(key)
+}
+
+// checkValue 校验key当前的value是否与expected一致 expected为nil表示期望key不存在 调用方需要持有锁
+func (db *Db) checkValue(key []byte, expected []byte) error {
+	pos := db.index.Get(key)
+	if pos == nil {
+		if expected == nil {
+			return nil
+		}
+		return &ConflictError{Key: key}
+	}
+
+	record, err := db.posByLogRecord(key, pos)
+	if err != nil {
+		return err
+	}
+	// 空value与nil区分 保证冲突错误中的Current不为nil
+	current := record.Value
+	if current == nil {
+		current = []byte{}
+	}
+	if expected == nil || !bytes.Equal(current, expected) {
+		return &ConflictError{Key: key, Exists: true, Current: current, Version: pos.Seq}
+	}
+	return nil
+}
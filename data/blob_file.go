@@ -0,0 +1,301 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/fio"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	// BlobFileSuffix blob文件后缀 大value单独存放在blob文件中
+	BlobFileSuffix = ".blob"
+	// BlobTmpFileSuffix 流式写入中的临时文件后缀 写入完成后追加到活动blob文件并删除
+	BlobTmpFileSuffix = BlobFileSuffix + ".tmp"
+)
+
+// BlobPos 大value在blob文件中的位置 作为BlobIndex记录的value保存在数据文件中
+type BlobPos struct {
+	// blob文件id
+	FileId uint32
+	// 记录在blob文件中的偏移
+	Offset int64
+	// 记录占用的字节数 流式写入的value可能超过4GB
+	Size int64
+}
+
+// BlobFile blob文件 记录格式为: key长度 + value长度 + key + value + crc 校验和放在末尾 写入value时可以边写边计算
+type BlobFile struct {
+	// 文件id
+	FileId uint32
+	// 数据写入偏移
+	WriteOffset int64
+	// 文件读写对象
+	FileManage fio.IOManagement
+}
+
+// OpenBlobFile 打开blob文件 从文件末尾继续写入
+func OpenBlobFile(path string, fileId uint32) (*BlobFile, error) {
+	fileIo, err := fio.CreateFileIo(path + BlobFileName(fileId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobFile{
+		FileId:      fileId,
+		WriteOffset: fileIo.Size(),
+		FileManage:  fileIo,
+	}, nil
+}
+
+// OpenBlobFileReadOnly 以只读方式打开已存在的blob文件
+func OpenBlobFileReadOnly(path string, fileId uint32) (*BlobFile, error) {
+	fileIo, err := fio.OpenFileIoReadOnly(path + BlobFileName(fileId))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobFile{
+		FileId:      fileId,
+		WriteOffset: fileIo.Size(),
+		FileManage:  fileIo,
+	}, nil
+}
+
+// BlobFileName 获取blob文件名称
+func BlobFileName(fileId uint32) string {
+	return fmt.Sprintf("%09d", fileId) + BlobFileSuffix
+}
+
+// Write 写入一条blob记录 返回记录位置
+func (blobFile *BlobFile) Write(key []byte, value []byte) (*BlobPos, error) {
+	header := encodingBlobHeader(len(key), len(value))
+	buffer := make([]byte, len(header)+len(key)+len(value)+crc32.Size)
+	index := copy(buffer, header)
+	index += copy(buffer[index:], key)
+	index += copy(buffer[index:], value)
+	binary.LittleEndian.PutUint32(buffer[index:], crc32.ChecksumIEEE(buffer[:index]))
+
+	offset := blobFile.WriteOffset
+	writeSize, err := blobFile.FileManage.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	blobFile.WriteOffset += int64(writeSize)
+
+	return &BlobPos{
+		FileId: blobFile.FileId,
+		Offset: offset,
+		Size:   int64(len(buffer)),
+	}, nil
+}
+
+// Read 根据位置读取blob记录 返回key以及value
+func (blobFile *BlobFile) Read(pos *BlobPos) ([]byte, []byte, error) {
+	buffer := make([]byte, pos.Size)
+	readSize, err := blobFile.FileManage.Read(pos.Offset, buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if readSize != len(buffer) || readSize < crc32.Size {
+		return nil, nil, fmt.Errorf("blob文件%d偏移%d记录不完整: %w", blobFile.FileId, pos.Offset, ErrCorruptRecord)
+	}
+
+	keySize, valueSize, headerSize := decodingBlobHeader(buffer)
+	if headerSize <= 0 || headerSize+keySize+valueSize+crc32.Size != len(buffer) {
+		return nil, nil, errCorruptBlob
+	}
+
+	crcIndex := len(buffer) - crc32.Size
+	if crc32.ChecksumIEEE(buffer[:crcIndex]) != binary.LittleEndian.Uint32(buffer[crcIndex:]) {
+		return nil, nil, fmt.Errorf("blob文件%d偏移%d crc校验失败: %w", blobFile.FileId, pos.Offset, ErrCorruptRecord)
+	}
+
+	key := buffer[headerSize : headerSize+keySize]
+	value := buffer[headerSize+keySize : crcIndex]
+	return key, value, nil
+}
+
+func encodingBlobHeader(keySize int, valueSize int) []byte {
+	header := make([]byte, binary.MaxVarintLen64*2)
+	index := binary.PutUvarint(header, uint64(keySize))
+	index += binary.PutUvarint(header[index:], uint64(valueSize))
+	return header[:index]
+}
+
+// decodingBlobHeader 解析blob记录头 返回key长度、value长度以及记录头长度
+func decodingBlobHeader(buffer []byte) (int, int, int) {
+	keySize, index := binary.Uvarint(buffer)
+	if index <= 0 {
+		return 0, 0, 0
+	}
+	valueSize, size := binary.Uvarint(buffer[index:])
+	if size <= 0 {
+		return 0, 0, 0
+	}
+	return int(keySize), int(valueSize), index + size
+}
+
+// EncodingBlobPos 序列化blob位置
+func EncodingBlobPos(pos *BlobPos) []byte {
+	buffer := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	index := binary.PutVarint(buffer, int64(pos.FileId))
+	index += binary.PutVarint(buffer[index:], pos.Offset)
+	index += binary.PutVarint(buffer[index:], pos.Size)
+	return buffer[:index]
+}
+
+// DecodingBlobPos 反序列化blob位置
+func DecodingBlobPos(buffer []byte) (*BlobPos, error) {
+	fileId, index := binary.Varint(buffer)
+	if index <= 0 {
+		return nil, errCorruptBlobPos
+	}
+	offset, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, errCorruptBlobPos
+	}
+	index += size
+	recordSize, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, errCorruptBlobPos
+	}
+
+	return &BlobPos{
+		FileId: uint32(fileId),
+		Offset: offset,
+		Size:   recordSize,
+	}, nil
+}
+
+// blobStreamBufferSize 流式读写value时每次处理的字节数
+const blobStreamBufferSize = 64 * 1024
+
+// WriteFrom 从reader中读取size字节作为value写入blob记录 边写边计算crc 不需要把value整体放入内存
+// 写入失败时已写入的部分不会被引用 由调用方计入可回收空间
+func (blobFile *BlobFile) WriteFrom(key []byte, reader io.Reader, size int64) (*BlobPos, error) {
+	if size < 0 {
+		return nil, errors.New("value长度不合法")
+	}
+
+	offset := blobFile.WriteOffset
+	header := encodingBlobHeader(len(key), int(size))
+	buffer := make([]byte, 0, len(header)+len(key))
+	buffer = append(buffer, header...)
+	buffer = append(buffer, key...)
+	crc := crc32.ChecksumIEEE(buffer)
+	if err := blobFile.write(buffer); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, blobStreamBufferSize)
+	remain := size
+	for remain > 0 {
+		chunkSize := int64(len(chunk))
+		if remain < chunkSize {
+			chunkSize = remain
+		}
+		readSize, err := io.ReadFull(reader, chunk[:chunkSize])
+		if err != nil {
+			return nil, fmt.Errorf("读取value失败, 剩余%d字节: %w", remain-int64(readSize), err)
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, chunk[:readSize])
+		if err := blobFile.write(chunk[:readSize]); err != nil {
+			return nil, err
+		}
+		remain -= int64(readSize)
+	}
+
+	trailer := make([]byte, crc32.Size)
+	binary.LittleEndian.PutUint32(trailer, crc)
+	if err := blobFile.write(trailer); err != nil {
+		return nil, err
+	}
+
+	return &BlobPos{
+		FileId: blobFile.FileId,
+		Offset: offset,
+		Size:   blobFile.WriteOffset - offset,
+	}, nil
+}
+
+func (blobFile *BlobFile) write(buffer []byte) error {
+	writeSize, err := blobFile.FileManage.Write(buffer)
+	blobFile.WriteOffset += int64(writeSize)
+	return err
+}
+
+// BlobReader 流式读取blob记录中的value 读到末尾时校验crc
+// 持有独立的文件句柄 blob文件被回收删除后仍然可以读取
+type BlobReader struct {
+	file   *os.File
+	value  *io.SectionReader
+	crc    uint32
+	crcPos int64
+}
+
+// OpenBlobReader 打开blob记录的value读取对象 使用完毕后需要调用Close
+func OpenBlobReader(path string, pos *BlobPos) (*BlobReader, error) {
+	file, err := os.Open(path + BlobFileName(pos.FileId))
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, binary.MaxVarintLen64*2)
+	if int64(len(header)) > pos.Size {
+		header = header[:pos.Size]
+	}
+	if _, err := file.ReadAt(header, pos.Offset); err != nil && err != io.EOF {
+		_ = file.Close()
+		return nil, err
+	}
+	keySize, valueSize, headerSize := decodingBlobHeader(header)
+	if headerSize <= 0 || int64(headerSize+keySize+valueSize+crc32.Size) != pos.Size {
+		_ = file.Close()
+		return nil, errCorruptBlob
+	}
+
+	// 记录头和key参与crc计算 value部分在读取时继续累加
+	prefix := make([]byte, headerSize+keySize)
+	if _, err := file.ReadAt(prefix, pos.Offset); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	valueOffset := pos.Offset + int64(len(prefix))
+	return &BlobReader{
+		file:   file,
+		value:  io.NewSectionReader(file, valueOffset, int64(valueSize)),
+		crc:    crc32.ChecksumIEEE(prefix),
+		crcPos: valueOffset + int64(valueSize),
+	}, nil
+}
+
+// Size value的字节数
+func (reader *BlobReader) Size() int64 {
+	return reader.value.Size()
+}
+
+func (reader *BlobReader) Read(buffer []byte) (int, error) {
+	readSize, err := reader.value.Read(buffer)
+	reader.crc = crc32.Update(reader.crc, crc32.IEEETable, buffer[:readSize])
+	if err != io.EOF {
+		return readSize, err
+	}
+
+	trailer := make([]byte, crc32.Size)
+	if _, err := reader.file.ReadAt(trailer, reader.crcPos); err != nil {
+		return readSize, err
+	}
+	if reader.crc != binary.LittleEndian.Uint32(trailer) {
+		return readSize, fmt.Errorf("blob记录crc校验失败: %w", ErrCorruptRecord)
+	}
+	return readSize, io.EOF
+}
+
+func (reader *BlobReader) Close() error {
+	return reader.file.Close()
+}
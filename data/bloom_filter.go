@@ -0,0 +1,104 @@
+package data
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter 布隆过滤器 判断key是否可能存在于数据文件中 不存在时可以避免读取磁盘
+type BloomFilter struct {
+	// 哈希函数个数
+	hashCount uint32
+	// 位数组
+	bits []uint64
+}
+
+// NewBloomFilter 根据预计的key数量以及误判率创建布隆过滤器
+func NewBloomFilter(keyCount int, falsePositive float64) *BloomFilter {
+	if keyCount <= 0 {
+		keyCount = 1
+	}
+	if falsePositive <= 0 || falsePositive >= 1 {
+		falsePositive = 0.01
+	}
+
+	// 位数组长度 m = -n * ln(p) / (ln2)^2 哈希函数个数 k = m / n * ln2
+	bitCount := math.Ceil(-float64(keyCount) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	hashCount := uint32(math.Round(bitCount / float64(keyCount) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+
+	return &BloomFilter{
+		hashCount: hashCount,
+		bits:      make([]uint64, (int(bitCount)+63)/64),
+	}
+}
+
+// Add 添加key
+func (filter *BloomFilter) Add(key []byte) {
+	h1, h2 := bloomHash(key)
+	bitCount := uint64(len(filter.bits) * 64)
+	for i := uint32(0); i < filter.hashCount; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % bitCount
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// MayContain 判断key是否可能存在 返回false表示key一定不存在
+func (filter *BloomFilter) MayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	bitCount := uint64(len(filter.bits) * 64)
+	for i := uint32(0); i < filter.hashCount; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % bitCount
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash 将64位fnv哈希拆分为两个32位哈希 通过双重哈希模拟多个哈希函数
+func bloomHash(key []byte) (uint32, uint32) {
+	hash := fnv.New64a()
+	_, _ = hash.Write(key)
+	sum := hash.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// EncodingBloomFilter 序列化布隆过滤器 格式为: 哈希函数个数 + 位数组长度 + 位数组
+func EncodingBloomFilter(filter *BloomFilter) []byte {
+	buffer := make([]byte, binary.MaxVarintLen32*2+len(filter.bits)*8)
+	index := binary.PutUvarint(buffer, uint64(filter.hashCount))
+	index += binary.PutUvarint(buffer[index:], uint64(len(filter.bits)))
+	for _, word := range filter.bits {
+		binary.LittleEndian.PutUint64(buffer[index:], word)
+		index += 8
+	}
+	return buffer[:index]
+}
+
+// DecodingBloomFilter 反序列化布隆过滤器
+func DecodingBloomFilter(buffer []byte) (*BloomFilter, error) {
+	hashCount, index := binary.Uvarint(buffer)
+	if index <= 0 || hashCount == 0 {
+		return nil, errCorruptBloom
+	}
+	wordCount, size := binary.Uvarint(buffer[index:])
+	if size <= 0 || wordCount == 0 || uint64(len(buffer)-index-size) != wordCount*8 {
+		return nil, errCorruptBloom
+	}
+	index += size
+
+	bits := make([]uint64, wordCount)
+	for i := range bits {
+		bits[i] = binary.LittleEndian.Uint64(buffer[index:])
+		index += 8
+	}
+
+	return &BloomFilter{
+		hashCount: uint32(hashCount),
+		bits:      bits,
+	}, nil
+}
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBloomFilter_MayContain(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.Add([]byte(strconv.Itoa(i)))
+	}
+
+	decodeFilter, err := DecodingBloomFilter(EncodingBloomFilter(filter))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !decodeFilter.MayContain([]byte(strconv.Itoa(i))) {
+			t.Fatalf("已添加的key不能被判断为不存在: %d", i)
+		}
+	}
+
+	falsePositive := 0
+	for i := 1000; i < 11000; i++ {
+		if decodeFilter.MayContain([]byte(strconv.Itoa(i))) {
+			falsePositive++
+		}
+	}
+	if falsePositive > 300 {
+		t.Fatalf("误判率过高: %d", falsePositive)
+	}
+}
@@ -1,12 +1,14 @@
 package data
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/RainbowSorcery/kv-project/fio"
 	"hash/crc32"
 	"io"
-	"kv-database/fio"
+	"os"
 )
 
 type FileData struct {
@@ -16,6 +18,8 @@ type FileData struct {
 	WriteOffset int64
 	// 文件读写对象
 	FileManage fio.IOManagement
+	// 布隆过滤器 只有非活动文件才有
+	Filter *BloomFilter
 }
 
 func (fileData *FileData) Write(data []byte) error {
@@ -33,7 +37,7 @@ func (fileData *FileData) Write(data []byte) error {
 
 func (fileData *FileData) Read(pos int64) (*LogRecord, int64, error) {
 	// 读取header header中存储crc冗余校验、record类型、key长度、value长度
-	logRecordLengthSize := int64(binary.MaxVarintLen32*3 + 1)
+	logRecordLengthSize := int64(MaxLogRecordHeaderSize)
 	if fileData == nil {
 		return nil, 0, errors.New("fileData is nil")
 	}
@@ -55,9 +59,7 @@ func (fileData *FileData) Read(pos int64) (*LogRecord, int64, error) {
 	}
 
 	// 读取key value数据
-	pos += size
-
-	recordDataBuffer, err := fileData.readNByte(pos, int64(recordHeader.KeySize+recordHeader.ValueSize))
+	recordDataBuffer, err := fileData.readNByte(pos+size, int64(recordHeader.KeySize+recordHeader.ValueSize))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -66,13 +68,14 @@ func (fileData *FileData) Read(pos int64) (*LogRecord, int64, error) {
 		Key:   recordDataBuffer[:recordHeader.KeySize],
 		Value: recordDataBuffer[recordHeader.KeySize : recordHeader.KeySize+recordHeader.ValueSize],
 		Type:  recordHeader.Type,
+		Seq:   recordHeader.Seq,
 	}
 
 	// crc冗余校验
 	crc := GetLogRecordCRC(logRecord, buffer[crc32.Size:headerSize])
 
 	if crc != recordHeader.Crc {
-		return nil, 0, errors.New("crc校验失败")
+		return nil, 0, fmt.Errorf("数据文件%d偏移%d crc校验失败: %w", fileData.FileId, pos, ErrCorruptRecord)
 	}
 
 	return logRecord, headerSize + int64(recordHeader.KeySize+recordHeader.ValueSize), nil
@@ -91,7 +94,7 @@ func (fileData *FileData) readNByte(pos int64, length int64) ([]byte, error) {
 
 // ReadLogRecord 根据偏移获取logRecord
 func (fileData *FileData) ReadLogRecord(pos int64) (logRecord *LogRecord, err error) {
-	headerDataBuffer, err := fileData.readNByte(pos, 13)
+	headerDataBuffer, err := fileData.readNByte(pos, MaxLogRecordHeaderSize)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +103,7 @@ func (fileData *FileData) ReadLogRecord(pos int64) (logRecord *LogRecord, err er
 	header, size := DecodingLogRecordHeader(headerDataBuffer)
 
 	if header == nil {
-		return nil, errors.New("header为空")
+		return nil, fmt.Errorf("数据文件%d偏移%d记录头解析失败: %w", fileData.FileId, pos, ErrCorruptRecord)
 	}
 
 	// 拿到header之后就可以获取到logRecord的值了
@@ -113,41 +116,43 @@ func (fileData *FileData) ReadLogRecord(pos int64) (logRecord *LogRecord, err er
 		Key:   recordByteArray[:header.KeySize],
 		Value: recordByteArray[header.KeySize : header.ValueSize+header.KeySize],
 		Type:  header.Type,
+		Seq:   header.Seq,
 	}
 
 	return logRecord, nil
 }
 
-func (fileData *FileData) WriteHintRecord(key []byte, pos *LogRecordPos) error {
-	// 获取key数据
-	keyVarintBuffer := make([]byte, binary.MaxVarintLen64)
-	keySize := len(key)
-	index := binary.PutUvarint(keyVarintBuffer, uint64(keySize))
-	keyBuffer := make([]byte, keySize+index)
-	copy(keyBuffer[:index], keyVarintBuffer[:index])
-	copy(keyBuffer[index:], key)
-	err := fileData.Write(keyBuffer)
-
-	recordPos, err := EncodingLogRecordPos(pos)
+// ReadHintRecords 读取hint文件中的所有记录
+func (fileData *FileData) ReadHintRecords() ([]*HintRecord, error) {
+	buffer, err := fileData.readNByte(0, fileData.FileManage.Size())
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
 
-	if err != nil {
-		return err
+	if !bytes.HasPrefix(buffer, []byte(HintFileHeader)) {
+		return nil, fmt.Errorf("hint文件%d: %w", fileData.FileId, ErrStaleHint)
 	}
 
-	err = fileData.Write(recordPos)
-	if err != nil {
-		return err
+	records := make([]*HintRecord, 0)
+	var offset = int64(len(HintFileHeader))
+	for offset < int64(len(buffer)) {
+		record, size, err := DecodingHintRecord(buffer[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("hint文件%d偏移%d: %w", fileData.FileId, offset, err)
+		}
+		records = append(records, record)
+		offset += size
 	}
 
-	return nil
+	return records, nil
 }
 
 func (fileData *FileData) WriteMergeFinishRecord(mergeRecord *MergeFinishRecord) error {
-	mergeRecordBytesArr := make([]byte, (len(mergeRecord.MergerFinishFileIds)+4)*binary.MaxVarintLen64)
+	mergeRecordBytesArr := make([]byte, (len(mergeRecord.MergerFinishFileIds)+1)*binary.MaxVarintLen64)
 
 	writeIndex := 0
 	writeIndex += binary.PutVarint(mergeRecordBytesArr[writeIndex:], int64(mergeRecord.FinishCount))
-	for fileId := range mergeRecord.MergerFinishFileIds {
+	for _, fileId := range mergeRecord.MergerFinishFileIds {
 		writeIndex += binary.PutVarint(mergeRecordBytesArr[writeIndex:], int64(fileId))
 	}
 
@@ -159,11 +164,45 @@ func (fileData *FileData) WriteMergeFinishRecord(mergeRecord *MergeFinishRecord)
 	return nil
 }
 
-func OpenFileData(path string, fileId uint32) (*FileData, error) {
+// ReadMergeFinishRecord 读取合并完成记录
+func (fileData *FileData) ReadMergeFinishRecord() (*MergeFinishRecord, error) {
+	buffer, err := fileData.readNByte(0, fileData.FileManage.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodingMergeFinishRecord(buffer)
+}
+
+// DecodingMergeFinishRecord 反序列化合并完成记录
+func DecodingMergeFinishRecord(buffer []byte) (*MergeFinishRecord, error) {
+	finishCount, index := binary.Varint(buffer)
+	if index <= 0 {
+		return nil, errCorruptMergeFinish
+	}
+
+	mergeRecord := &MergeFinishRecord{
+		FinishCount:         uint32(finishCount),
+		MergerFinishFileIds: make([]uint32, 0, finishCount),
+	}
+	for i := 0; i < int(finishCount); i++ {
+		fileId, size := binary.Varint(buffer[index:])
+		if size <= 0 {
+			return nil, errCorruptMergeFinish
+		}
+		index += size
+		mergeRecord.MergerFinishFileIds = append(mergeRecord.MergerFinishFileIds, uint32(fileId))
+	}
+
+	return mergeRecord, nil
+}
+
+// OpenFileData 打开数据文件 blockCache不为空时读取经过块缓存
+func OpenFileData(path string, fileId uint32, blockCache *fio.BlockCache) (*FileData, error) {
 	// 拼接路径
-	dataFilePath := path + fmt.Sprintf("%09d", fileId) + ".data"
+	dataFilePath := path + DataFileName(fileId)
 	// 创建IOManagement对象
-	fileIo, err := fio.CreateFileIo(dataFilePath)
+	fileIo, err := fio.NewIOManagement(dataFilePath, blockCache)
 	if err != nil {
 		return nil, err
 	}
@@ -177,25 +216,138 @@ func OpenFileData(path string, fileId uint32) (*FileData, error) {
 	}, nil
 }
 
-func OpenHintFile(path string) (*FileData, error) {
+// OpenFileDataReadOnly 以只读方式打开已存在的数据文件 blockCache不为空时读取经过块缓存
+func OpenFileDataReadOnly(path string, fileId uint32, blockCache *fio.BlockCache) (*FileData, error) {
+	fileIo, err := fio.NewReadOnlyIOManagement(path+DataFileName(fileId), blockCache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileData{
+		FileId:      fileId,
+		WriteOffset: 0,
+		FileManage:  fileIo,
+	}, nil
+}
+
+// OpenHintFile 以只读方式打开已存在的hint文件 hint文件只通过WriteHintFile整体写入
+func OpenHintFile(path string, fileId uint32) (*FileData, error) {
 	// 拼接路径
-	dataFilePath := path + "hint-index" + ".hint"
+	dataFilePath := path + HintFileName(fileId)
 	// 创建IOManagement对象
-	fileIo, err := fio.CreateFileIo(dataFilePath)
+	fileIo, err := fio.OpenFileIoReadOnly(dataFilePath)
 	if err != nil {
 		return nil, err
 	}
 
 	// 创建FileData对象
 	return &FileData{
+		FileId:      fileId,
 		WriteOffset: 0,
 		FileManage:  fileIo,
 	}, nil
 }
 
+// WriteHintFile 将数据文件对应的hint记录写入hint文件
+func WriteHintFile(path string, fileId uint32, records []*HintRecord) error {
+	buffer := bytes.NewBufferString(HintFileHeader)
+	for _, record := range records {
+		recordBytes, err := EncodingHintRecord(record)
+		if err != nil {
+			return err
+		}
+		buffer.Write(recordBytes)
+	}
+
+	return writeFileAtomic(path, HintFileName(fileId), buffer.Bytes())
+}
+
+// WriteBulkFinishFile 写入批量导入完成记录
+func WriteBulkFinishFile(path string, record *BulkFinishRecord) error {
+	buffer := make([]byte, binary.MaxVarintLen32*2+1)
+	index := binary.PutUvarint(buffer, uint64(record.FileCount))
+	if record.Assigned {
+		buffer[index] = 1
+	}
+	index++
+	index += binary.PutUvarint(buffer[index:], uint64(record.BaseFileId))
+
+	return writeFileAtomic(path, BulkFinishFileName, buffer[:index])
+}
+
+// ReadBulkFinishFile 读取批量导入完成记录
+func ReadBulkFinishFile(path string) (*BulkFinishRecord, error) {
+	buffer, err := os.ReadFile(path + BulkFinishFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileCount, index := binary.Uvarint(buffer)
+	if index <= 0 || len(buffer) <= index {
+		return nil, errCorruptBulkFinish
+	}
+	assigned := buffer[index] == 1
+	index++
+	baseFileId, size := binary.Uvarint(buffer[index:])
+	if size <= 0 {
+		return nil, errCorruptBulkFinish
+	}
+
+	return &BulkFinishRecord{
+		FileCount:  uint32(fileCount),
+		Assigned:   assigned,
+		BaseFileId: uint32(baseFileId),
+	}, nil
+}
+
+// WriteBloomFile 将数据文件对应的布隆过滤器写入文件
+func WriteBloomFile(path string, fileId uint32, filter *BloomFilter) error {
+	return writeFileAtomic(path, BloomFileName(fileId), EncodingBloomFilter(filter))
+}
+
+// ReadBloomFile 读取数据文件对应的布隆过滤器
+func ReadBloomFile(path string, fileId uint32) (*BloomFilter, error) {
+	buffer, err := os.ReadFile(path + BloomFileName(fileId))
+	if err != nil {
+		return nil, err
+	}
+	return DecodingBloomFilter(buffer)
+}
+
+// writeFileAtomic 先写入临时文件再重命名 保证文件要么完整存在要么不存在
+func writeFileAtomic(path string, fileName string, content []byte) error {
+	// 清理上次写入失败遗留的临时文件
+	tmpFilePath := path + fileName + ".tmp"
+	err := os.Remove(tmpFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	fileIo, err := fio.CreateFileIo(tmpFilePath)
+	if err != nil {
+		return err
+	}
+	_, err = fileIo.Write(content)
+	if err != nil {
+		fileIo.Close()
+		return err
+	}
+	err = fileIo.Sync()
+	if err != nil {
+		fileIo.Close()
+		return err
+	}
+	err = fileIo.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilePath, path+fileName)
+}
+
 func OpenFinishMergeFile(path string) (*FileData, error) {
 	// 拼接路径
-	dataFilePath := path + "merge-finish.done"
+	dataFilePath := path + MergeFinishFileName
 	// 创建IOManagement对象
 	fileIo, err := fio.CreateFileIo(dataFilePath)
 	if err != nil {
@@ -0,0 +1,22 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCorruptRecord 记录已损坏 crc校验失败或者无法解析
+var ErrCorruptRecord = errors.New("记录已损坏")
+
+// ErrStaleHint hint文件由旧版本写入 需要根据数据文件重新生成
+var ErrStaleHint = errors.New("hint文件版本不一致")
+
+var (
+	errCorruptPos         = fmt.Errorf("索引信息解析失败: %w", ErrCorruptRecord)
+	errCorruptHint        = fmt.Errorf("hint记录解析失败: %w", ErrCorruptRecord)
+	errCorruptBloom       = fmt.Errorf("布隆过滤器解析失败: %w", ErrCorruptRecord)
+	errCorruptBlob        = fmt.Errorf("blob记录解析失败: %w", ErrCorruptRecord)
+	errCorruptBlobPos     = fmt.Errorf("blob位置解析失败: %w", ErrCorruptRecord)
+	errCorruptMergeFinish = fmt.Errorf("合并完成记录解析失败: %w", ErrCorruptRecord)
+	errCorruptBulkFinish  = fmt.Errorf("批量导入完成记录解析失败: %w", ErrCorruptRecord)
+)
@@ -3,6 +3,7 @@ package data
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 )
 
@@ -15,17 +16,37 @@ const (
 	Normal LogRecordType = 1
 	// TxComplete 事务完成
 	TxComplete LogRecordType = 2
+	// BlobIndex 大value记录 value保存在blob文件中 记录中只保存blob文件中的位置
+	BlobIndex LogRecordType = 3
+	// MergeOperand 合并操作数 读取时与之前的value以及操作数依次合并
+	MergeOperand LogRecordType = 4
 
-	// HintFileName Hint文件名称常量
-	HintFileName = "hint-index.hint"
+	// DataFileSuffix 数据文件后缀
+	DataFileSuffix = ".data"
+	// HintFileSuffix Hint文件后缀 每个数据文件对应一个同id的hint文件
+	HintFileSuffix = ".hint"
+	// BloomFileSuffix 布隆过滤器文件后缀 与hint文件一样每个非活动文件对应一个
+	BloomFileSuffix = ".bloom"
 	// MergeFinishFileName 合并完成记录文件名称
 	MergeFinishFileName = "merge-finish.done"
+	// BulkFinishFileName 批量导入完成记录文件名称
+	BulkFinishFileName = "bulk-finish.done"
+
+	// MaxLogRecordHeaderSize 记录头最大长度 crc + 类型 + key长度 + value长度 + 序列号
+	MaxLogRecordHeaderSize = 4 + 1 + binary.MaxVarintLen32*2 + binary.MaxVarintLen64
+
+	// seqHeaderFlag 记录类型的最高位 为1表示记录头中保存序列号 旧版本的记录头没有序列号 读取时序列号为0
+	seqHeaderFlag LogRecordType = 0x80
+	// HintFileHeader hint文件头 hint记录格式变化时修改 文件头不一致的hint文件根据数据文件重新生成
+	HintFileHeader = "KVHINT02"
 )
 
 // LogRecordPos 数据内存索引信息 主要是根据key找到指定文件的指定位置读取指定数据
 type LogRecordPos struct {
 	FileId uint32 // 文件id
 	Pos    int64  // 数据偏移
+	Size   uint32 // 记录在文件中占用的字节数 用于统计可回收空间
+	Seq    uint64 // 记录的写入序列号
 }
 
 type LogRecordHeader struct {
@@ -33,6 +54,7 @@ type LogRecordHeader struct {
 	Type      LogRecordType
 	KeySize   uint32
 	ValueSize uint32
+	Seq       uint64
 }
 
 type LogRecord struct {
@@ -42,6 +64,22 @@ type LogRecord struct {
 	Value []byte
 	// 索引是否删除
 	Type LogRecordType
+	// 写入序列号 每次写入单调递增 合并文件时保持不变
+	Seq uint64
+}
+
+// HintRecord hint文件中的索引记录 启动时不需要读取value即可建立内存索引
+type HintRecord struct {
+	// key
+	Key []byte
+	// 记录类型
+	Type LogRecordType
+	// 事务序列号 非事务记录为0
+	TranNum int64
+	// 索引信息
+	Pos *LogRecordPos
+	// 记录的value 只有BlobIndex记录保存 内容为blob文件中的位置
+	Value []byte
 }
 
 // MergeFinishRecord 合并完成记录
@@ -52,13 +90,23 @@ type MergeFinishRecord struct {
 	MergerFinishFileIds []uint32
 }
 
+// BulkFinishRecord 批量导入完成记录 导入目录中的数据文件id从0开始连续分配
+type BulkFinishRecord struct {
+	// 导入的数据文件数量
+	FileCount uint32
+	// 是否已经分配挂载后的文件id
+	Assigned bool
+	// 挂载到数据库后的起始文件id
+	BaseFileId uint32
+}
+
 // EncodingLogRecord 将record对象实例化为字节数组并返回长度以及序列化后的对象结果
 func EncodingLogRecord(logRecord *LogRecord) ([]byte, int64) {
-	header := make([]byte, 15)
+	header := make([]byte, MaxLogRecordHeaderSize)
 
 	// 前3个字节为crc冗余校验位，该位等整个LogRecord读取出来才能进行计算，所以需要先跳过前三个字节，从第四个字节开始设置
 	var index = 4
-	header[index] = logRecord.Type
+	header[index] = logRecord.Type | seqHeaderFlag
 	index++
 
 	keySize := len(logRecord.Key)
@@ -66,6 +114,7 @@ func EncodingLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	// 写入字节数值到header中 PutVarint会返回每次写入字节数 因为keySize和valueSize不是定长的，所以需要这样设置一些
 	index += binary.PutVarint(header[index:], int64(keySize))
 	index += binary.PutVarint(header[index:], int64(valueSize))
+	index += binary.PutUvarint(header[index:], logRecord.Seq)
 
 	// 计算logRecord长度 header长度 + key长度 + value长度
 	var size = int64(index + keySize + valueSize)
@@ -101,12 +150,18 @@ func DecodingLogRecordHeader(buffer []byte) (*LogRecordHeader, int64) {
 	index += writeSize
 	valueSize, writeSize := binary.Varint(buffer[5+index:])
 	index += writeSize
+	var seq uint64 = 0
+	if buffer[4]&seqHeaderFlag != 0 {
+		seq, writeSize = binary.Uvarint(buffer[5+index:])
+		index += writeSize
+	}
 
 	logRecordHeader := &LogRecordHeader{
 		Crc:       binary.LittleEndian.Uint32(buffer[:4]),
-		Type:      buffer[4],
+		Type:      buffer[4] &^ seqHeaderFlag,
 		KeySize:   uint32(keySize),
 		ValueSize: uint32(valueSize),
+		Seq:       seq,
 	}
 	return logRecordHeader, int64(4 + 1 + index)
 }
@@ -122,28 +177,155 @@ func GetLogRecordCRC(record *LogRecord, headerBuffer []byte) uint32 {
 }
 
 func EncodingLogRecordPos(pos *LogRecordPos) ([]byte, error) {
-	buffer := make([]byte, 12)
+	buffer := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 
 	index := 0
 	index += binary.PutVarint(buffer[index:], int64(pos.FileId))
 	index += binary.PutVarint(buffer[index:], pos.Pos)
+	index += binary.PutVarint(buffer[index:], int64(pos.Size))
+	index += binary.PutUvarint(buffer[index:], pos.Seq)
 
-	return buffer, nil
+	return buffer[:index], nil
 }
 
 func DecodingLogRecordPos(posBytes []byte) (*LogRecordPos, error) {
 	index := 0
 	fileId, size := binary.Varint(posBytes)
+	if size <= 0 {
+		return nil, errCorruptPos
+	}
+	index += size
+	pos, size := binary.Varint(posBytes[index:])
+	if size <= 0 {
+		return nil, errCorruptPos
+	}
 	index += size
-	pos, size := binary.Varint(posBytes[size:])
+	recordSize, size := binary.Varint(posBytes[index:])
+	if size <= 0 {
+		return nil, errCorruptPos
+	}
 	index += size
+	seq, size := binary.Uvarint(posBytes[index:])
+	if size <= 0 {
+		return nil, errCorruptPos
+	}
 
 	return &LogRecordPos{
 		FileId: uint32(fileId),
 		Pos:    pos,
+		Size:   uint32(recordSize),
+		Seq:    seq,
 	}, nil
 }
 
+// IsValueType 判断记录类型是否为有效数据记录
+func IsValueType(recordType LogRecordType) bool {
+	return recordType == Normal || recordType == BlobIndex
+}
+
+// EncodingHintRecord 序列化hint记录 格式为: 记录类型 + 事务序列号 + key长度 + key + 索引信息 BlobIndex记录额外保存value
+func EncodingHintRecord(record *HintRecord) ([]byte, error) {
+	posBytes, err := EncodingLogRecordPos(record.Pos)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 1+binary.MaxVarintLen64*3+len(record.Key)+len(posBytes)+len(record.Value))
+	buffer[0] = record.Type
+	index := 1
+	index += binary.PutVarint(buffer[index:], record.TranNum)
+	index += binary.PutUvarint(buffer[index:], uint64(len(record.Key)))
+	index += copy(buffer[index:], record.Key)
+	index += copy(buffer[index:], posBytes)
+	if record.Type == BlobIndex {
+		index += binary.PutUvarint(buffer[index:], uint64(len(record.Value)))
+		index += copy(buffer[index:], record.Value)
+	}
+
+	return buffer[:index], nil
+}
+
+// DecodingHintRecord 反序列化hint记录 返回记录以及记录长度
+func DecodingHintRecord(buffer []byte) (*HintRecord, int64, error) {
+	if len(buffer) < 2 {
+		return nil, 0, errCorruptHint
+	}
+
+	index := 1
+	tranNum, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+	keySize, size := binary.Uvarint(buffer[index:])
+	if size <= 0 || len(buffer) < index+size+int(keySize) {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+	key := buffer[index : index+int(keySize)]
+	index += int(keySize)
+
+	fileId, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+	pos, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+	recordSize, size := binary.Varint(buffer[index:])
+	if size <= 0 {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+	seq, size := binary.Uvarint(buffer[index:])
+	if size <= 0 {
+		return nil, 0, errCorruptHint
+	}
+	index += size
+
+	var value []byte
+	if buffer[0] == BlobIndex {
+		valueSize, size := binary.Uvarint(buffer[index:])
+		if size <= 0 || len(buffer) < index+size+int(valueSize) {
+			return nil, 0, errCorruptHint
+		}
+		index += size
+		value = buffer[index : index+int(valueSize)]
+		index += int(valueSize)
+	}
+
+	return &HintRecord{
+		Key:     key,
+		Type:    buffer[0],
+		TranNum: tranNum,
+		Pos: &LogRecordPos{
+			FileId: uint32(fileId),
+			Pos:    pos,
+			Size:   uint32(recordSize),
+			Seq:    seq,
+		},
+		Value: value,
+	}, int64(index), nil
+}
+
+// DataFileName 获取数据文件名称
+func DataFileName(fileId uint32) string {
+	return fmt.Sprintf("%09d", fileId) + DataFileSuffix
+}
+
+// HintFileName 获取数据文件对应的hint文件名称
+func HintFileName(fileId uint32) string {
+	return fmt.Sprintf("%09d", fileId) + HintFileSuffix
+}
+
+// BloomFileName 获取数据文件对应的布隆过滤器文件名称
+func BloomFileName(fileId uint32) string {
+	return fmt.Sprintf("%09d", fileId) + BloomFileSuffix
+}
+
 // Int64ToBytes 整形转换成字节数组
 func Int64ToBytes(n int64) ([]byte, error) {
 	bytesBuffer := bytes.NewBuffer([]byte{})
@@ -0,0 +1,581 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/index"
+	"math"
+)
+
+// DataType 数据结构类型 保存在元数据的第一个字节
+type DataType = byte
+
+const (
+	Hash DataType = iota + 1
+	List
+	Set
+	ZSet
+)
+
+const (
+	// dataStructurePrefix 数据结构成员key前缀 格式为: 前缀 + key长度 + key + 版本号 + 成员
+	dataStructurePrefix = internalKeyPrefix + "ds:"
+	// listInitialIndex 列表初始位置 从中间开始 两端都可以插入
+	listInitialIndex = math.MaxUint64 / 2
+
+	zsetMemberTag = 'm'
+	zsetScoreTag  = 's'
+)
+
+// dataStructureMeta 数据结构元数据 保存在用户key下 成员单独保存在内部key中
+type dataStructureMeta struct {
+	// 数据结构类型
+	dataType DataType
+	// 版本号 创建时的序列号 重新创建时更换 旧版本的成员不再可见
+	version uint64
+	// 成员数量
+	size uint64
+	// 列表头部位置 包含
+	head uint64
+	// 列表尾部位置 不包含
+	tail uint64
+}
+
+func encodingMeta(meta *dataStructureMeta) []byte {
+	buffer := make([]byte, 1+binary.MaxVarintLen64*4)
+	buffer[0] = meta.dataType
+	index := 1
+	index += binary.PutUvarint(buffer[index:], meta.version)
+	index += binary.PutUvarint(buffer[index:], meta.size)
+	if meta.dataType == List {
+		index += binary.PutUvarint(buffer[index:], meta.head)
+		index += binary.PutUvarint(buffer[index:], meta.tail)
+	}
+	return buffer[:index]
+}
+
+func decodingMeta(buffer []byte) (*dataStructureMeta, error) {
+	if len(buffer) == 0 {
+		return nil, fmt.Errorf("元数据解析失败: %w", ErrCorruptRecord)
+	}
+	meta := &dataStructureMeta{dataType: buffer[0]}
+	fields := []*uint64{&meta.version, &meta.size}
+	if meta.dataType == List {
+		fields = append(fields, &meta.head, &meta.tail)
+	}
+	index := 1
+	for _, field := range fields {
+		value, size := binary.Uvarint(buffer[index:])
+		if size <= 0 {
+			return nil, fmt.Errorf("元数据解析失败: %w", ErrCorruptRecord)
+		}
+		*field = value
+		index += size
+	}
+	return meta, nil
+}
+
+// memberPrefix 获取数据结构成员key前缀
+func (meta *dataStructureMeta) memberPrefix(key []byte) []byte {
+	return binary.BigEndian.AppendUint64(dataStructureKeyPrefix(key), meta.version)
+}
+
+// dataStructureKeyPrefix 获取key所有版本成员的公共前缀
+func dataStructureKeyPrefix(key []byte) []byte {
+	buffer := make([]byte, 0, len(dataStructurePrefix)+binary.MaxVarintLen64+len(key)+8)
+	buffer = append(buffer, dataStructurePrefix...)
+	buffer = binary.AppendUvarint(buffer, uint64(len(key)))
+	return append(buffer, key...)
+}
+
+func (meta *dataStructureMeta) memberKey(key []byte, member ...[]byte) []byte {
+	memberKey := meta.memberPrefix(key)
+	for _, part := range member {
+		memberKey = append(memberKey, part...)
+	}
+	return memberKey
+}
+
+// findMeta 读取key的元数据 key不存在时创建新的元数据 调用方需要持有锁
+func (db *Db) findMeta(key []byte, dataType DataType) (*dataStructureMeta, error) {
+	value, err := db.readValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		// 写入元数据的事务分配的序列号都大于当前序列号 与之前的版本不会重复
+		meta := &dataStructureMeta{dataType: dataType, version: db.seq + 1}
+		if dataType == List {
+			meta.head, meta.tail = listInitialIndex, listInitialIndex
+		}
+		return meta, nil
+	}
+
+	meta, err := decodingMeta(value)
+	if err != nil {
+		return nil, err
+	}
+	if meta.dataType != dataType {
+		return nil, fmt.Errorf("key %q: %w", key, ErrWrongType)
+	}
+	return meta, nil
+}
+
+// readValue 读取key的value key不存在时返回nil 调用方需要持有锁
+func (db *Db) readValue(key []byte) ([]byte, error) {
+	pos := db.index.Get(key)
+	if pos == nil {
+		return nil, nil
+	}
+	record, err := db.posByLogRecord(key, pos)
+	if err != nil {
+		return nil, err
+	}
+	if record.Value == nil {
+		return []byte{}, nil
+	}
+	return record.Value, nil
+}
+
+// commitMeta 在一个事务中写入元数据以及成员变化 成员数量为0时删除元数据 调用方需要持有锁
+func (db *Db) commitMeta(key []byte, meta *dataStructureMeta, writes map[string]*data.LogRecord) error {
+	if meta.size == 0 {
+		if db.index.Get(key) != nil {
+			writes[string(key)] = &data.LogRecord{Key: key, Type: data.Deleted}
+		}
+	} else {
+		writes[string(key)] = &data.LogRecord{Key: key, Value: encodingMeta(meta), Type: data.Normal}
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return db.commit(writes, true, false)
+}
+
+// withMemberDeletes 覆盖或者删除数据结构的key时 在同一个事务中删除所有成员 没有成员时返回writes本身 调用方需要持有锁
+// 同一个事务中写入的成员保留 导入数据结构时元数据与成员一起写入
+func (db *Db) withMemberDeletes(writes map[string]*data.LogRecord) (map[string]*data.LogRecord, error) {
+	var result map[string]*data.LogRecord
+	for key := range writes {
+		if isInternalKey([]byte(key)) {
+			continue
+		}
+		prefix := dataStructureKeyPrefix([]byte(key))
+		err := db.rangeMemberKeys(prefix, prefixUpperBound(prefix), func(memberKey []byte) {
+			if _, ok := writes[string(memberKey)]; ok {
+				return
+			}
+			if result == nil {
+				result = make(map[string]*data.LogRecord, len(writes)+1)
+				for writeKey, record := range writes {
+					result[writeKey] = record
+				}
+			}
+			result[string(memberKey)] = deleteRecord(memberKey)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if result == nil {
+		return writes, nil
+	}
+	return result, nil
+}
+
+// hasMembers 判断key是否存在任意版本的成员 调用方需要持有锁
+func (db *Db) hasMembers(key []byte) bool {
+	prefix := dataStructureKeyPrefix(key)
+	iterate := db.index.Iterate(index.IteratorOption{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	defer iterate.Close()
+	return iterate.HasNext()
+}
+
+// rangeMemberKeys 遍历[lowerBound, upperBound)范围内的成员key 不读取value 调用方需要持有锁
+func (db *Db) rangeMemberKeys(lowerBound []byte, upperBound []byte, fun func(memberKey []byte)) error {
+	iterate := db.index.Iterate(index.IteratorOption{LowerBound: lowerBound, UpperBound: upperBound})
+	defer iterate.Close()
+
+	for ; iterate.HasNext(); iterate.Next() {
+		memberKey, err := iterate.Key()
+		if err != nil {
+			return err
+		}
+		fun(memberKey)
+	}
+	return nil
+}
+
+// rangeMembers 按顺序遍历[lowerBound, upperBound)范围内的成员 返回false时停止 调用方需要持有锁
+func (db *Db) rangeMembers(lowerBound []byte, upperBound []byte, fun func(memberKey []byte, value []byte) bool) error {
+	iterate := db.index.Iterate(index.IteratorOption{LowerBound: lowerBound, UpperBound: upperBound})
+	defer iterate.Close()
+
+	for ; iterate.HasNext(); iterate.Next() {
+		memberKey, err := iterate.Key()
+		if err != nil {
+			return err
+		}
+		pos, err := iterate.Value()
+		if err != nil {
+			return err
+		}
+		record, err := db.posByLogRecord(memberKey, pos)
+		if err != nil {
+			return err
+		}
+		if !fun(memberKey, record.Value) {
+			break
+		}
+	}
+	return nil
+}
+
+func putRecord(key []byte, value []byte) *data.LogRecord {
+	return &data.LogRecord{Key: key, Value: value, Type: data.Normal}
+}
+
+func deleteRecord(key []byte) *data.LogRecord {
+	return &data.LogRecord{Key: key, Type: data.Deleted}
+}
+
+// ================ Hash ================
+
+// HSet 设置hash中field的value 返回field是否为新增
+func (db *Db) HSet(key []byte, field []byte, value []byte) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, Hash)
+	if err != nil {
+		return false, err
+	}
+	memberKey := meta.memberKey(key, field)
+	created := db.index.Get(memberKey) == nil
+	if created {
+		meta.size++
+	}
+
+	writes := map[string]*data.LogRecord{string(memberKey): putRecord(memberKey, value)}
+	return created, db.commitMeta(key, meta, writes)
+}
+
+// HGet 获取hash中field的value
+func (db *Db) HGet(key []byte, field []byte) ([]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, Hash)
+	if err != nil {
+		return nil, err
+	}
+	value, err := db.readValue(meta.memberKey(key, field))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("field %q: %w", field, ErrKeyNotFound)
+	}
+	return value, nil
+}
+
+// HDel 删除hash中的field 返回field是否存在
+func (db *Db) HDel(key []byte, field []byte) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, Hash)
+	if err != nil {
+		return false, err
+	}
+	memberKey := meta.memberKey(key, field)
+	if db.index.Get(memberKey) == nil {
+		return false, nil
+	}
+	meta.size--
+
+	writes := map[string]*data.LogRecord{string(memberKey): deleteRecord(memberKey)}
+	return true, db.commitMeta(key, meta, writes)
+}
+
+// HGetAll 获取hash中所有的field以及value
+func (db *Db) HGetAll(key []byte) (map[string][]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, Hash)
+	if err != nil {
+		return nil, err
+	}
+	prefix := meta.memberPrefix(key)
+	result := make(map[string][]byte, meta.size)
+	err = db.rangeMembers(prefix, prefixUpperBound(prefix), func(memberKey []byte, value []byte) bool {
+		result[string(memberKey[len(prefix):])] = value
+		return true
+	})
+	return result, err
+}
+
+// ================ List ================
+
+// LPush 从列表头部依次插入value 返回插入后的列表长度
+func (db *Db) LPush(key []byte, values ...[]byte) (int, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, List)
+	if err != nil {
+		return 0, err
+	}
+	writes := make(map[string]*data.LogRecord, len(values)+1)
+	for _, value := range values {
+		meta.head--
+		memberKey := meta.memberKey(key, binary.BigEndian.AppendUint64(nil, meta.head))
+		writes[string(memberKey)] = putRecord(memberKey, value)
+	}
+	meta.size = meta.tail - meta.head
+
+	return int(meta.size), db.commitMeta(key, meta, writes)
+}
+
+// RPop 弹出列表尾部的value
+func (db *Db) RPop(key []byte) ([]byte, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, List)
+	if err != nil {
+		return nil, err
+	}
+	if meta.size == 0 {
+		return nil, fmt.Errorf("key %q: %w", key, ErrEmptyList)
+	}
+
+	memberKey := meta.memberKey(key, binary.BigEndian.AppendUint64(nil, meta.tail-1))
+	value, err := db.readValue(memberKey)
+	if err != nil {
+		return nil, err
+	}
+	meta.tail--
+	meta.size = meta.tail - meta.head
+
+	writes := map[string]*data.LogRecord{string(memberKey): deleteRecord(memberKey)}
+	return value, db.commitMeta(key, meta, writes)
+}
+
+// LRange 获取列表中[start, stop]范围内的value 负数表示从尾部开始计算的位置
+func (db *Db) LRange(key []byte, start int, stop int) ([][]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, List)
+	if err != nil {
+		return nil, err
+	}
+	first, last, ok := normalizeRange(start, stop, int(meta.size))
+	if !ok {
+		return [][]byte{}, nil
+	}
+
+	lowerBound := meta.memberKey(key, binary.BigEndian.AppendUint64(nil, meta.head+uint64(first)))
+	upperBound := meta.memberKey(key, binary.BigEndian.AppendUint64(nil, meta.head+uint64(last)+1))
+	values := make([][]byte, 0, last-first+1)
+	err = db.rangeMembers(lowerBound, upperBound, func(memberKey []byte, value []byte) bool {
+		values = append(values, value)
+		return true
+	})
+	return values, err
+}
+
+// normalizeRange 将redis风格的闭区间转换为非负的位置 范围为空时返回false
+func normalizeRange(start int, stop int, size int) (int, int, bool) {
+	if start < 0 {
+		start += size
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop || start >= size {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// ================ Set ================
+
+// SAdd 向集合中添加成员 返回新增的成员数量
+func (db *Db) SAdd(key []byte, members ...[]byte) (int, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, Set)
+	if err != nil {
+		return 0, err
+	}
+	writes := make(map[string]*data.LogRecord, len(members)+1)
+	for _, member := range members {
+		memberKey := meta.memberKey(key, member)
+		if _, ok := writes[string(memberKey)]; ok || db.index.Get(memberKey) != nil {
+			continue
+		}
+		writes[string(memberKey)] = putRecord(memberKey, nil)
+	}
+	added := len(writes)
+	meta.size += uint64(added)
+
+	return added, db.commitMeta(key, meta, writes)
+}
+
+// SIsMember 判断成员是否在集合中
+func (db *Db) SIsMember(key []byte, member []byte) (bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, Set)
+	if err != nil {
+		return false, err
+	}
+	return db.index.Get(meta.memberKey(key, member)) != nil, nil
+}
+
+// SMembers 获取集合中所有的成员
+func (db *Db) SMembers(key []byte) ([][]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, Set)
+	if err != nil {
+		return nil, err
+	}
+	prefix := meta.memberPrefix(key)
+	members := make([][]byte, 0, meta.size)
+	err = db.rangeMembers(prefix, prefixUpperBound(prefix), func(memberKey []byte, value []byte) bool {
+		members = append(members, memberKey[len(prefix):])
+		return true
+	})
+	return members, err
+}
+
+// ================ ZSet ================
+
+// ZAdd 向有序集合中添加成员或者更新成员的分数 返回成员是否为新增
+// 每个成员保存两条记录: 成员 -> 分数 用于查询分数 以及 分数 + 成员 用于按分数排序
+func (db *Db) ZAdd(key []byte, score float64, member []byte) (bool, error) {
+	if err := validateKey(key); err != nil {
+		return false, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	meta, err := db.findMeta(key, ZSet)
+	if err != nil {
+		return false, err
+	}
+	memberKey := meta.memberKey(key, []byte{zsetMemberTag}, member)
+	oldScore, err := db.readValue(memberKey)
+	if err != nil {
+		return false, err
+	}
+
+	writes := make(map[string]*data.LogRecord, 3)
+	if oldScore != nil {
+		oldScoreKey := meta.memberKey(key, []byte{zsetScoreTag}, oldScore, member)
+		writes[string(oldScoreKey)] = deleteRecord(oldScoreKey)
+	} else {
+		meta.size++
+	}
+	encodedScore := encodingScore(score)
+	scoreKey := meta.memberKey(key, []byte{zsetScoreTag}, encodedScore, member)
+	writes[string(scoreKey)] = putRecord(scoreKey, nil)
+	writes[string(memberKey)] = putRecord(memberKey, encodedScore)
+
+	return oldScore == nil, db.commitMeta(key, meta, writes)
+}
+
+// ZScore 获取有序集合中成员的分数
+func (db *Db) ZScore(key []byte, member []byte) (float64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, ZSet)
+	if err != nil {
+		return 0, err
+	}
+	encodedScore, err := db.readValue(meta.memberKey(key, []byte{zsetMemberTag}, member))
+	if err != nil {
+		return 0, err
+	}
+	if encodedScore == nil {
+		return 0, fmt.Errorf("成员 %q: %w", member, ErrKeyNotFound)
+	}
+	return decodingScore(encodedScore), nil
+}
+
+// ZRange 按分数从小到大获取排名在[start, stop]范围内的成员 负数表示从尾部开始计算的排名
+func (db *Db) ZRange(key []byte, start int, stop int) ([][]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	meta, err := db.findMeta(key, ZSet)
+	if err != nil {
+		return nil, err
+	}
+	first, last, ok := normalizeRange(start, stop, int(meta.size))
+	if !ok {
+		return [][]byte{}, nil
+	}
+
+	prefix := meta.memberKey(key, []byte{zsetScoreTag})
+	members := make([][]byte, 0, last-first+1)
+	rank := 0
+	err = db.rangeMembers(prefix, prefixUpperBound(prefix), func(memberKey []byte, value []byte) bool {
+		if rank >= first {
+			// 分数固定为8字节
+			members = append(members, memberKey[len(prefix)+8:])
+		}
+		rank++
+		return rank <= last
+	})
+	return members, err
+}
+
+// encodingScore 将分数编码为按字节比较时与数值大小顺序一致的8字节
+func encodingScore(score float64) []byte {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+func decodingScore(buffer []byte) float64 {
+	bits := binary.BigEndian.Uint64(buffer)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
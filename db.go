@@ -1,25 +1,27 @@
-package main
+package kv
 
 import (
-	"encoding/binary"
 	"errors"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/cache"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/fio"
+	"github.com/RainbowSorcery/kv-project/index"
 	"io"
-	"kv-database/data"
-	"kv-database/fio"
-	"kv-database/index"
-	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Db bitcask实例 面向用户的接口
 type Db struct {
 	// 系统配置
-	option option
+	option Options
 	// 锁
 	lock *sync.RWMutex
 	// 活动文件
@@ -34,25 +36,99 @@ type Db struct {
 	mergeIng bool
 	// 合并记录列表
 	mergeCompleteFileId map[uint32]struct{}
+	// 每个数据文件中可回收的字节数 key被覆盖或删除时累加
+	reclaimable map[uint32]int64
+	// 关闭信号 用于停止后台自动合并协程
+	closeCh chan struct{}
+	// 等待后台协程退出
+	backgroundWait sync.WaitGroup
+	// 活动文件中记录的hint信息 活动文件写满归档时写入hint文件
+	activeHints []*data.HintRecord
+	// value缓存 未开启时为nil
+	valueCache cache.Cache
+	// 数据文件共享的块缓存 未开启时为nil
+	blockCache *fio.BlockCache
+	// 活动blob文件
+	activeBlobFile *data.BlobFile
+	// 所有blob文件
+	blobFiles map[uint32]*data.BlobFile
+	// 下一个blob文件id 流式写入与活动blob文件共用
+	nextBlobFileId uint32
+	// value存放在blob文件中的key以及对应的blob位置
+	blobRefs map[string]*data.BlobPos
+	// 每个blob文件中可回收的字节数
+	blobReclaimable map[uint32]int64
+	// 存在未合并操作数的key 以及对应的基础value和操作数位置
+	operandChains map[string]*operandChain
+	// 最近一次写入的序列号
+	seq uint64
+	// 已注册的二级索引以及对应的字段提取函数
+	secondaryIndexes map[string]IndexExtractor
+	// 内部key数量 统计key数量时排除
+	internalKeyNum int
+	// 运行指标
+	metrics *dbMetrics
+	// 最近一次合并完成的时间 没有合并过时为零值
+	lastMergeTime time.Time
+	// 是否已关闭
+	closed bool
+	// 是否有进行中的批量导入
+	bulkLoading bool
+	// 打开时挂载的批量导入 没有挂载时为nil
+	attachedBulk *data.BulkFinishRecord
+	// 批量导入挂载失败的原因 挂载失败后不允许写入 重新打开数据库时继续挂载
+	attachErr error
+	// 被删除的key以及墓碑的序列号 只在加载索引以及在线批量导入期间记录
+	tombstoneSeqs map[string]uint64
+	// 挂载时比删除更早而被忽略的key 需要在导入的文件之后重新写入墓碑
+	shadowedKeys [][]byte
 }
 
-func open(option option) (*Db, error) {
-	// 校验option配置是否合法
-	if len(option.DirPath) == 0 {
-		return nil, errors.New("目录为空")
+// Open 打开数据库 opts依次修改options中的配置 未设置的配置使用默认值
+func Open(options Options, opts ...Option) (*Db, error) {
+	option, err := buildOptions(options, opts...)
+	if err != nil {
+		return nil, err
 	}
 
 	db := &Db{
-		option:     option,
-		lock:       new(sync.RWMutex),
-		activeFile: nil,
-		oldFile:    make(map[uint32]*data.FileData, 10),
-		index:      index.NewBtree(),
-		TranNum:    new(int64),
+		option:              option,
+		lock:                new(sync.RWMutex),
+		activeFile:          nil,
+		oldFile:             make(map[uint32]*data.FileData, 10),
+		index:               index.NewBtree(),
+		TranNum:             new(int64),
+		mergeCompleteFileId: make(map[uint32]struct{}),
+		reclaimable:         make(map[uint32]int64),
+		closeCh:             make(chan struct{}),
+		blobFiles:           make(map[uint32]*data.BlobFile),
+		blobRefs:            make(map[string]*data.BlobPos),
+		blobReclaimable:     make(map[uint32]int64),
+		operandChains:       make(map[string]*operandChain),
+		secondaryIndexes:    make(map[string]IndexExtractor),
+		metrics:             newDbMetrics(),
+	}
+	if option.ValueCacheSize > 0 {
+		db.valueCache = cache.NewCache(option.ValueCachePolicy, option.ValueCacheSize)
+	}
+	if option.BlockCacheSize > 0 {
+		db.blockCache = fio.NewBlockCache(option.BlockCacheSize, option.BlockSize, option.ReadAheadBlocks)
+	}
+
+	// 完成上次中断的合并
+	err = db.recoverMerge()
+	if err != nil {
+		return nil, err
+	}
+
+	// 挂载已提交的批量导入
+	err = db.recoverBulk()
+	if err != nil {
+		return nil, err
 	}
 
 	// 初始化db
-	err := db.LoadDb()
+	err = db.LoadDb()
 
 	if err != nil {
 		return nil, err
@@ -64,151 +140,215 @@ func open(option option) (*Db, error) {
 		return nil, err
 	}
 
-	// 读取活动文件 并记录上次写文件的位置
-	offset, err := readFileData(db, db.activeFile)
-	if err != nil && err == io.EOF {
-		log.Printf("文件读取完毕, fileId:%d\n", db.activeFile.FileId)
-	} else if err != nil && err != io.EOF {
+	// 打开blob文件
+	err = db.loadBlobFiles()
+	if err != nil {
 		return nil, err
 	}
 
-	db.activeFile.WriteOffset = offset
-
-	// 读取非活动文件
-	for _, oldFileData := range db.oldFile {
-		// 判断hint文件是存在且合并记录中有当前fileId 那么读取hint文件
-		_, err := os.Stat(db.option.DirPath + data.HintFileName)
-		if !os.IsNotExist(err) && db.mergeCompleteFileId[oldFileData.FileId] == struct{}{} {
-			// 读取hint文件，建立内存索引
-			err = db.LoadHintFile(oldFileData)
-		} else {
-			_, err = readFileData(db, oldFileData)
+	// 并行读取数据文件 建立内存索引
+	err = db.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	// 只读模式下被忽略的记录仍然不会生效 下次以读写模式打开时写入墓碑
+	if !db.option.ReadOnly {
+		if err := db.writeShadowedTombstones(); err != nil {
+			return nil, err
+		}
+		if db.attachedBulk != nil {
+			if err := db.deleteAttachedMembers(db.attachedBulk); err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		if err != nil && err == io.EOF {
-			log.Printf("文件读取完毕, fileId:%d\n", oldFileData.FileId)
-		} else if err != nil && err != io.EOF {
+	// 注册配置中的二级索引 第一次注册时根据已有数据建立索引
+	for name, extractor := range db.option.Indexes {
+		if err := db.RegisterIndex(name, extractor); err != nil {
 			return nil, err
 		}
+		// 批量导入的数据没有索引条目 挂载后需要重建
+		if db.attachedBulk != nil {
+			if err := db.Index(name).Rebuild(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 开启后台自动合并 只读模式下不合并
+	if !db.option.ReadOnly && (db.option.MergeRatio > 0 || db.option.BlobGCRatio > 0) {
+		db.backgroundWait.Add(1)
+		go db.autoMerge()
 	}
 
 	return db, nil
 }
 
-func readFileData(db *Db, activeFile *data.FileData) (int64, error) {
-	// 事务暂存数据
-	txCache := make(map[int64]map[string]*data.LogRecordPos)
+// readFileData 读取数据文件 返回文件写入偏移以及文件对应的hint记录
+func readFileData(fileData *data.FileData) (int64, []*data.HintRecord, error) {
+	hintRecords := make([]*data.HintRecord, 0)
 
 	var offset int64 = 0
 	for {
-		logRecord, size, err := activeFile.Read(offset)
+		logRecord, size, err := fileData.Read(offset)
 
 		// 根据偏移读取文件内容 如果文件内容EOF了，那么表示文件读取完毕了
 		if err != nil && err == io.EOF {
 			break
+		} else if err != nil {
+			return offset, nil, err
 		}
 
 		txNum, key := DecodingTranKey(logRecord.Key)
-		// 判断record状态 如果是事务提交对象则暂存到缓存区中 如果不是则判断元素是否被删除 如果被删除则从内存索引中将元素移除
-		if txNum != 0 && logRecord.Type != data.TxComplete {
-			txValueMap := txCache[txNum]
-			if txValueMap == nil {
-				txValueMap = make(map[string]*data.LogRecordPos)
-			}
-			if logRecord.Type == data.Normal {
-				txValueMap[string(key)] = &data.LogRecordPos{
-					FileId: activeFile.FileId,
-					Pos:    offset,
-				}
-			} else if logRecord.Type == data.Deleted {
-				txValueMap[string(key)] = nil
-			}
-
-			txCache[txNum] = txValueMap
-		} else if logRecord.Type == data.Normal {
-			_, realKey := DecodingTranKey(logRecord.Key)
-			db.index.Put(realKey, &data.LogRecordPos{
-				FileId: activeFile.FileId,
+		hintRecord := &data.HintRecord{
+			Key:     key,
+			Type:    logRecord.Type,
+			TranNum: txNum,
+			Pos: &data.LogRecordPos{
+				FileId: fileData.FileId,
 				Pos:    offset,
-			})
-		} else if logRecord.Type == data.Deleted {
-			_, realKey := DecodingTranKey(logRecord.Key)
-			db.index.Delete(realKey)
-		} else if logRecord.Type == data.TxComplete {
-			// 如果遇到事务索引以完成则读取事务数据到内存中
-			txKey, _ := DecodingTranKey(logRecord.Key)
-			txValue := txCache[txKey]
-			for key := range txValue {
-				if txValue[key] != nil {
-					db.index.Put([]byte(key), txValue[key])
-				} else {
-					db.index.Delete([]byte(key))
-				}
-			}
-			delete(txCache, txNum)
-			db.TranNum = &txNum
-			//db.TranNum = &txNum
+				Size:   uint32(size),
+				Seq:    logRecord.Seq,
+			},
 		}
+		if logRecord.Type == data.BlobIndex {
+			hintRecord.Value = logRecord.Value
+		}
+		hintRecords = append(hintRecords, hintRecord)
 
 		// 计算下个record偏移
 		offset += size
 	}
-	return offset, nil
+	return offset, hintRecords, nil
 }
 
-// LoadHintFile 加载Hint文件
-func (db *Db) LoadHintFile(fileData *data.FileData) error {
-	// 读取合并完成记录信息
-	hintFile, err := fio.CreateFileIo(db.option.DirPath + data.HintFileName)
-	if err != nil {
-		return err
+// loadRecord 根据记录信息更新内存索引 事务中的记录暂存到事务缓存中 等到事务完成记录出现后才生效
+func (db *Db) loadRecord(record *data.HintRecord, txCache map[int64]map[string]*data.HintRecord) {
+	if record.Pos.Seq > db.seq {
+		db.seq = record.Pos.Seq
+	}
+	txNum := record.TranNum
+	// 判断record状态 如果是事务提交对象则暂存到缓存区中 如果不是则判断元素是否被删除 如果被删除则从内存索引中将元素移除
+	if txNum != 0 && record.Type != data.TxComplete {
+		txValueMap := txCache[txNum]
+		if txValueMap == nil {
+			txValueMap = make(map[string]*data.HintRecord)
+			txCache[txNum] = txValueMap
+		}
+		txValueMap[string(record.Key)] = record
+		return
 	}
-	// 读取hint文件
-	var offset int64 = 0
-	for {
-		// 读取key信息
-		keySizeBuffer := make([]byte, binary.MaxVarintLen64)
-		_, err := hintFile.Read(offset, keySizeBuffer)
 
-		if err != nil && err == io.EOF {
-			break
+	if record.Type == data.TxComplete {
+		// 如果遇到事务索引以完成则读取事务数据到内存中
+		for _, txValue := range txCache[txNum] {
+			db.applyRecord(txValue)
 		}
-		keySize, varintIndex := binary.Uvarint(keySizeBuffer)
-		offset += int64(varintIndex)
-
-		key := make([]byte, keySize)
-		_, err = hintFile.Read(offset, key)
-		offset += int64(keySize)
-
-		buffer := make([]byte, 12)
-		readByteSize, err := hintFile.Read(offset, buffer)
+		// 事务完成记录只用于标记事务提交 本身可以回收
+		db.reclaimable[record.Pos.FileId] += int64(record.Pos.Size)
+		delete(txCache, txNum)
+		if txNum > *db.TranNum {
+			*db.TranNum = txNum
+		}
+		return
+	}
 
-		pos, err := data.DecodingLogRecordPos(buffer)
+	db.applyRecord(record)
+}
 
-		if err != nil {
-			return err
-		}
+// applyRecord 将已提交的记录更新到内存索引中
+func (db *Db) applyRecord(record *data.HintRecord) {
+	// 批量导入的记录在导入时分配序列号 挂载前写入的同名key可能更新 此时保留较新的写入
+	if db.staleRecord(record) {
+		db.reclaimable[record.Pos.FileId] += int64(record.Pos.Size)
+		return
+	}
 
-		if err != nil && err == io.EOF {
-			break
+	if data.IsValueType(record.Type) {
+		var blobPos *data.BlobPos
+		if record.Type == data.BlobIndex {
+			blobPos, _ = data.DecodingBlobPos(record.Value)
 		}
+		db.indexPut(record.Key, record.Pos, blobPos)
+	} else if record.Type == data.Deleted {
+		db.indexDelete(record.Key, record.Pos)
+	} else if record.Type == data.MergeOperand {
+		db.indexPutOperand(record.Key, record.Pos)
+	}
+}
 
-		_, realKey := DecodingTranKey(key)
-		db.index.Put(realKey, pos)
+// staleRecord 判断记录是否比内存索引中的记录或者墓碑更早 没有序列号的记录按文件顺序生效
+func (db *Db) staleRecord(record *data.HintRecord) bool {
+	if record.Pos.Seq == 0 {
+		return false
+	}
+	if pos := db.index.Get(record.Key); pos != nil {
+		return record.Pos.Seq < pos.Seq
+	}
+	if seq, ok := db.tombstoneSeqs[string(record.Key)]; ok && record.Pos.Seq < seq {
+		db.shadowedKeys = append(db.shadowedKeys, record.Key)
+		return true
+	}
+	return false
+}
 
-		offset += int64(readByteSize)
+// LoadHintFile 读取数据文件对应的Hint文件
+func (db *Db) LoadHintFile(fileData *data.FileData) ([]*data.HintRecord, error) {
+	hintFile, err := data.OpenHintFile(db.option.DirPath, fileData.FileId)
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.FileManage.Close()
 
+	// 读取hint文件
+	records, err := hintFile.ReadHintRecords()
+	if err != nil {
+		return nil, err
+	}
+	// hint文件与数据文件一一对应 批量导入的文件挂载时会修改文件id 位置中的文件id以数据文件为准
+	for _, record := range records {
+		record.Pos.FileId = fileData.FileId
 	}
+	return records, nil
+}
 
-	// 将合并文件移动到主目录中
+// indexPut 更新内存索引 被覆盖的旧记录计入可回收空间 blobPos不为空表示value存放在blob文件中
+func (db *Db) indexPut(key []byte, pos *data.LogRecordPos, blobPos *data.BlobPos) {
+	db.dropOperandChain(key)
+	if oldPos := db.index.Put(key, pos); oldPos != nil {
+		db.reclaimable[oldPos.FileId] += int64(oldPos.Size)
+	} else if isInternalKey(key) {
+		db.internalKeyNum++
+	}
+	db.trackBlob(key, blobPos)
+}
 
-	return nil
+// indexDelete 删除内存索引 被删除的旧记录以及墓碑记录本身都计入可回收空间
+func (db *Db) indexDelete(key []byte, tombstonePos *data.LogRecordPos) {
+	db.dropOperandChain(key)
+	if oldPos, ok := db.index.Delete(key); ok && oldPos != nil {
+		db.reclaimable[oldPos.FileId] += int64(oldPos.Size)
+		if isInternalKey(key) {
+			db.internalKeyNum--
+		}
+	}
+	if tombstonePos != nil {
+		db.reclaimable[tombstonePos.FileId] += int64(tombstonePos.Size)
+		if db.tombstoneSeqs != nil {
+			db.tombstoneSeqs[string(key)] = tombstonePos.Seq
+		}
+	}
+	db.trackBlob(key, nil)
 }
 
 // LoadDb 加载db文件
 func (db *Db) LoadDb() error {
-	// 判断目录是否存在 如果不存在则创建
+	// 判断目录是否存在 如果不存在则创建 只读模式下不创建
 	_, err := os.Stat(db.option.DirPath)
+	if os.IsNotExist(err) && db.option.ReadOnly {
+		return fmt.Errorf("只读模式下数据目录不存在: %w", err)
+	}
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(db.option.DirPath, 0644)
 		if err != nil {
@@ -230,8 +370,11 @@ func (db *Db) LoadDb() error {
 	}
 
 	// 如果目录下没有文件 那么初始化一个活动文件
+	if len(fileDataArr) == 0 && db.option.ReadOnly {
+		return errors.New("只读模式下数据目录中没有数据文件")
+	}
 	if fileDataArr == nil || len(fileDataArr) == 0 {
-		fileData, err := data.OpenFileData(db.option.DirPath, uint32(0))
+		fileData, err := data.OpenFileData(db.option.DirPath, uint32(0), db.blockCache)
 		if err != nil {
 			return err
 		}
@@ -249,7 +392,7 @@ func (db *Db) LoadDb() error {
 				if err != nil {
 					return err
 				}
-				fileData, err := data.OpenFileData(db.option.DirPath, uint32(fileId))
+				fileData, err := db.openFileData(uint32(fileId))
 				if err != nil {
 					return err
 				}
@@ -269,9 +412,30 @@ func (db *Db) LoadDb() error {
 
 // Put 添加kv
 func (db *Db) Put(key []byte, value []byte) error {
+	defer db.metrics.putLatency.ObserveSince(time.Now())
+
 	// 判断key是否合法
-	if len(key) == 0 {
-		return errors.New("key为空")
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.put(key, value, 0)
+}
+
+// put 写入kv并更新内存索引 seq为0时分配新的序列号 调用方需要持有锁
+func (db *Db) put(key []byte, value []byte, seq uint64) error {
+	// 注册了二级索引或者覆盖数据结构时 value与索引条目、成员的删除在同一个事务中写入 与普通写入一样不刷盘
+	writes, err := db.withMemberDeletes(map[string]*data.LogRecord{
+		string(key): {Key: key, Value: value, Type: data.Normal, Seq: seq},
+	})
+	if err != nil {
+		return err
+	}
+	if len(writes) > 1 || len(db.secondaryIndexes) > 0 {
+		return db.commit(writes, true, false)
 	}
 
 	// 构建logRecord
@@ -279,33 +443,63 @@ func (db *Db) Put(key []byte, value []byte) error {
 		Key:   EncodingTranKey(key, 0),
 		Value: value,
 		Type:  data.Normal,
+		Seq:   seq,
+	}
+
+	// 大value写入blob文件 数据文件中只保存blob文件中的位置
+	var blobPos *data.BlobPos
+	if db.isBlobValue(value) {
+		blobRecord, pos, err := db.writeBlob(key, value)
+		if err != nil {
+			return err
+		}
+		logRecord.Value = blobRecord.Value
+		logRecord.Type = data.BlobIndex
+		blobPos = pos
 	}
 
 	// 向文件追加数据
-	logRecordPos, err := db.appendLogRecordSync(logRecord)
+	logRecordPos, err := db.AppendLogRecord(logRecord)
 	if err != nil {
-		return errors.New("文件追加失败")
+		return fmt.Errorf("文件追加失败: %w", err)
 	}
 
 	// 将追加的索引添加内存中
-	db.index.Put(key, logRecordPos)
+	db.indexPut(key, logRecordPos, blobPos)
 
 	return nil
 }
 
 // Delete 删除kv
 func (db *Db) Delete(key []byte) error {
+	defer db.metrics.deleteLatency.ObserveSince(time.Now())
+
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	// 校验key是否合法
-	if len(key) == 0 {
-		return errors.New("key为空")
+	if err := validateKey(key); err != nil {
+		return err
 	}
 
 	// 判断key是否在内存中存在
 	if db.index.Get(key) == nil {
-		return errors.New("key不存在")
+		return ErrKeyNotFound
+	}
+
+	return db.delete(key)
+}
+
+// delete 写入墓碑记录并删除内存索引 调用方需要持有锁
+func (db *Db) delete(key []byte) error {
+	writes, err := db.withMemberDeletes(map[string]*data.LogRecord{
+		string(key): {Key: key, Type: data.Deleted},
+	})
+	if err != nil {
+		return err
+	}
+	if len(writes) > 1 || len(db.secondaryIndexes) > 0 {
+		return db.commit(writes, true, false)
 	}
 
 	// 新建一个LogRecord并写入到磁盘中 在合并时再将墓碑值修改
@@ -314,26 +508,34 @@ func (db *Db) Delete(key []byte) error {
 		Type: data.Deleted,
 	}
 
-	_, err := db.AppendLogRecord(logRecord)
+	pos, err := db.AppendLogRecord(logRecord)
 
 	if err != nil {
 		return err
 	}
 
 	// 删除内存中的索引
-	db.index.Delete(key)
+	db.indexDelete(key, pos)
 
 	return nil
 }
 
-func (db *Db) appendLogRecordSync(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.lock.Lock()
-	defer db.lock.Unlock()
-	return db.AppendLogRecord(logRecord)
+// checkWritable 校验数据库是否允许写入 调用方需要持有锁
+func (db *Db) checkWritable() error {
+	if db.closed {
+		return ErrDbClosed
+	}
+	if db.option.ReadOnly {
+		return ErrReadOnly
+	}
+	return db.attachErr
 }
 
 // AppendLogRecord 将KV数据追加到文件中
 func (db *Db) AppendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	if err := db.checkWritable(); err != nil {
+		return nil, err
+	}
 
 	// 如果当前活跃文件为空 则创建当前活跃文件
 	if db.activeFile == nil {
@@ -344,15 +546,24 @@ func (db *Db) AppendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 
 	// 判断文件是否到达阈值 如果到达阈值则将旧的数据文件归档，创建新的数据文件
 	if db.activeFile.WriteOffset >= db.option.FileDataSize {
-		db.oldFile[db.activeFile.FileId] = db.activeFile
-
-		if err := db.setActiveFile(); err != nil {
+		if err := db.sealActiveFile(); err != nil {
 			return nil, err
 		}
 	}
 
+	// 记录长度以uint32保存 超过4GB的value需要通过PutReader写入blob文件
+	if int64(len(logRecord.Key))+int64(len(logRecord.Value)) > math.MaxUint32-data.MaxLogRecordHeaderSize {
+		return nil, ErrValueTooLarge
+	}
+
+	// 每次写入分配新的序列号 重写已有记录时保留原序列号
+	if logRecord.Seq == 0 {
+		db.seq++
+		logRecord.Seq = db.seq
+	}
+
 	// 将记录对象序列化为二进制字节数组
-	encodingData, _ := data.EncodingLogRecord(logRecord)
+	encodingData, size := data.EncodingLogRecord(logRecord)
 
 	offset := db.activeFile.WriteOffset
 
@@ -361,11 +572,72 @@ func (db *Db) AppendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if err != nil {
 		return nil, err
 	}
+	db.metrics.fileBytesWritten[db.activeFile.FileId] += uint64(size)
 
-	return &data.LogRecordPos{
+	pos := &data.LogRecordPos{
 		FileId: db.activeFile.FileId,
 		Pos:    offset,
-	}, nil
+		Size:   uint32(size),
+		Seq:    logRecord.Seq,
+	}
+
+	// 记录hint信息 活动文件归档时写入hint文件
+	txNum, realKey := DecodingTranKey(logRecord.Key)
+	hintRecord := &data.HintRecord{
+		Key:     realKey,
+		Type:    logRecord.Type,
+		TranNum: txNum,
+		Pos:     pos,
+	}
+	if logRecord.Type == data.BlobIndex {
+		hintRecord.Value = logRecord.Value
+	}
+	db.activeHints = append(db.activeHints, hintRecord)
+
+	return pos, nil
+}
+
+// sealActiveFile 归档活动文件 写入活动文件对应的hint文件后创建新的活动文件
+func (db *Db) sealActiveFile() error {
+	if err := db.archiveActiveFile(); err != nil {
+		return err
+	}
+	return db.setActiveFile()
+}
+
+// archiveActiveFile 将活动文件刷盘并写入hint文件以及布隆过滤器 之后作为非活动文件只读
+func (db *Db) archiveActiveFile() error {
+	err := db.syncFile(db.activeFile.FileManage)
+	if err != nil {
+		return err
+	}
+
+	err = data.WriteHintFile(db.option.DirPath, db.activeFile.FileId, db.activeHints)
+	if err != nil {
+		return err
+	}
+
+	// 归档的文件不会再写入 可以生成布隆过滤器
+	filter := db.newBloomFilter(db.activeHints)
+	err = data.WriteBloomFile(db.option.DirPath, db.activeFile.FileId, filter)
+	if err != nil {
+		return err
+	}
+	db.activeFile.Filter = filter
+
+	db.oldFile[db.activeFile.FileId] = db.activeFile
+	db.activeHints = nil
+
+	return nil
+}
+
+// newBloomFilter 根据数据文件中的记录创建布隆过滤器
+func (db *Db) newBloomFilter(records []*data.HintRecord) *data.BloomFilter {
+	filter := data.NewBloomFilter(len(records), db.option.BloomFalsePositive)
+	for _, record := range records {
+		filter.Add(record.Key)
+	}
+	return filter
 }
 
 // 设置活动文件
@@ -376,9 +648,9 @@ func (db *Db) setActiveFile() error {
 		activeFileId += 1
 	}
 
-	fileData, openFileDataError := data.OpenFileData(db.option.DirPath, uint32(activeFileId))
+	fileData, openFileDataError := data.OpenFileData(db.option.DirPath, uint32(activeFileId), db.blockCache)
 	if openFileDataError != nil {
-		return errors.New("创建数据文件失败")
+		return fmt.Errorf("创建数据文件失败: %w", openFileDataError)
 	}
 
 	db.activeFile = fileData
@@ -388,12 +660,12 @@ func (db *Db) setActiveFile() error {
 
 func (db *Db) read(key []byte) ([]byte, error) {
 	if len(key) == 0 {
-		return nil, errors.New("key为空")
+		return nil, ErrEmptyKey
 	}
 
 	keyIndex := db.index.Get(key)
 	if keyIndex == nil {
-		return nil, errors.New("key不存在")
+		return nil, ErrKeyNotFound
 	}
 
 	// 判断活动文件是否与index的file id相符
@@ -423,30 +695,107 @@ func (db *Db) read(key []byte) ([]byte, error) {
 
 // Get 根据key获取logRecord
 func (db *Db) Get(key []byte) (*data.LogRecord, error) {
+	defer db.metrics.getLatency.ObserveSince(time.Now())
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
 	// 在内存中查找key是否存在 如果不存在则直接抛出异常
 	EncodingTranKey(key, 0)
 	keyIndex := db.index.Get(key)
-	record, err := db.posByLogRecord(keyIndex)
+	record, err := db.posByLogRecord(key, keyIndex)
 	if err != nil {
 		return nil, err
 	}
 
 	if record.Type == data.Deleted {
-		return nil, errors.New("key已删除")
+		return nil, ErrKeyNotFound
 	}
 
 	return record, nil
 }
 
-func (db *Db) posByLogRecord(pos *data.LogRecordPos) (*data.LogRecord, error) {
+// Has 判断key是否存在 只查询内存索引 不读取value
+func (db *Db) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 
+	if db.closed {
+		return false, ErrDbClosed
+	}
+
+	pos := db.index.Get(key)
+	return pos != nil && db.mayContain(key, pos), nil
+}
+
+// mayContain 根据布隆过滤器判断记录所在的非活动文件是否可能包含key 返回false时key一定不在文件中 不需要读取磁盘 调用方需要持有锁
+func (db *Db) mayContain(key []byte, pos *data.LogRecordPos) bool {
+	fileData := db.oldFile[pos.FileId]
+	return fileData == nil || fileData.Filter == nil || fileData.Filter.MayContain(key)
+}
+
+func (db *Db) posByLogRecord(key []byte, pos *data.LogRecordPos) (*data.LogRecord, error) {
+	if db.closed {
+		return nil, ErrDbClosed
+	}
 	if pos == nil {
-		return nil, errors.New("索引不存在")
+		return nil, ErrKeyNotFound
 	}
 
+	// 优先从缓存中读取 key被覆盖后会写入新的位置 缓存中的旧数据不会再被读取
+	// 缓存中的记录被多次返回 返回副本避免调用方修改缓存
+	cacheKey := cache.Key{FileId: pos.FileId, Pos: pos.Pos}
+	if db.valueCache != nil {
+		if record, ok := db.valueCache.Get(cacheKey); ok {
+			return cloneLogRecord(record), nil
+		}
+	}
+
+	// 最后一个操作数的合并结果保存在内存中 不需要读取磁盘
+	if chain := db.operandChains[string(key)]; chain != nil && chain.hasMerged && samePos(chain.operands[len(chain.operands)-1], pos) {
+		return db.foldOperands(key)
+	}
+
+	record, err := db.readLogRecord(key, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	// 操作数记录需要与之前的value合并 合并结果以最后一个操作数的位置缓存
+	if record.Type == data.MergeOperand {
+		record, err = db.foldOperands(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if db.valueCache != nil && record.Type == data.Normal {
+		db.valueCache.Put(cacheKey, record)
+		return cloneLogRecord(record), nil
+	}
+
+	return record, nil
+}
+
+func cloneLogRecord(record *data.LogRecord) *data.LogRecord {
+	return &data.LogRecord{
+		Key:   append([]byte{}, record.Key...),
+		Value: append([]byte{}, record.Value...),
+		Type:  record.Type,
+		Seq:   record.Seq,
+	}
+}
+
+// readLogRecord 读取指定位置的记录 BlobIndex记录会从blob文件中读取value
+func (db *Db) readLogRecord(key []byte, pos *data.LogRecordPos) (*data.LogRecord, error) {
 	var fileData *data.FileData
 
 	// 判断文件是否为活跃文件
@@ -459,16 +808,35 @@ func (db *Db) posByLogRecord(pos *data.LogRecordPos) (*data.LogRecord, error) {
 
 	// 判断文件是否存在
 	if fileData == nil {
-		return nil, errors.New("文件不存在")
+		return nil, fmt.Errorf("数据文件%d不存在", pos.FileId)
+	}
+
+	// 布隆过滤器判断key不在文件中时不需要读取磁盘
+	if !db.mayContain(key, pos) {
+		return nil, ErrKeyNotFound
 	}
 
 	record, err := fileData.ReadLogRecord(pos.Pos)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("读取数据文件%d偏移%d失败: %w", pos.FileId, pos.Pos, err)
 	}
 
 	if record == nil {
-		return nil, errors.New("log record不存在")
+		return nil, ErrKeyNotFound
+	}
+
+	// 大value记录需要从blob文件中读取value
+	if record.Type == data.BlobIndex {
+		value, err := db.readBlob(record)
+		if err != nil {
+			return nil, err
+		}
+		record = &data.LogRecord{
+			Key:   record.Key,
+			Value: value,
+			Type:  data.Normal,
+			Seq:   record.Seq,
+		}
 	}
 
 	return record, nil
@@ -481,28 +849,51 @@ func (db *Db) KeyList() [][]byte {
 
 // Sync 将缓冲区的数据持久化到内存中
 func (db *Db) Sync() error {
-	err := db.activeFile.FileManage.Sync()
+	err := db.syncFile(db.activeFile.FileManage)
 	return err
 }
 
-// Close 关闭文件读写
+// Close 关闭文件读写 某个文件关闭失败时仍然关闭其余文件 返回所有错误 重复关闭返回ErrDbClosed
 func (db *Db) Close() error {
-	return db.activeFile.FileManage.Close()
+	db.lock.Lock()
+	if db.closed {
+		db.lock.Unlock()
+		return ErrDbClosed
+	}
+	db.closed = true
+	db.lock.Unlock()
+
+	// 停止后台自动合并 需要在加锁前等待 避免与正在执行的合并互相等待
+	close(db.closeCh)
+	db.backgroundWait.Wait()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	errs := make([]error, 0)
+	for _, oldFileData := range db.oldFile {
+		errs = append(errs, oldFileData.FileManage.Close())
+	}
+	for _, blobFile := range db.blobFiles {
+		errs = append(errs, blobFile.FileManage.Close())
+	}
+	if db.activeFile != nil {
+		errs = append(errs, db.activeFile.FileManage.Close())
+	}
+	return errors.Join(errs...)
 }
 
 func (db *Db) ListKeys() ([][]byte, error) {
-	iterate := db.index.Iterate(false)
-	keys := make([][]byte, db.index.Size())
+	iterate := db.userKeyIterator(index.IteratorOption{})
+	defer iterate.Close()
+	keys := make([][]byte, 0, db.index.Size())
 
-	keyIndex := 0
-	for !iterate.HasNext() {
+	for ; iterate.HasNext(); iterate.Next() {
 		key, err := iterate.Key()
 		if err != nil {
 			return nil, err
 		}
-		keys[keyIndex] = key
-		keyIndex++
-		iterate.Next()
+		keys = append(keys, key)
 	}
 
 	return keys, nil
@@ -512,10 +903,11 @@ func (db *Db) fold(fun func(key []byte, value []byte) bool) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	iterate := db.index.Iterate(false)
+	iterate := db.userKeyIterator(index.IteratorOption{})
+	defer iterate.Close()
 
 	// 判断迭代器是否还有key
-	for !iterate.HasNext() {
+	for iterate.HasNext() {
 		key, err := iterate.Key()
 
 		if err != nil {
@@ -526,7 +918,7 @@ func (db *Db) fold(fun func(key []byte, value []byte) bool) error {
 		if err != nil {
 			return err
 		}
-		value, err := db.posByLogRecord(pos)
+		value, err := db.posByLogRecord(key, pos)
 		if err != nil {
 			return err
 		}
@@ -540,44 +932,36 @@ func (db *Db) fold(fun func(key []byte, value []byte) bool) error {
 	return nil
 }
 
+// openFileData 打开已存在的数据文件 只读模式下以只读方式打开
+func (db *Db) openFileData(fileId uint32) (*data.FileData, error) {
+	if db.option.ReadOnly {
+		return data.OpenFileDataReadOnly(db.option.DirPath, fileId, db.blockCache)
+	}
+	return data.OpenFileData(db.option.DirPath, fileId, db.blockCache)
+}
+
 func (db *Db) LoadMergeCompleteFileId() error {
-	_, err := os.Stat(db.option.DirPath + data.MergeFinishFileName)
+	fileInfo, err := os.Stat(db.option.DirPath + data.MergeFinishFileName)
 
 	if !os.IsNotExist(err) {
-		fileIo, err := fio.CreateFileIo(db.option.DirPath + data.MergeFinishFileName)
+		// 合并完成记录在每次合并成功后重新写入 修改时间即为最近一次合并的时间
+		if fileInfo != nil {
+			db.lastMergeTime = fileInfo.ModTime()
+		}
 
+		buffer, err := os.ReadFile(db.option.DirPath + data.MergeFinishFileName)
 		if err != nil {
 			return err
 		}
-
-		var offset int64 = 0
-
-		// 先读取第一个对象获取到合并成功的文件数
-		buffer := make([]byte, binary.MaxVarintLen64)
-		index := 0
-		readSize, err := fileIo.Read(offset, buffer)
-		index += readSize
-		offset += int64(readSize)
-
+		mergeRecord, err := data.DecodingMergeFinishRecord(buffer)
 		if err != nil {
 			return err
 		}
 
-		mergeCompleteFileId := make(map[uint32]struct{}, readSize)
-
-		// 序号遍历读取合并成功的文件id
-		componetSize, _ := binary.Varint(buffer[:index])
-		for i := 0; i < int(componetSize); i++ {
-			buffer = make([]byte, 0)
-			readSize, err := fileIo.Read(offset, buffer)
-			offset += int64(readSize)
-			if err != nil {
-				return err
-			}
-
-			fileId, _ := binary.Varint(buffer)
-
-			mergeCompleteFileId[uint32(fileId)] = struct{}{}
+		// 记录合并成功的文件id
+		mergeCompleteFileId := make(map[uint32]struct{}, mergeRecord.FinishCount)
+		for _, fileId := range mergeRecord.MergerFinishFileIds {
+			mergeCompleteFileId[fileId] = struct{}{}
 		}
 
 		db.mergeCompleteFileId = mergeCompleteFileId
@@ -1,8 +1,9 @@
-package main
+package kv
 
 import (
-	"kv-database/data"
-	"kv-database/index"
+	"bytes"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/index"
 )
 
 type DbIterator struct {
@@ -15,7 +16,23 @@ type DbIterator struct {
 }
 
 func NewDbIterator(db *Db, option IteratorOption) *DbIterator {
-	iterate := db.index.Iterate(option.Reverse)
+	lowerBound, upperBound := option.LowerBound, option.UpperBound
+	// 前缀转换为遍历范围 与上下界取交集
+	if len(option.Prefix) > 0 {
+		if lowerBound == nil || bytes.Compare(option.Prefix, lowerBound) > 0 {
+			lowerBound = option.Prefix
+		}
+		prefixEnd := prefixUpperBound(option.Prefix)
+		if prefixEnd != nil && (upperBound == nil || bytes.Compare(prefixEnd, upperBound) < 0) {
+			upperBound = prefixEnd
+		}
+	}
+
+	iterate := db.userKeyIterator(index.IteratorOption{
+		Reverse:    option.Reverse,
+		LowerBound: lowerBound,
+		UpperBound: upperBound,
+	})
 	return &DbIterator{
 		Db:            db,
 		Option:        option,
@@ -23,17 +40,35 @@ func NewDbIterator(db *Db, option IteratorOption) *DbIterator {
 	}
 }
 
+// prefixUpperBound 获取前缀对应的上界 即大于所有以prefix开头的key的最小key 前缀全部为0xff时没有上界
+func prefixUpperBound(prefix []byte) []byte {
+	upperBound := make([]byte, len(prefix))
+	copy(upperBound, prefix)
+	for i := len(upperBound) - 1; i >= 0; i-- {
+		if upperBound[i] < 0xff {
+			upperBound[i]++
+			return upperBound[:i+1]
+		}
+	}
+	return nil
+}
+
 // Rewind 回到迭代器起点
 func (dbIterator *DbIterator) Rewind() {
 	dbIterator.IndexIterator.Rewind()
 }
 
+// Seek 定位到key所在位置 key不存在时定位到遍历方向上的下一个key
+func (dbIterator *DbIterator) Seek(key []byte) bool {
+	return dbIterator.IndexIterator.Seek(key)
+}
+
 // Next 遍历下一个key
 func (dbIterator *DbIterator) Next() {
 	dbIterator.IndexIterator.Next()
 }
 
-// HasNext 判断是否有下一个key用于遍历
+// HasNext 判断当前位置是否还有key用于遍历
 func (dbIterator *DbIterator) HasNext() bool {
 	return dbIterator.IndexIterator.HasNext()
 }
@@ -60,3 +95,46 @@ func (dbIterator *DbIterator) Value() (*data.LogRecord, error) {
 func (dbIterator *DbIterator) Close() error {
 	return dbIterator.IndexIterator.Close()
 }
+
+// Scan 顺序获取[start, end)范围内的kv start、end为空表示不限制 limit小于等于0表示不限制数量
+func (db *Db) Scan(start []byte, end []byte, limit int) ([]*data.LogRecord, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return nil, ErrInvalidRange
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	iterate := db.userKeyIterator(index.IteratorOption{
+		LowerBound: start,
+		UpperBound: end,
+	})
+	defer iterate.Close()
+
+	records := make([]*data.LogRecord, 0)
+	for ; iterate.HasNext(); iterate.Next() {
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+		key, err := iterate.Key()
+		if err != nil {
+			return nil, err
+		}
+		pos, err := iterate.Value()
+		if err != nil {
+			return nil, err
+		}
+		record, err := db.posByLogRecord(key, pos)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &data.LogRecord{
+			Key:   key,
+			Value: record.Value,
+			Type:  record.Type,
+			Seq:   record.Seq,
+		})
+	}
+
+	return records, nil
+}
@@ -1,7 +1,1896 @@
-package main
+package kv
 
-import "testing"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/fio"
+	"github.com/RainbowSorcery/kv-project/index"
+	"hash/crc32"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
 
 func TestDb_Get(t *testing.T) {
 
 }
+
+func TestDb_Stat(t *testing.T) {
+	db, err := Open(Options{
+		DirPath:      t.TempDir(),
+		FileDataSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Delete([]byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := db.Stat()
+	if stat.KeyNum != 99 {
+		t.Fatalf("key数量错误: %d", stat.KeyNum)
+	}
+	if stat.ReclaimableSize <= 0 || stat.ReclaimableSize >= stat.DiskSize {
+		t.Fatalf("可回收空间统计错误: %d/%d", stat.ReclaimableSize, stat.DiskSize)
+	}
+	if stat.LiveSize != stat.DiskSize-stat.ReclaimableSize || stat.ActiveFileId != uint32(stat.DataFileNum-1) {
+		t.Fatalf("文件统计错误: %+v", stat)
+	}
+	if stat.ActiveFileOffset != db.activeFile.FileManage.Size() || !stat.LastMergeTime.IsZero() || stat.MergeIng {
+		t.Fatalf("活动文件以及合并状态统计错误: %+v", stat)
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	mergedStat := db.Stat()
+	if mergedStat.DiskSize >= stat.DiskSize || mergedStat.ReclaimableSize >= stat.ReclaimableSize {
+		t.Fatalf("合并后空间未回收: %+v", mergedStat)
+	}
+	if mergedStat.LastMergeTime.IsZero() {
+		t.Fatal("合并时间未记录")
+	}
+	for i := 1; i < 100; i++ {
+		record, err := db.Get([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Value) != "2" {
+			t.Fatalf("合并后数据错误: %s", record.Value)
+		}
+	}
+}
+
+func TestDb_NeedMerge(t *testing.T) {
+	db, err := Open(Options{
+		DirPath:       t.TempDir(),
+		FileDataSize:  1024,
+		MergeRatio:    0.5,
+		MergeMinBytes: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !db.needMerge() {
+		t.Fatal("可回收空间达到阈值时需要合并")
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if db.needMerge() {
+		t.Fatal("合并后不需要再次合并")
+	}
+}
+
+func TestDb_MergePartial(t *testing.T) {
+	dirPath := t.TempDir() + "/"
+	db, err := Open(Options{
+		DirPath:       dirPath,
+		FileDataSize:  1024,
+		MergeMaxFiles: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 删除第一个文件中的数据 使第一个文件的可回收空间占比最高
+	for i := 0; i < 20; i++ {
+		if err := db.Delete([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.mergeCompleteFileId) != 1 {
+		t.Fatalf("合并文件数错误: %d", len(db.mergeCompleteFileId))
+	}
+	if _, ok := db.mergeCompleteFileId[0]; !ok {
+		t.Fatal("需要优先合并可回收空间占比最高的文件")
+	}
+	if _, err := os.Stat(dirPath + data.HintFileName(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		record, err := db.Get([]byte(strconv.Itoa(i)))
+		if i < 20 {
+			if err == nil {
+				t.Fatalf("key已删除: %d", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Value) != strconv.Itoa(i) {
+			t.Fatalf("合并后数据错误: %s", record.Value)
+		}
+	}
+}
+
+func TestDb_ReopenWithHint(t *testing.T) {
+	dirPath := t.TempDir() + "/"
+	db, err := Open(Options{
+		DirPath:      dirPath,
+		FileDataSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	batch := NewBatchWrite(db)
+	for i := 0; i < 50; i++ {
+		if err := batch.Put([]byte(strconv.Itoa(i)), []byte("batch")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Delete([]byte("99")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for fileId := range db.oldFile {
+		if _, err := os.Stat(dirPath + data.HintFileName(fileId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{
+		DirPath:      dirPath,
+		FileDataSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.index.Size() != 99 {
+		t.Fatalf("key数量错误: %d", db.index.Size())
+	}
+	for i := 0; i < 99; i++ {
+		record, err := db.Get([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "2"
+		if i < 50 {
+			expected = "batch"
+		}
+		if string(record.Value) != expected {
+			t.Fatalf("重新打开后数据错误: %d %s", i, record.Value)
+		}
+	}
+}
+
+func TestDb_LoadConcurrency(t *testing.T) {
+	dirPath := t.TempDir() + "/"
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := round; i < 100; i += 7 {
+			if err := db.Delete([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 事务写入的数据超过文件大小 会跨越多个数据文件
+	beginFileId := db.activeFile.FileId
+	batch := NewBatchWrite(db)
+	for i := 0; i < 80; i++ {
+		if err := batch.Put([]byte("batch"+strconv.Itoa(i)), bytes.Repeat([]byte{'v'}, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Delete([]byte("50")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if db.activeFile.FileId == beginFileId {
+		t.Fatal("事务需要跨越文件")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type loadResult struct {
+		positions   map[string]data.LogRecordPos
+		reclaimable map[uint32]int64
+		stat        *Stat
+	}
+	// load 删除hint文件后以只读模式打开 保证两次都是解析数据文件并且不会写入hint文件
+	load := func(concurrency int) *loadResult {
+		for fileId := uint32(0); fileId <= db.activeFile.FileId; fileId++ {
+			if err := os.Remove(dirPath + data.HintFileName(fileId)); err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+		db, err := Open(Options{DirPath: dirPath, FileDataSize: 1024, LoadConcurrency: concurrency, ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		result := &loadResult{
+			positions:   make(map[string]data.LogRecordPos),
+			reclaimable: make(map[uint32]int64),
+			stat:        db.Stat(),
+		}
+		iterator := db.index.Iterate(index.IteratorOption{})
+		defer iterator.Close()
+		for ; iterator.HasNext(); iterator.Next() {
+			key, err := iterator.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			pos, err := iterator.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result.positions[string(key)] = *pos
+		}
+		for fileId, size := range db.reclaimable {
+			result.reclaimable[fileId] = size
+		}
+		return result
+	}
+
+	serial := load(1)
+	parallel := load(8)
+	if len(serial.positions) != 80+100-15 {
+		t.Fatalf("key数量错误: %d", len(serial.positions))
+	}
+	if _, ok := serial.positions["50"]; ok {
+		t.Fatal("事务中删除的key不能存在")
+	}
+	if !reflect.DeepEqual(serial.positions, parallel.positions) {
+		t.Fatal("并行加载的索引与串行加载不一致")
+	}
+	if !reflect.DeepEqual(serial.reclaimable, parallel.reclaimable) {
+		t.Fatalf("并行加载的可回收空间与串行加载不一致: %v %v", serial.reclaimable, parallel.reclaimable)
+	}
+	if serial.stat.ReclaimableSize == 0 || serial.stat.ReclaimableSize != parallel.stat.ReclaimableSize || serial.stat.LiveSize != parallel.stat.LiveSize {
+		t.Fatalf("可回收空间统计错误: %d %d", serial.stat.ReclaimableSize, parallel.stat.ReclaimableSize)
+	}
+}
+
+func TestDb_Has(t *testing.T) {
+	dirPath := t.TempDir() + "/"
+	db, err := Open(Options{
+		DirPath:      dirPath,
+		FileDataSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for fileId, oldFile := range db.oldFile {
+		if oldFile.Filter == nil {
+			t.Fatalf("非活动文件缺少布隆过滤器: %d", fileId)
+		}
+		if _, err := os.Stat(dirPath + data.BloomFileName(fileId)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, _ := db.Has([]byte("0")); !ok {
+		t.Fatal("key存在")
+	}
+	if ok, _ := db.Has([]byte("1")); ok {
+		t.Fatal("key已删除")
+	}
+	if _, err := db.Has(nil); err == nil {
+		t.Fatal("key为空")
+	}
+
+	// 布隆过滤器判断key不在文件中时直接返回 不读取磁盘
+	pos := db.index.Get([]byte("0"))
+	db.oldFile[pos.FileId].Filter = data.NewBloomFilter(1, 0.01)
+	if ok, _ := db.Has([]byte("0")); ok {
+		t.Fatal("布隆过滤器中不存在的key需要返回false")
+	}
+	if _, err := db.Get([]byte("0")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("布隆过滤器中不存在的key需要返回ErrKeyNotFound: %v", err)
+	}
+}
+
+func TestDb_ValueCache(t *testing.T) {
+	db, err := Open(Options{
+		DirPath:        t.TempDir(),
+		FileDataSize:   1024,
+		ValueCacheSize: 1024 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("hot"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get([]byte("hot")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("hot"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	record, err := db.Get([]byte("hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record.Value) != "v2" {
+		t.Fatalf("覆盖后读取到旧数据: %s", record.Value)
+	}
+
+	stat := db.Stat().ValueCache
+	if stat.Hits != 9 || stat.Misses != 2 {
+		t.Fatalf("缓存统计错误: %+v", stat)
+	}
+
+	// 修改返回的记录不影响缓存
+	record.Value[0] = 'x'
+	if record, err := db.Get([]byte("hot")); err != nil || string(record.Value) != "v2" {
+		t.Fatalf("缓存中的记录被修改: %v", err)
+	}
+}
+
+func TestDb_BlockCache(t *testing.T) {
+	dirPath := t.TempDir()
+	opt := Options{
+		DirPath:        dirPath,
+		FileDataSize:   4096,
+		BlockCacheSize: 64 * 1024,
+		BlockSize:      512,
+	}
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除hint文件 启动时顺序读取数据文件
+	hintFiles, _ := filepath.Glob(filepath.Join(dirPath, "*"+data.HintFileSuffix))
+	for _, hintFile := range hintFiles {
+		_ = os.Remove(hintFile)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		record, err := db.Get([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Value) != strconv.Itoa(i) {
+			t.Fatalf("读取数据错误: %s", record.Value)
+		}
+	}
+}
+
+func TestDb_BlobValue(t *testing.T) {
+	dirPath := t.TempDir()
+	opt := Options{
+		DirPath:       dirPath,
+		FileDataSize:  1024,
+		BlobThreshold: 256,
+		BlobFileSize:  4096,
+	}
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largeValue := func(i int) []byte {
+		return []byte(strings.Repeat(strconv.Itoa(i), 300))
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			if err := db.Put([]byte(strconv.Itoa(i)), largeValue(i+round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Put([]byte("small"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := db.Stat()
+	if stat.BlobFileNum < 2 || stat.BlobReclaimableSize == 0 {
+		t.Fatalf("blob统计错误: %+v", stat)
+	}
+	if stat.DiskSize >= stat.BlobSize {
+		t.Fatalf("大value不能写入数据文件: %d %d", stat.DiskSize, stat.BlobSize)
+	}
+
+	if err := db.BlobGC(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stat().BlobSize >= stat.BlobSize {
+		t.Fatal("blob文件回收后空间未减少")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		record, err := db.Get([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Value) != string(largeValue(i+1)) {
+			t.Fatalf("读取大value错误: %d", i)
+		}
+	}
+	record, err := db.Get([]byte("small"))
+	if err != nil || string(record.Value) != "v" {
+		t.Fatalf("读取小value错误: %v", err)
+	}
+}
+
+func TestDb_StreamValue(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024, BlobFileSize: 1024, BlobGCRatio: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("stream", 50000)
+	if err := db.PutReader([]byte("big"), strings.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	// 活动blob文件达到阈值后才创建新文件 之后的流式写入追加到同一个文件
+	for _, key := range []string{"big2", "big3"} {
+		if err := db.PutReader([]byte(key), strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+		if db.Stat().BlobFileNum != 2 {
+			t.Fatalf("流式写入没有复用活动blob文件: %+v", db.Stat())
+		}
+		if record, err := db.Get([]byte(key)); err != nil || string(record.Value) != key {
+			t.Fatalf("读取流式写入的value错误: %v", err)
+		}
+	}
+	if err := db.PutReader([]byte("short"), strings.NewReader("abc"), 10); err == nil {
+		t.Fatal("reader长度不足时需要返回错误")
+	}
+	if _, err := db.GetReader([]byte("short")); err == nil {
+		t.Fatal("写入失败的key不能被读取")
+	}
+
+	reader, err := db.GetReader([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// 覆盖后回收旧blob文件 已打开的reader仍然可以读取
+	if err := db.Put([]byte("big"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BlobGC(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Stat().BlobFileNum != 1 {
+		t.Fatalf("旧blob文件未回收: %+v", db.Stat())
+	}
+
+	readValue, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(readValue) != value {
+		t.Fatal("流式读取value错误")
+	}
+
+	smallReader, err := db.GetReader([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smallReader.Close()
+	if readValue, _ := io.ReadAll(smallReader); string(readValue) != "small" {
+		t.Fatal("流式读取小value错误")
+	}
+
+	// reader阻塞时不影响其他读写
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutReader([]byte("slow"), pipeReader, 4)
+	}()
+	if _, err := pipeWriter.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("other"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := db.Get([]byte("big")); err != nil || string(record.Value) != "small" {
+		t.Fatalf("流式写入期间读取错误: %v", err)
+	}
+	if _, err := db.Get([]byte("slow")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("流式写入完成前key不能被读取: %v", err)
+	}
+	if _, err := pipeWriter.Write([]byte("cd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if record, err := db.Get([]byte("slow")); err != nil || string(record.Value) != "abcd" {
+		t.Fatalf("流式写入的value错误: %v", err)
+	}
+}
+
+func TestDb_Scan(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "user:1", "user:2", "user:3", "v"} {
+		if err := db.Put([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := db.Scan([]byte("user:"), []byte("v"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || string(records[0].Key) != "user:1" || string(records[1].Value) != "value-user:2" {
+		t.Fatalf("scan结果错误: %v", records)
+	}
+
+	iterator := NewDbIterator(db, IteratorOption{Prefix: []byte("user:"), Reverse: true})
+	defer iterator.Close()
+	keys := make([]string, 0)
+	for ; iterator.HasNext(); iterator.Next() {
+		key, _ := iterator.Key()
+		keys = append(keys, string(key))
+	}
+	if strings.Join(keys, ",") != "user:3,user:2,user:1" {
+		t.Fatalf("前缀遍历错误: %v", keys)
+	}
+}
+
+func TestDb_MergeValue(t *testing.T) {
+	dirPath := t.TempDir()
+	opt := Options{DirPath: dirPath, FileDataSize: 1024, MergeOperator: Int64AddOperator{}}
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 计数器的基础value与操作数分散在多个文件中
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("counter-"+strconv.Itoa(i)), []byte("100")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 10; i++ {
+			if err := db.MergeValue([]byte("counter-"+strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put([]byte("garbage"), []byte(strconv.Itoa(round))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.MergeValue([]byte("new"), []byte("7")); err != nil {
+		t.Fatal(err)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := db.Incr([]byte("incr"), 2); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	// 配置了计数器合并操作符时自增只追加操作数
+	if chain := db.operandChains["incr"]; chain == nil || len(chain.operands) != 50 {
+		t.Fatal("自增需要追加操作数")
+	}
+	if _, err := db.Incr([]byte(internalKeyPrefix+"incr"), 1); err == nil {
+		t.Fatal("不允许自增内部前缀的key")
+	}
+
+	check := func(db *Db) {
+		for i := 0; i < 10; i++ {
+			record, err := db.Get([]byte("counter-" + strconv.Itoa(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(record.Value) != strconv.Itoa(100+20*i) {
+				t.Fatalf("计数器%d合并结果错误: %s", i, record.Value)
+			}
+		}
+		for key, value := range map[string]string{"new": "7", "incr": "100"} {
+			record, err := db.Get([]byte(key))
+			if err != nil || string(record.Value) != value {
+				t.Fatalf("%s读取错误: %v", key, err)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+// TestDb_MergeValueConcurrentGet 并发读取同一个操作数key 使用-race检查读锁下没有写入
+func TestDb_MergeValueConcurrentGet(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, operand := range []string{"1", "2", "3"} {
+		if err := db.MergeValue([]byte("counter"), []byte(operand)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wait sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				record, err := db.Get([]byte("counter"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(record.Value) != "6" {
+					errs <- fmt.Errorf("合并结果错误: %s", record.Value)
+					return
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_CompareAndSwap(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte("leader")
+	if err := db.PutIfAbsent(key, []byte("node-1")); err != nil {
+		t.Fatal(err)
+	}
+	var conflict *ConflictError
+	if err := db.PutIfAbsent(key, []byte("node-2")); !errors.As(err, &conflict) || string(conflict.Current) != "node-1" {
+		t.Fatalf("key已存在时需要返回冲突错误: %v", err)
+	}
+
+	if err := db.CompareAndSwap(key, []byte("node-2"), []byte("node-3")); !errors.As(err, &conflict) {
+		t.Fatalf("value不一致时需要返回冲突错误: %v", err)
+	}
+	if err := db.CompareAndSwap(key, []byte("node-1"), []byte("node-2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DeleteIfEquals(key, []byte("node-1")); !errors.As(err, &conflict) {
+		t.Fatalf("value不一致时不能删除: %v", err)
+	}
+	if err := db.DeleteIfEquals(key, []byte("node-2")); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := db.Has(key); has {
+		t.Fatal("key未删除")
+	}
+	if err := db.DeleteIfEquals(key, []byte("node-2")); !errors.As(err, &conflict) || conflict.Current != nil || conflict.Exists {
+		t.Fatalf("key不存在时需要返回冲突错误: %v", err)
+	}
+	if err := db.DeleteIfEquals([]byte(internalKeyPrefix+"key"), []byte("v")); err == nil || errors.As(err, &conflict) {
+		t.Fatalf("内部key不能删除: %v", err)
+	}
+
+	// 旧版本写入的记录没有序列号 冲突时仍然是存在的key
+	legacy := []byte("legacy")
+	if err := db.Put(legacy, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	pos := *db.index.Get(legacy)
+	pos.Seq = 0
+	db.index.Put(legacy, &pos)
+	if err := db.PutIfAbsent(legacy, []byte("v")); !errors.As(err, &conflict) || !conflict.Exists || strings.Contains(err.Error(), "不存在") {
+		t.Fatalf("旧版本写入的key已存在: %v", err)
+	}
+	if err := db.CompareAndSwapVersion(legacy, 0, []byte("v")); !errors.As(err, &conflict) || !conflict.Exists {
+		t.Fatalf("旧版本写入的key已存在: %v", err)
+	}
+}
+
+func TestDb_Version(t *testing.T) {
+	dirPath := t.TempDir()
+	opt := Options{DirPath: dirPath, FileDataSize: 256}
+	db, err := Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastSeq uint64
+	for i := 0; i < 20; i++ {
+		if err := db.Put([]byte("key"), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+		record, err := db.Get([]byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Seq <= lastSeq {
+			t.Fatalf("序列号需要单调递增: %d %d", lastSeq, record.Seq)
+		}
+		lastSeq = record.Seq
+	}
+
+	var conflict *ConflictError
+	if err := db.CompareAndSwapVersion([]byte("key"), lastSeq-1, []byte("stale")); !errors.As(err, &conflict) || conflict.Version != lastSeq {
+		t.Fatalf("旧版本号需要返回冲突错误: %v", err)
+	}
+	if err := db.CompareAndSwapVersion([]byte("key"), lastSeq, []byte("fresh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwapVersion([]byte("other"), 0, []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _ := db.Get([]byte("key"))
+	version := record.Seq
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 合并以及重启后版本号保持不变 新的写入继续递增
+	db, err = Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	record, err = db.Get([]byte("key"))
+	if err != nil || record.Seq != version {
+		t.Fatalf("重启后版本号错误: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := db.Get([]byte("key")); record.Seq <= version {
+		t.Fatal("重启后序列号需要继续递增")
+	}
+}
+
+func TestDb_SecondaryIndex(t *testing.T) {
+	dirPath := t.TempDir()
+	// value格式为 email,city
+	field := func(i int) IndexExtractor {
+		return func(value []byte) [][]byte {
+			fields := strings.Split(string(value), ",")
+			if len(fields) <= i {
+				return nil
+			}
+			return [][]byte{[]byte(fields[i])}
+		}
+	}
+
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 注册前写入的数据在第一次注册时建立索引
+	if err := db.Put([]byte("user:1"), []byte("a@x.com,beijing")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RegisterIndex("email", field(0)); err != nil {
+		t.Fatal(err)
+	}
+	// 注册索引后的写入与普通写入一样不刷盘
+	syncCount := db.Metrics().SyncLatency.Count
+	if err := db.Put([]byte("user:2"), []byte("b@x.com,shanghai")); err != nil {
+		t.Fatal(err)
+	}
+	if db.Metrics().SyncLatency.Count != syncCount {
+		t.Fatal("注册索引后的写入不需要刷盘")
+	}
+	batch := NewBatchWrite(db)
+	_ = batch.Put([]byte("user:3"), []byte("c@x.com,beijing"))
+	_ = batch.Put([]byte("user:1"), []byte("a2@x.com,beijing"))
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("user:2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 1024, Indexes: map[string]IndexExtractor{
+		"email": field(0),
+		"city":  field(1),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	check := func(name string, value string, expected ...string) {
+		keys, err := db.Index(name).Get([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := make([]string, 0, len(keys))
+		for _, key := range keys {
+			actual = append(actual, string(key))
+		}
+		if strings.Join(actual, ",") != strings.Join(expected, ",") {
+			t.Fatalf("索引%s查询%s结果错误: %v", name, value, actual)
+		}
+	}
+	check("email", "a@x.com")
+	check("email", "a2@x.com", "user:1")
+	check("email", "b@x.com")
+	check("city", "beijing", "user:1", "user:3")
+
+	entries, err := db.Index("email").Scan([]byte("a"), []byte("c"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || string(entries[0].Value) != "a2@x.com" {
+		t.Fatalf("索引范围查询错误: %v", entries)
+	}
+
+	// 内部索引key对用户不可见
+	keys, err := db.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || db.Stat().KeyNum != 2 {
+		t.Fatalf("内部key不能出现在遍历结果中: %q", keys)
+	}
+	if err := db.Put([]byte(internalKeyPrefix+"x"), []byte("v")); err == nil {
+		t.Fatal("不允许写入内部前缀的key")
+	}
+}
+
+func TestDb_SecondaryIndexMergeValue(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024, BlobThreshold: 16, MergeOperator: Int64AddOperator{},
+		Indexes: map[string]IndexExtractor{
+			"count": func(value []byte) [][]byte { return [][]byte{value} },
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 注册了二级索引时操作数合并后写入 索引条目与合并后的value一致
+	_ = db.MergeValue([]byte("c"), []byte("1"))
+	_ = db.MergeValue([]byte("c"), []byte("2"))
+	if keys, err := db.Index("count").Get([]byte("3")); err != nil || len(keys) != 1 || string(keys[0]) != "c" {
+		t.Fatalf("合并后的value没有更新索引: %q %v", keys, err)
+	}
+	if keys, _ := db.Index("count").Get([]byte("1")); len(keys) != 0 {
+		t.Fatalf("旧value的索引条目没有删除: %q", keys)
+	}
+
+	// 注册了二级索引时流式value读入内存后写入 索引条目根据完整的value提取
+	value := strings.Repeat("v", 32)
+	if err := db.PutReader([]byte("big"), strings.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.Index("count").Get([]byte(value)); err != nil || len(keys) != 1 || string(keys[0]) != "big" {
+		t.Fatalf("流式写入的value没有更新索引: %q %v", keys, err)
+	}
+	if err := db.PutReader([]byte("huge"), strings.NewReader(value), maxIndexedStreamSize+1); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("超过上限的流式value需要返回ErrValueTooLarge: %v", err)
+	}
+	if _, err := db.Get([]byte("huge")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("写入失败的value不能被读取: %v", err)
+	}
+}
+
+func TestDb_DataStructure(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte("hash")
+	if created, err := db.HSet(key, []byte("f1"), []byte("v1")); err != nil || !created {
+		t.Fatalf("HSet失败: %v", err)
+	}
+	if created, _ := db.HSet(key, []byte("f1"), []byte("v2")); created {
+		t.Fatal("已存在的field不是新增")
+	}
+	_, _ = db.HSet(key, []byte("f2"), []byte("v3"))
+	if value, err := db.HGet(key, []byte("f1")); err != nil || string(value) != "v2" {
+		t.Fatalf("HGet错误: %v", err)
+	}
+	if deleted, _ := db.HDel(key, []byte("f2")); !deleted {
+		t.Fatal("HDel失败")
+	}
+	if all, _ := db.HGetAll(key); len(all) != 1 || string(all["f1"]) != "v2" {
+		t.Fatalf("HGetAll错误: %v", all)
+	}
+	if _, err := db.SAdd(key, []byte("m")); err == nil {
+		t.Fatal("类型不匹配时需要返回错误")
+	}
+
+	list := []byte("list")
+	if size, err := db.LPush(list, []byte("a"), []byte("b"), []byte("c")); err != nil || size != 3 {
+		t.Fatalf("LPush错误: %v", err)
+	}
+	if values, _ := db.LRange(list, 0, -1); len(values) != 3 || string(values[0]) != "c" || string(values[2]) != "a" {
+		t.Fatalf("LRange错误: %q", values)
+	}
+	if value, _ := db.RPop(list); string(value) != "a" {
+		t.Fatalf("RPop错误: %s", value)
+	}
+	if values, _ := db.LRange(list, -1, 5); len(values) != 1 || string(values[0]) != "b" {
+		t.Fatalf("LRange负数下标错误: %q", values)
+	}
+
+	set := []byte("set")
+	if added, _ := db.SAdd(set, []byte("x"), []byte("y"), []byte("x")); added != 2 {
+		t.Fatalf("SAdd新增数量错误: %d", added)
+	}
+	if ok, _ := db.SIsMember(set, []byte("y")); !ok {
+		t.Fatal("SIsMember错误")
+	}
+	if members, _ := db.SMembers(set); len(members) != 2 {
+		t.Fatalf("SMembers错误: %q", members)
+	}
+
+	zset := []byte("zset")
+	for member, score := range map[string]float64{"a": 3, "b": -1.5, "c": 10, "d": 0} {
+		if _, err := db.ZAdd(zset, score, []byte(member)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if created, _ := db.ZAdd(zset, 20, []byte("a")); created {
+		t.Fatal("更新分数不是新增")
+	}
+	if score, _ := db.ZScore(zset, []byte("a")); score != 20 {
+		t.Fatalf("ZScore错误: %v", score)
+	}
+	members, _ := db.ZRange(zset, 0, -1)
+	actual := make([]string, 0, len(members))
+	for _, member := range members {
+		actual = append(actual, string(member))
+	}
+	if strings.Join(actual, ",") != "b,d,c,a" {
+		t.Fatalf("ZRange顺序错误: %v", actual)
+	}
+
+	// 成员保存在内部key中 只有数据结构本身的key可见
+	if keys, _ := db.ListKeys(); len(keys) != 4 {
+		t.Fatalf("内部成员key不能出现在遍历结果中: %q", keys)
+	}
+
+	// 覆盖或者删除数据结构的key时成员一起删除 重新创建时使用新的版本
+	internalKeyNum := db.internalKeyNum
+	if err := db.Put(zset, []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(set); err != nil {
+		t.Fatal(err)
+	}
+	if db.internalKeyNum != internalKeyNum-8-2 {
+		t.Fatalf("旧数据结构的成员没有删除: %d", db.internalKeyNum)
+	}
+	if added, _ := db.SAdd(set, []byte("z")); added != 1 {
+		t.Fatal("重新创建集合失败")
+	}
+	if members, _ := db.SMembers(set); len(members) != 1 || string(members[0]) != "z" {
+		t.Fatalf("重新创建的集合中出现旧成员: %q", members)
+	}
+	if meta, _ := db.findMeta(set, Set); meta.version > db.seq {
+		t.Fatalf("版本号需要取自序列号: %d", meta.version)
+	}
+}
+
+// replaceOperator 合并结果为最后一个操作数
+type replaceOperator struct{}
+
+func (replaceOperator) Merge(key []byte, existingValue []byte, operand []byte) ([]byte, error) {
+	return operand, nil
+}
+
+func TestDb_DataStructureOverwrite(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), BlobThreshold: 16, MergeOperator: replaceOperator{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 流式写入、追加操作数以及批量导入覆盖数据结构的key时成员一起删除
+	keys := [][]byte{[]byte("stream"), []byte("merge"), []byte("bulk")}
+	for _, key := range keys {
+		if _, err := db.HSet(key, []byte("field"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := bytes.Repeat([]byte{'v'}, 64)
+	if err := db.PutReader(keys[0], bytes.NewReader(value), int64(len(value))); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MergeValue(keys[1], []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	loader, err := NewBulkLoader(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Add(keys[2], []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if db.hasMembers(key) {
+			t.Fatalf("%s 覆盖后成员没有删除", key)
+		}
+	}
+	if db.internalKeyNum != 0 {
+		t.Fatalf("成员没有全部删除: %d", db.internalKeyNum)
+	}
+	if record, err := db.Get(keys[0]); err != nil || !bytes.Equal(record.Value, value) {
+		t.Fatalf("流式写入的value错误: %v", err)
+	}
+	if record, err := db.Get(keys[1]); err != nil || string(record.Value) != "plain" {
+		t.Fatalf("合并后的value错误: %v", err)
+	}
+}
+
+func TestDb_Metrics(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024, ValueCacheSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i%10)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get([]byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := NewBatchWrite(db)
+	_ = batch.Put([]byte("a"), []byte("b"))
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := db.Metrics()
+	if snapshot.PutLatency.Count != 100 || snapshot.GetLatency.Count != 3 || snapshot.BatchCommitSize.Count != 1 {
+		t.Fatalf("操作次数统计错误: %+v", snapshot)
+	}
+	if snapshot.MergeDuration.Count != 1 || snapshot.MergeReclaimedBytes == 0 {
+		t.Fatalf("合并统计错误: %+v", snapshot)
+	}
+	if snapshot.IndexSize != 11 || snapshot.CacheHits != 2 || len(snapshot.FileBytesWritten) < 2 {
+		t.Fatalf("指标统计错误: %+v", snapshot)
+	}
+
+	recorder := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{"kv_put_duration_seconds_count 100", "kv_index_keys 11", `kv_file_bytes_written_total{file_id="0"}`} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("缺少指标 %q:\n%s", line, body)
+		}
+	}
+}
+
+// recordLogger 记录输出的日志 用于测试
+type recordLogger struct {
+	NopLogger
+	lock     sync.Mutex
+	messages []string
+}
+
+func (logger *recordLogger) Info(msg string, fields ...Field) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	for _, field := range fields {
+		if field.Key == FieldPhase {
+			msg += " " + field.Value.(string)
+		}
+	}
+	logger.messages = append(logger.messages, msg)
+}
+
+func TestDb_Logger(t *testing.T) {
+	logger := &recordLogger{}
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024, Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte("key"), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := strings.Join(logger.messages, ",")
+	if messages != "merge started rewrite,merge files rewritten swap" {
+		t.Fatalf("合并日志错误: %s", messages)
+	}
+}
+
+func TestDb_DefaultOptions(t *testing.T) {
+	// 手动构造的配置只设置目录 其余配置项使用默认值
+	db, err := Open(Options{DirPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	option := db.option
+	if option.FileDataSize != DefaultOptions.FileDataSize || option.LoadConcurrency != DefaultOptions.LoadConcurrency ||
+		option.BloomFalsePositive != DefaultOptions.BloomFalsePositive || option.ValueCachePolicy != DefaultOptions.ValueCachePolicy ||
+		option.BlockSize != DefaultOptions.BlockSize || option.ReadAheadBlocks != DefaultOptions.ReadAheadBlocks ||
+		option.BlobFileSize != DefaultOptions.BlobFileSize || option.MergeCheckInterval != DefaultOptions.MergeCheckInterval {
+		t.Fatalf("零值配置项没有使用默认值: %+v", option)
+	}
+	if option.Logger == nil {
+		t.Fatal("日志输出为空时需要使用NopLogger")
+	}
+}
+
+func TestDb_Errors(t *testing.T) {
+	if _, err := Open(DefaultOptions); err == nil {
+		t.Fatal("没有指定目录需要返回错误")
+	}
+
+	dirPath := t.TempDir()
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put(nil, []byte("v")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("空key需要返回ErrEmptyKey: %v", err)
+	}
+	if _, err := db.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("不存在的key需要返回ErrKeyNotFound: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("已删除的key需要返回ErrKeyNotFound: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("空key需要返回ErrEmptyKey: %v", err)
+	}
+	if err := db.Put([]byte(internalKeyPrefix+"key"), []byte("v")); !errors.Is(err, ErrInternalKey) {
+		t.Fatalf("内部前缀需要返回ErrInternalKey: %v", err)
+	}
+	if _, err := db.HGet([]byte("key"), []byte("field")); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("类型不匹配需要返回ErrWrongType: %v", err)
+	}
+	if _, err := db.RPop([]byte("list")); !errors.Is(err, ErrEmptyList) {
+		t.Fatalf("空列表需要返回ErrEmptyList: %v", err)
+	}
+	if _, err := db.Index("missing").Get([]byte("v")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("未注册的索引需要返回ErrIndexNotFound: %v", err)
+	}
+	if err := db.RegisterIndex("", func(value []byte) [][]byte { return nil }); !errors.Is(err, ErrInvalidIndex) {
+		t.Fatalf("索引名称为空需要返回ErrInvalidIndex: %v", err)
+	}
+	if err := db.MergeValue([]byte("key"), []byte("1")); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("未配置合并操作符需要返回ErrNoMergeOperator: %v", err)
+	}
+	if _, err := db.Incr([]byte("key"), 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("value不是整数需要返回ErrNotInteger: %v", err)
+	}
+	if _, err := db.Scan([]byte("b"), []byte("a"), 0); !errors.Is(err, ErrInvalidRange) {
+		t.Fatalf("遍历范围不合法需要返回ErrInvalidRange: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key")); !errors.Is(err, ErrDbClosed) {
+		t.Fatalf("关闭后读取需要返回ErrDbClosed: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrDbClosed) {
+		t.Fatalf("关闭后写入需要返回ErrDbClosed: %v", err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrDbClosed) {
+		t.Fatalf("重复关闭需要返回ErrDbClosed: %v", err)
+	}
+
+	// 只读模式允许读取 不允许写入以及合并
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := db.Get([]byte("key")); err != nil || string(record.Value) != "value" {
+		t.Fatalf("只读模式读取失败: %v", err)
+	}
+	if err := db.Put([]byte("key"), []byte("other")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("只读模式写入需要返回ErrReadOnly: %v", err)
+	}
+	if err := db.Merge(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("只读模式合并需要返回ErrReadOnly: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只读模式不修改数据目录 遗留的合并目录保持不变 目录不存在或者为空时返回错误
+	if err := os.MkdirAll(filepath.Join(dirPath, "merge"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	listDir := func() string {
+		entries, _ := os.ReadDir(dirPath)
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			info, _ := entry.Info()
+			names = append(names, fmt.Sprintf("%s:%d", entry.Name(), info.Size()))
+		}
+		return strings.Join(names, ",")
+	}
+	before := listDir()
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := listDir(); after != before {
+		t.Fatalf("只读模式修改了数据目录: %s -> %s", before, after)
+	}
+	if err := os.Remove(filepath.Join(dirPath, "merge")); err != nil {
+		t.Fatal(err)
+	}
+	missingPath := filepath.Join(t.TempDir(), "missing") + "/"
+	if _, err := Open(Options{DirPath: missingPath, ReadOnly: true}); err == nil {
+		t.Fatal("只读模式下目录不存在需要返回错误")
+	}
+	if _, err := os.Stat(missingPath); !os.IsNotExist(err) {
+		t.Fatal("只读模式不能创建数据目录")
+	}
+	if _, err := Open(Options{DirPath: t.TempDir() + "/", ReadOnly: true}); err == nil {
+		t.Fatal("只读模式下目录为空需要返回错误")
+	}
+
+	// 破坏最后一条记录的value 重新打开时返回带文件位置信息的ErrCorruptRecord
+	filePath := filepath.Join(dirPath, data.DataFileName(0))
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-1] ^= 0xff
+	if err := os.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024}); !errors.Is(err, ErrCorruptRecord) || !strings.Contains(err.Error(), "数据文件0") {
+		t.Fatalf("损坏的记录需要返回ErrCorruptRecord: %v", err)
+	}
+}
+
+func TestOpen_Options(t *testing.T) {
+	db, err := Open(DefaultOptions, WithDirPath(t.TempDir()), WithIndex("value", func(value []byte) [][]byte {
+		return [][]byte{value}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.option.FileDataSize != DefaultOptions.FileDataSize || db.Index("value") == nil {
+		t.Fatal("配置未生效")
+	}
+	if DefaultOptions.Indexes != nil {
+		t.Fatal("不能修改默认配置")
+	}
+}
+
+func TestDb_ExportImport(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := map[string]string{"empty": "", "binary": "\x00\xff,\n\"", "user:1": "alice"}
+	for key, value := range expected {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 数据结构与成员一起导出 计为一条kv
+	if _, err := db.HSet([]byte("hash"), []byte("field"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LPush([]byte("list"), []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SAdd([]byte("set"), []byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ZAdd([]byte("zset"), 1.5, []byte("m")); err != nil {
+		t.Fatal(err)
+	}
+	exportCount := len(expected) + 4
+
+	for _, format := range []ExportFormat{FormatJSONL, FormatCSV, FormatSorted} {
+		buffer := &strings.Builder{}
+		if count, err := db.Export(buffer, format); err != nil || count != exportCount {
+			t.Fatalf("%s 导出失败: %d %v", format, count, err)
+		}
+
+		target, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024 * 1024})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 导入覆盖已存在的hash时之前的成员被删除
+		if _, err := target.HSet([]byte("hash"), []byte("stale"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := target.Import(strings.NewReader(buffer.String()), format); err != nil || count != exportCount {
+			t.Fatalf("%s 导入失败: %d %v", format, count, err)
+		}
+		for key, value := range expected {
+			record, err := target.Get([]byte(key))
+			if err != nil || string(record.Value) != value {
+				t.Fatalf("%s 导入的数据错误: %s %v", format, key, err)
+			}
+		}
+		if fields, err := target.HGetAll([]byte("hash")); err != nil || len(fields) != 1 || string(fields["field"]) != "value" {
+			t.Fatalf("%s 导入的hash错误: %v %v", format, fields, err)
+		}
+		if values, err := target.LRange([]byte("list"), 0, -1); err != nil || len(values) != 2 || string(values[0]) != "b" {
+			t.Fatalf("%s 导入的列表错误: %q %v", format, values, err)
+		}
+		if members, err := target.SMembers([]byte("set")); err != nil || len(members) != 2 {
+			t.Fatalf("%s 导入的集合错误: %q %v", format, members, err)
+		}
+		if score, err := target.ZScore([]byte("zset"), []byte("m")); err != nil || score != 1.5 {
+			t.Fatalf("%s 导入的有序集合错误: %v %v", format, score, err)
+		}
+		if err := target.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	// 写入writer期间不持有锁 可以继续写入 导出的是开始导出时的数据
+	writer := &hookWriter{hook: func() {
+		if err := db.Put([]byte("during"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if count, err := db.Export(writer, FormatJSONL); err != nil || count != exportCount {
+		t.Fatalf("导出期间写入失败: %d %v", count, err)
+	}
+	if strings.Contains(writer.String(), base64.StdEncoding.EncodeToString([]byte("during"))) {
+		t.Fatal("导出开始后写入的数据不能被导出")
+	}
+
+	// 二进制格式损坏时导入失败 超过一个批次的数据也不会写入
+	content := &bytes.Buffer{}
+	encoder, _ := newExportEncoder(content, FormatSorted)
+	for i := 0; i < importBatchRecords*2; i++ {
+		_ = encoder.encode(&exportRecord{Key: []byte(fmt.Sprintf("key-%05d", i)), Value: []byte("value")})
+	}
+	_ = encoder.close()
+	corrupted := content.Bytes()
+	corrupted[len(corrupted)-1] ^= 0xff
+	target, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if _, err := target.Import(bytes.NewReader(corrupted), FormatSorted); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("损坏的文件需要返回ErrCorruptRecord: %v", err)
+	}
+	if target.Stat().KeyNum != 0 {
+		t.Fatalf("校验失败时不能写入数据: %d", target.Stat().KeyNum)
+	}
+}
+
+// hookWriter 第一次写入时执行hook
+type hookWriter struct {
+	bytes.Buffer
+	hook func()
+}
+
+func (writer *hookWriter) Write(buffer []byte) (int, error) {
+	if writer.hook != nil {
+		writer.hook()
+		writer.hook = nil
+	}
+	return writer.Buffer.Write(buffer)
+}
+
+func TestDb_BulkLoader(t *testing.T) {
+	dirPath := t.TempDir()
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("key-0001"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 在线导入 数据跨多个文件 覆盖已有的key
+	loader, err := NewBulkLoader(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBulkLoader(db); err == nil {
+		t.Fatal("同时只能有一个批量导入")
+	}
+	for i := 0; i < 500; i++ {
+		if err := loader.Add([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loader.Add([]byte("key-0000"), []byte("value")); err == nil {
+		t.Fatal("key未按升序写入需要返回错误")
+	}
+	if err := loader.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("after"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *Db, count int) {
+		for i := 0; i < count; i++ {
+			record, err := db.Get([]byte(fmt.Sprintf("key-%04d", i)))
+			if err != nil || string(record.Value) != fmt.Sprintf("value-%d", i) {
+				t.Fatalf("导入的数据错误: %d %v", i, err)
+			}
+		}
+		if record, err := db.Get([]byte("after")); err != nil || string(record.Value) != "value" {
+			t.Fatalf("挂载后写入的数据错误: %v", err)
+		}
+	}
+	check(db, 500)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 离线导入 下次打开时挂载
+	loader, err = NewOfflineBulkLoader(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 500; i < 600; i++ {
+		if err := loader.Add([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loader.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db, 600)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db, 600)
+}
+
+func TestDb_BulkLoaderConcurrentWrites(t *testing.T) {
+	dirPath := t.TempDir()
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put([]byte("key-1"), []byte("old"))
+	_ = db.Put([]byte("key-2"), []byte("old"))
+
+	// 提交失败时释放在线导入 可以重新创建
+	loader, err := NewBulkLoader(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = loader.Add([]byte("key-0"), []byte("value"))
+	if err := os.RemoveAll(dirPath + BulkPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Commit(); err == nil {
+		t.Fatal("导入目录被删除时提交需要返回错误")
+	}
+
+	// 导入期间写入以及删除的key序列号更大 挂载后保留较新的写入
+	loader, err = NewBulkLoader(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = loader.Add([]byte("key-0"), []byte("bulk"))
+	_ = db.Put([]byte("key-1"), []byte("during"))
+	_ = db.Delete([]byte("key-2"))
+	_ = loader.Add([]byte("key-1"), []byte("bulk"))
+	_ = loader.Add([]byte("key-2"), []byte("bulk"))
+	duringSeq := db.index.Get([]byte("key-1")).Seq
+	if err := loader.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		if record, err := db.Get([]byte("key-0")); err != nil || string(record.Value) != "bulk" {
+			t.Fatalf("导入的数据错误: %v", err)
+		}
+		if record, err := db.Get([]byte("key-1")); err != nil || string(record.Value) != "during" || record.Seq != duringSeq {
+			t.Fatalf("导入期间的写入被覆盖: %v", err)
+		}
+		if _, err := db.Get([]byte("key-2")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("导入期间删除的key被恢复: %v", err)
+		}
+	}
+	check(db)
+	// 合并掉更早的墓碑后重新打开 导入的记录仍然不会生效
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDb_Checkpoint(t *testing.T) {
+	db, err := Open(Options{DirPath: t.TempDir(), FileDataSize: 4096, BlobThreshold: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 300; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Delete([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	blobValue := strings.Repeat("b", 1024)
+	if err := db.Put([]byte("blob"), []byte(blobValue)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	if err := db.Checkpoint(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(dir); err == nil {
+		t.Fatal("检查点目录不为空时需要返回错误")
+	}
+
+	// 创建检查点之后的写入以及合并不影响检查点
+	for i := 100; i < 300; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := Open(Options{DirPath: dir, FileDataSize: 4096, BlobThreshold: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.Close()
+	for i := 0; i < 300; i++ {
+		record, err := checkpoint.Get([]byte(strconv.Itoa(i)))
+		if i < 100 {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("已删除的key需要返回ErrKeyNotFound: %d %v", i, err)
+			}
+			continue
+		}
+		if err != nil || string(record.Value) != strconv.Itoa(i) {
+			t.Fatalf("检查点中的数据错误: %d %v", i, err)
+		}
+	}
+	if record, err := checkpoint.Get([]byte("blob")); err != nil || string(record.Value) != blobValue {
+		t.Fatalf("检查点中的blob数据错误: %v", err)
+	}
+}
+
+// encodingBaselineRecord 按没有序列号的旧版本格式编码记录: crc + 类型 + key长度 + value长度 + key + value
+func encodingBaselineRecord(key string, value string, recordType data.LogRecordType) []byte {
+	buffer := make([]byte, 5+binary.MaxVarintLen32*2)
+	buffer[4] = recordType
+	index := 5
+	index += binary.PutVarint(buffer[index:], int64(len(EncodingTranKey([]byte(key), 0))))
+	index += binary.PutVarint(buffer[index:], int64(len(value)))
+	buffer = append(buffer[:index], EncodingTranKey([]byte(key), 0)...)
+	buffer = append(buffer, value...)
+	binary.LittleEndian.PutUint32(buffer[:4], crc32.ChecksumIEEE(buffer[4:]))
+	return buffer
+}
+
+func TestOpen_BaselineFormat(t *testing.T) {
+	dirPath := t.TempDir()
+	oldFile := append(encodingBaselineRecord("a", "1", data.Normal), encodingBaselineRecord("b", "2", data.Normal)...)
+	oldFile = append(oldFile, encodingBaselineRecord("a", "", data.Deleted)...)
+	files := map[string][]byte{
+		data.DataFileName(0): oldFile,
+		data.DataFileName(1): encodingBaselineRecord("c", "3", data.Normal),
+		// 旧版本的hint文件没有文件头 需要根据数据文件重新生成
+		data.HintFileName(0): []byte("stale"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dirPath, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(db *Db) {
+		if _, err := db.Get([]byte("a")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("已删除的key需要返回ErrKeyNotFound: %v", err)
+		}
+		for key, value := range map[string]string{"b": "2", "c": "3"} {
+			record, err := db.Get([]byte(key))
+			if err != nil || string(record.Value) != value || record.Seq != 0 {
+				t.Fatalf("旧版本记录读取错误: %s %v", key, err)
+			}
+		}
+	}
+
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Put([]byte("d"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+	if record, err := db.Get([]byte("d")); err != nil || string(record.Value) != "4" || record.Seq == 0 {
+		t.Fatalf("新写入的记录需要有序列号: %v", err)
+	}
+}
+
+// closeFailIO 关闭时返回错误的文件读写对象
+type closeFailIO struct {
+	fio.IOManagement
+}
+
+var errCloseFail = errors.New("关闭失败")
+
+func (closeFailIO) Close() error {
+	return errCloseFail
+}
+
+func TestDb_CloseError(t *testing.T) {
+	dirPath := t.TempDir()
+	db, err := Open(Options{DirPath: dirPath, FileDataSize: 64, BlobThreshold: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(strconv.Itoa(i)), []byte(strings.Repeat("v", i*8))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.oldFile) == 0 || len(db.blobFiles) == 0 {
+		t.Fatalf("没有生成旧文件以及blob文件: %+v", db.Stat())
+	}
+
+	// 一个文件关闭失败时其余文件仍然关闭 返回关闭失败的错误
+	failFiles := make([]fio.IOManagement, 0, len(db.oldFile))
+	for _, fileData := range db.oldFile {
+		failFiles = append(failFiles, fileData.FileManage)
+		fileData.FileManage = closeFailIO{fileData.FileManage}
+	}
+	activeFile := db.activeFile.FileManage
+	if err := db.Close(); !errors.Is(err, errCloseFail) {
+		t.Fatalf("关闭失败时需要返回错误: %v", err)
+	}
+	if _, err := activeFile.Write([]byte("v")); err == nil {
+		t.Fatal("活动文件没有关闭")
+	}
+	for _, blobFile := range db.blobFiles {
+		if _, err := blobFile.FileManage.Write([]byte("v")); err == nil {
+			t.Fatalf("blob文件%d没有关闭", blobFile.FileId)
+		}
+	}
+	for _, file := range failFiles {
+		_ = file.Close()
+	}
+
+	db, err = Open(Options{DirPath: dirPath, FileDataSize: 64, BlobThreshold: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if record, err := db.Get([]byte("9")); err != nil || string(record.Value) != strings.Repeat("v", 72) {
+		t.Fatalf("重新打开后读取失败: %v", err)
+	}
+}
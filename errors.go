@@ -0,0 +1,39 @@
+package kv
+
+import (
+	"errors"
+	"github.com/RainbowSorcery/kv-project/data"
+)
+
+var (
+	// ErrKeyNotFound key不存在或者已删除
+	ErrKeyNotFound = errors.New("key不存在")
+	// ErrEmptyKey key为空
+	ErrEmptyKey = errors.New("key为空")
+	// ErrCorruptRecord 记录已损坏 crc校验失败或者无法解析
+	ErrCorruptRecord = data.ErrCorruptRecord
+	// ErrMergeInProgress 正在合并中 合并只能同时执行一次
+	ErrMergeInProgress = errors.New("正在合并中")
+	// ErrDbClosed 数据库已关闭
+	ErrDbClosed = errors.New("数据库已关闭")
+	// ErrReadOnly 数据库以只读模式打开 不允许写入
+	ErrReadOnly = errors.New("数据库为只读模式")
+	// ErrValueTooLarge value超过数据文件记录的长度上限
+	ErrValueTooLarge = errors.New("value过大")
+	// ErrInternalKey key使用了内部前缀 内部前缀保留给二级索引以及数据结构成员
+	ErrInternalKey = errors.New("key不能使用内部前缀")
+	// ErrInvalidRange 遍历范围的起点大于终点
+	ErrInvalidRange = errors.New("遍历范围不合法")
+	// ErrWrongType key已经保存了其他类型的数据结构或者普通value
+	ErrWrongType = errors.New("key类型不匹配")
+	// ErrEmptyList 列表中没有元素
+	ErrEmptyList = errors.New("列表为空")
+	// ErrInvalidIndex 二级索引名称或者提取函数不合法
+	ErrInvalidIndex = errors.New("索引配置不合法")
+	// ErrIndexNotFound 二级索引没有注册
+	ErrIndexNotFound = errors.New("索引不存在")
+	// ErrNoMergeOperator 没有配置合并操作符
+	ErrNoMergeOperator = errors.New("未配置合并操作符")
+	// ErrNotInteger value或者操作数不是十进制整数
+	ErrNotInteger = errors.New("不是整数")
+)
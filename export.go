@@ -0,0 +1,685 @@
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/index"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// ExportFormat 导出导入格式
+type ExportFormat string
+
+const (
+	// FormatJSONL 每行一个json对象 key以及value为base64编码
+	FormatJSONL ExportFormat = "jsonl"
+	// FormatCSV 第一行为表头key,value,members 之后每行一个kv key、value以及成员为base64编码
+	FormatCSV ExportFormat = "csv"
+	// FormatSorted 按key升序排列的二进制格式 文件末尾保存记录数以及crc校验和
+	FormatSorted ExportFormat = "sorted"
+
+	// sortedMagic 二进制格式文件头
+	sortedMagic = "KVSORT01"
+	// sortedEntryTag、sortedStructTag、sortedFooterTag 二进制格式中kv记录、数据结构记录以及文件尾的标记
+	sortedEntryTag  = 1
+	sortedStructTag = 2
+	sortedFooterTag = 0
+	// maxImportFieldSize 二进制格式中key或者value的最大长度 避免损坏的长度申请过大内存
+	maxImportFieldSize = 1 << 30
+
+	// importBatchRecords、importBatchBytes 导入时单个批量写入的最大记录数以及字节数
+	importBatchRecords = 4096
+	importBatchBytes   = 4 * 1024 * 1024
+)
+
+// exportRecord 导出的一条kv 数据结构的value为元数据 成员与元数据作为一个整体导出导入
+type exportRecord struct {
+	Key     []byte          `json:"key"`
+	Value   []byte          `json:"value"`
+	Members []*exportMember `json:"members,omitempty"`
+}
+
+// exportMember 数据结构的一个成员 key为成员key去掉前缀以及版本号之后的部分
+type exportMember struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Export 按key升序将开始导出时的所有kv以指定格式写入writer 返回导出的kv数量
+// 导出前复制内存索引并打开独立的文件句柄 写入writer期间不持有锁 不会阻塞其他读写
+// 哈希、列表、集合以及有序集合与所有成员一起导出 计为一条kv
+func (db *Db) Export(writer io.Writer, format ExportFormat) (int, error) {
+	buffer := bufio.NewWriter(writer)
+	encoder, err := newExportEncoder(buffer, format)
+	if err != nil {
+		return 0, err
+	}
+
+	snapshot, err := db.exportSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.close()
+
+	iterate := newUserKeyIterator(snapshot.index, index.IteratorOption{})
+	defer iterate.Close()
+
+	count := 0
+	for ; iterate.HasNext(); iterate.Next() {
+		key, err := iterate.Key()
+		if err != nil {
+			return count, err
+		}
+		pos, err := iterate.Value()
+		if err != nil {
+			return count, err
+		}
+		value, err := snapshot.read(key, pos)
+		if err != nil {
+			return count, err
+		}
+		members, err := snapshot.members(key, value)
+		if err != nil {
+			return count, err
+		}
+		if err := encoder.encode(&exportRecord{Key: key, Value: value, Members: members}); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if err := encoder.close(); err != nil {
+		return count, err
+	}
+	return count, buffer.Flush()
+}
+
+// Import 读取指定格式的kv并分批写入 每批在一个事务中提交 返回导入的kv数量
+// 数据结构的元数据与成员在同一个事务中写入 覆盖已存在的key时之前的成员被删除
+// 二进制格式先完整读取到临时文件并校验文件尾 校验失败时不会写入任何数据
+// 其余格式没有校验和 导入失败时之前已提交的批次不会回滚
+func (db *Db) Import(reader io.Reader, format ExportFormat) (int, error) {
+	if format == FormatSorted {
+		spoolFile, err := spoolSortedImport(reader)
+		if err != nil {
+			return 0, err
+		}
+		defer func() {
+			_ = spoolFile.Close()
+			_ = os.Remove(spoolFile.Name())
+		}()
+		reader = spoolFile
+	}
+
+	decoder, err := newImportDecoder(bufio.NewReader(reader), format)
+	if err != nil {
+		return 0, err
+	}
+
+	count, pending := 0, 0
+	batch, batchBytes := NewBatchWrite(db), 0
+	for {
+		record, err := decoder.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := batch.Put(record.Key, record.Value); err != nil {
+			return count, err
+		}
+		if err := putImportMembers(batch, record); err != nil {
+			return count, err
+		}
+		pending++
+
+		batchBytes += len(record.Key) + len(record.Value)
+		for _, member := range record.Members {
+			batchBytes += len(member.Key) + len(member.Value)
+		}
+		if len(batch.PendingWrites) >= importBatchRecords || batchBytes >= importBatchBytes {
+			if err := batch.Commit(); err != nil {
+				return count, err
+			}
+			count += pending
+			batch, batchBytes, pending = NewBatchWrite(db), 0, 0
+		}
+	}
+
+	if pending > 0 {
+		if err := batch.Commit(); err != nil {
+			return count, err
+		}
+		count += pending
+	}
+	return count, nil
+}
+
+// putImportMembers 将数据结构的成员加入批量写入 成员key使用元数据中的版本号
+func putImportMembers(batch *BatchWrite, record *exportRecord) error {
+	if len(record.Members) == 0 {
+		return nil
+	}
+	meta, err := decodingMeta(record.Value)
+	if err != nil {
+		return fmt.Errorf("key %q的元数据不合法: %w", record.Key, ErrCorruptRecord)
+	}
+	prefix := meta.memberPrefix(record.Key)
+	for _, member := range record.Members {
+		memberKey := append(append([]byte{}, prefix...), member.Key...)
+		batch.PendingWrites[string(memberKey)] = &data.LogRecord{Key: memberKey, Value: member.Value, Type: data.Normal}
+	}
+	return nil
+}
+
+// spoolSortedImport 将二进制格式的内容写入临时文件 同时校验所有记录以及文件尾 返回定位到开头的临时文件
+func spoolSortedImport(reader io.Reader) (*os.File, error) {
+	spoolFile, err := os.CreateTemp("", "kv-import-*")
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		_ = spoolFile.Close()
+		_ = os.Remove(spoolFile.Name())
+		return nil, err
+	}
+
+	spoolWriter := bufio.NewWriter(spoolFile)
+	decoder, err := newImportDecoder(bufio.NewReader(io.TeeReader(reader, spoolWriter)), FormatSorted)
+	if err != nil {
+		return fail(err)
+	}
+	for {
+		_, err := decoder.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := spoolWriter.Flush(); err != nil {
+		return fail(err)
+	}
+	if _, err := spoolFile.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return spoolFile, nil
+}
+
+// exportSnapshot 导出时的快照 持有复制的内存索引以及独立的文件句柄
+// 导出期间文件被合并替换或者回收删除 已打开的句柄仍然指向原文件
+type exportSnapshot struct {
+	index         index.Indexer
+	dataFiles     map[uint32]*data.FileData
+	blobFiles     map[uint32]*data.BlobFile
+	operandChains map[string]*operandChain
+	mergeOperator MergeOperator
+}
+
+// exportSnapshot 持有锁复制内存索引、操作数并打开所有数据文件以及blob文件
+func (db *Db) exportSnapshot() (*exportSnapshot, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.closed {
+		return nil, ErrDbClosed
+	}
+
+	snapshot := &exportSnapshot{
+		index:         db.index.Clone(),
+		dataFiles:     make(map[uint32]*data.FileData, len(db.oldFile)+1),
+		blobFiles:     make(map[uint32]*data.BlobFile, len(db.blobFiles)),
+		operandChains: make(map[string]*operandChain, len(db.operandChains)),
+		mergeOperator: db.option.MergeOperator,
+	}
+	fileIds := []uint32{db.activeFile.FileId}
+	for fileId := range db.oldFile {
+		fileIds = append(fileIds, fileId)
+	}
+	for _, fileId := range fileIds {
+		fileData, err := data.OpenFileDataReadOnly(db.option.DirPath, fileId, nil)
+		if err != nil {
+			snapshot.close()
+			return nil, err
+		}
+		snapshot.dataFiles[fileId] = fileData
+	}
+	for fileId := range db.blobFiles {
+		blobFile, err := data.OpenBlobFileReadOnly(db.option.DirPath, fileId)
+		if err != nil {
+			snapshot.close()
+			return nil, err
+		}
+		snapshot.blobFiles[fileId] = blobFile
+	}
+	// 合并文件时会原地修改操作数位置 需要复制
+	for key, chain := range db.operandChains {
+		snapshot.operandChains[key] = &operandChain{
+			base:     chain.base,
+			operands: append([]*data.LogRecordPos{}, chain.operands...),
+		}
+	}
+	return snapshot, nil
+}
+
+// read 读取key在快照中的value 存在操作数时依次合并
+func (snapshot *exportSnapshot) read(key []byte, pos *data.LogRecordPos) ([]byte, error) {
+	chain := snapshot.operandChains[string(key)]
+	if chain == nil {
+		return snapshot.readValue(pos)
+	}
+	if snapshot.mergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+
+	var value []byte
+	if chain.base != nil {
+		var err error
+		if value, err = snapshot.readValue(chain.base); err != nil {
+			return nil, err
+		}
+	}
+	for _, operandPos := range chain.operands {
+		operand, err := snapshot.readValue(operandPos)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = snapshot.mergeOperator.Merge(key, value, operand); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// members 读取数据结构当前版本的所有成员 value不是数据结构的元数据或者没有成员时返回nil
+func (snapshot *exportSnapshot) members(key []byte, value []byte) ([]*exportMember, error) {
+	meta, err := decodingMeta(value)
+	if err != nil || meta.dataType < Hash || meta.dataType > ZSet {
+		return nil, nil
+	}
+
+	prefix := meta.memberPrefix(key)
+	iterate := snapshot.index.Iterate(index.IteratorOption{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	defer iterate.Close()
+
+	var members []*exportMember
+	for ; iterate.HasNext(); iterate.Next() {
+		memberKey, err := iterate.Key()
+		if err != nil {
+			return nil, err
+		}
+		pos, err := iterate.Value()
+		if err != nil {
+			return nil, err
+		}
+		memberValue, err := snapshot.readValue(pos)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &exportMember{Key: memberKey[len(prefix):], Value: memberValue})
+	}
+	return members, nil
+}
+
+// readValue 读取指定位置记录的value BlobIndex记录从blob文件中读取
+func (snapshot *exportSnapshot) readValue(pos *data.LogRecordPos) ([]byte, error) {
+	fileData := snapshot.dataFiles[pos.FileId]
+	if fileData == nil {
+		return nil, fmt.Errorf("数据文件%d不存在", pos.FileId)
+	}
+	record, err := fileData.ReadLogRecord(pos.Pos)
+	if err != nil {
+		return nil, fmt.Errorf("读取数据文件%d偏移%d失败: %w", pos.FileId, pos.Pos, err)
+	}
+	if record == nil {
+		return nil, ErrKeyNotFound
+	}
+	if record.Type != data.BlobIndex {
+		return record.Value, nil
+	}
+
+	blobPos, err := data.DecodingBlobPos(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	blobFile := snapshot.blobFiles[blobPos.FileId]
+	if blobFile == nil {
+		return nil, fmt.Errorf("blob文件%d不存在", blobPos.FileId)
+	}
+	_, value, err := blobFile.Read(blobPos)
+	return value, err
+}
+
+func (snapshot *exportSnapshot) close() {
+	for _, fileData := range snapshot.dataFiles {
+		_ = fileData.FileManage.Close()
+	}
+	for _, blobFile := range snapshot.blobFiles {
+		_ = blobFile.FileManage.Close()
+	}
+}
+
+// exportEncoder 按格式输出kv
+type exportEncoder interface {
+	encode(record *exportRecord) error
+	close() error
+}
+
+// importDecoder 按格式读取kv 读取完毕时返回io.EOF
+type importDecoder interface {
+	decode() (*exportRecord, error)
+}
+
+func newExportEncoder(writer io.Writer, format ExportFormat) (exportEncoder, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlEncoder{encoder: json.NewEncoder(writer)}, nil
+	case FormatCSV:
+		csvWriter := csv.NewWriter(writer)
+		if err := csvWriter.Write([]string{"key", "value", "members"}); err != nil {
+			return nil, err
+		}
+		return &csvEncoder{writer: csvWriter}, nil
+	case FormatSorted:
+		if _, err := io.WriteString(writer, sortedMagic); err != nil {
+			return nil, err
+		}
+		return &sortedEncoder{writer: writer}, nil
+	}
+	return nil, fmt.Errorf("不支持的格式: %s", format)
+}
+
+func newImportDecoder(reader *bufio.Reader, format ExportFormat) (importDecoder, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlDecoder{decoder: json.NewDecoder(reader)}, nil
+	case FormatCSV:
+		// 字段数由表头决定 兼容没有members列的文件
+		csvReader := csv.NewReader(reader)
+		header, err := csvReader.Read()
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < 2 || len(header) > 3 || header[0] != "key" || header[1] != "value" || (len(header) == 3 && header[2] != "members") {
+			return nil, errors.New("csv表头必须为key,value或者key,value,members")
+		}
+		return &csvDecoder{reader: csvReader}, nil
+	case FormatSorted:
+		magic := make([]byte, len(sortedMagic))
+		if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != sortedMagic {
+			return nil, fmt.Errorf("文件头不合法: %w", ErrCorruptRecord)
+		}
+		return &sortedDecoder{reader: reader}, nil
+	}
+	return nil, fmt.Errorf("不支持的格式: %s", format)
+}
+
+type jsonlEncoder struct {
+	encoder *json.Encoder
+}
+
+func (encoder *jsonlEncoder) encode(record *exportRecord) error {
+	return encoder.encoder.Encode(record)
+}
+
+func (encoder *jsonlEncoder) close() error {
+	return nil
+}
+
+type jsonlDecoder struct {
+	decoder *json.Decoder
+	line    int
+}
+
+func (decoder *jsonlDecoder) decode() (*exportRecord, error) {
+	record := &exportRecord{}
+	decoder.line++
+	if err := decoder.decoder.Decode(record); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("第%d行解析失败: %w", decoder.line, err)
+	}
+	// 空value导出为""或者null 导入后统一为空数组
+	if record.Value == nil {
+		record.Value = []byte{}
+	}
+	for _, member := range record.Members {
+		if member == nil {
+			return nil, fmt.Errorf("第%d行成员为空: %w", decoder.line, ErrCorruptRecord)
+		}
+		if member.Value == nil {
+			member.Value = []byte{}
+		}
+	}
+	return record, nil
+}
+
+type csvEncoder struct {
+	writer *csv.Writer
+}
+
+func (encoder *csvEncoder) encode(record *exportRecord) error {
+	members := ""
+	if len(record.Members) > 0 {
+		members = base64.StdEncoding.EncodeToString(encodingExportMembers(record.Members))
+	}
+	return encoder.writer.Write([]string{
+		base64.StdEncoding.EncodeToString(record.Key),
+		base64.StdEncoding.EncodeToString(record.Value),
+		members,
+	})
+}
+
+func (encoder *csvEncoder) close() error {
+	encoder.writer.Flush()
+	return encoder.writer.Error()
+}
+
+type csvDecoder struct {
+	reader *csv.Reader
+}
+
+func (decoder *csvDecoder) decode() (*exportRecord, error) {
+	fields, err := decoder.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	line, _ := decoder.reader.FieldPos(0)
+	record := &exportRecord{}
+	if record.Key, err = base64.StdEncoding.DecodeString(fields[0]); err != nil {
+		return nil, fmt.Errorf("第%d行key解析失败: %w", line, err)
+	}
+	if record.Value, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+		return nil, fmt.Errorf("第%d行value解析失败: %w", line, err)
+	}
+	if len(fields) == 3 && fields[2] != "" {
+		members, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("第%d行成员解析失败: %w", line, err)
+		}
+		if record.Members, err = decodingExportMembers(members); err != nil {
+			return nil, fmt.Errorf("第%d行成员解析失败: %w", line, err)
+		}
+	}
+	return record, nil
+}
+
+// encodingExportMembers 序列化数据结构成员 每个成员为: key长度 + key + value长度 + value
+func encodingExportMembers(members []*exportMember) []byte {
+	buffer := make([]byte, 0)
+	for _, member := range members {
+		buffer = binary.AppendUvarint(buffer, uint64(len(member.Key)))
+		buffer = append(buffer, member.Key...)
+		buffer = binary.AppendUvarint(buffer, uint64(len(member.Value)))
+		buffer = append(buffer, member.Value...)
+	}
+	return buffer
+}
+
+func decodingExportMembers(buffer []byte) ([]*exportMember, error) {
+	members := make([]*exportMember, 0)
+	// readField 读取一个带长度的字段
+	readField := func() ([]byte, bool) {
+		size, index := binary.Uvarint(buffer)
+		if index <= 0 || uint64(len(buffer)-index) < size {
+			return nil, false
+		}
+		field := buffer[index : index+int(size)]
+		buffer = buffer[index+int(size):]
+		return field, true
+	}
+	for len(buffer) > 0 {
+		key, ok := readField()
+		if !ok {
+			return nil, fmt.Errorf("成员key不完整: %w", ErrCorruptRecord)
+		}
+		value, ok := readField()
+		if !ok {
+			return nil, fmt.Errorf("成员value不完整: %w", ErrCorruptRecord)
+		}
+		members = append(members, &exportMember{Key: key, Value: value})
+	}
+	return members, nil
+}
+
+// sortedEncoder 二进制格式 文件头之后每条记录为: 标记 + key长度 + value长度 + key + value
+// 数据结构记录为: 标记 + key长度 + value长度 + 成员长度 + key + value + 成员
+// 文件尾为: 标记 + 记录数 + 所有记录的crc校验和
+type sortedEncoder struct {
+	writer io.Writer
+	count  uint64
+	crc    uint32
+}
+
+func (encoder *sortedEncoder) encode(record *exportRecord) error {
+	var members []byte
+	if len(record.Members) > 0 {
+		members = encodingExportMembers(record.Members)
+	}
+	header := encodingSortedEntryHeader(record.Key, record.Value, members)
+	encoder.count++
+
+	for _, buffer := range [][]byte{header, record.Key, record.Value, members} {
+		encoder.crc = crc32.Update(encoder.crc, crc32.IEEETable, buffer)
+		if _, err := encoder.writer.Write(buffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (encoder *sortedEncoder) close() error {
+	footer := make([]byte, 1+binary.MaxVarintLen64+crc32.Size)
+	footer[0] = sortedFooterTag
+	index := 1
+	index += binary.PutUvarint(footer[index:], encoder.count)
+	binary.LittleEndian.PutUint32(footer[index:], encoder.crc)
+	_, err := encoder.writer.Write(footer[:index+crc32.Size])
+	return err
+}
+
+// encodingSortedEntryHeader 记录头 存在成员时为数据结构记录
+func encodingSortedEntryHeader(key []byte, value []byte, members []byte) []byte {
+	header := make([]byte, 1+binary.MaxVarintLen64*3)
+	header[0] = sortedEntryTag
+	index := 1
+	index += binary.PutUvarint(header[index:], uint64(len(key)))
+	index += binary.PutUvarint(header[index:], uint64(len(value)))
+	if len(members) > 0 {
+		header[0] = sortedStructTag
+		index += binary.PutUvarint(header[index:], uint64(len(members)))
+	}
+	return header[:index]
+}
+
+type sortedDecoder struct {
+	reader  *bufio.Reader
+	count   uint64
+	crc     uint32
+	lastKey []byte
+}
+
+func (decoder *sortedDecoder) decode() (*exportRecord, error) {
+	tag, err := decoder.reader.ReadByte()
+	if err == io.EOF {
+		return nil, fmt.Errorf("缺少文件尾: %w", ErrCorruptRecord)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tag == sortedFooterTag {
+		return nil, decoder.readFooter()
+	}
+	if tag != sortedEntryTag && tag != sortedStructTag {
+		return nil, decoder.corrupt("记录标记不合法")
+	}
+
+	keySize, err := binary.ReadUvarint(decoder.reader)
+	if err != nil || keySize > maxImportFieldSize {
+		return nil, decoder.corrupt("key长度不合法")
+	}
+	valueSize, err := binary.ReadUvarint(decoder.reader)
+	if err != nil || valueSize > maxImportFieldSize {
+		return nil, decoder.corrupt("value长度不合法")
+	}
+	var membersSize uint64
+	if tag == sortedStructTag {
+		membersSize, err = binary.ReadUvarint(decoder.reader)
+		if err != nil || membersSize == 0 || membersSize > maxImportFieldSize {
+			return nil, decoder.corrupt("成员长度不合法")
+		}
+	}
+	buffer := make([]byte, keySize+valueSize+membersSize)
+	if _, err := io.ReadFull(decoder.reader, buffer); err != nil {
+		return nil, decoder.corrupt("记录不完整")
+	}
+	record := &exportRecord{Key: buffer[:keySize], Value: buffer[keySize : keySize+valueSize]}
+	members := buffer[keySize+valueSize:]
+	if tag == sortedStructTag {
+		if record.Members, err = decodingExportMembers(members); err != nil {
+			return nil, decoder.corrupt("成员不完整")
+		}
+	}
+
+	if decoder.lastKey != nil && bytes.Compare(record.Key, decoder.lastKey) <= 0 {
+		return nil, decoder.corrupt("key未按升序排列")
+	}
+	decoder.lastKey = record.Key
+	decoder.crc = crc32.Update(decoder.crc, crc32.IEEETable, encodingSortedEntryHeader(record.Key, record.Value, members))
+	decoder.crc = crc32.Update(decoder.crc, crc32.IEEETable, buffer)
+	decoder.count++
+	return record, nil
+}
+
+// readFooter 校验文件尾中的记录数以及crc校验和 校验通过时返回io.EOF
+func (decoder *sortedDecoder) readFooter() error {
+	count, err := binary.ReadUvarint(decoder.reader)
+	if err != nil || count != decoder.count {
+		return fmt.Errorf("文件尾记录数与读取的%d条不一致: %w", decoder.count, ErrCorruptRecord)
+	}
+	crc := make([]byte, crc32.Size)
+	if _, err := io.ReadFull(decoder.reader, crc); err != nil || binary.LittleEndian.Uint32(crc) != decoder.crc {
+		return fmt.Errorf("crc校验失败: %w", ErrCorruptRecord)
+	}
+	if _, err := decoder.reader.ReadByte(); err != io.EOF {
+		return fmt.Errorf("文件尾之后存在多余数据: %w", ErrCorruptRecord)
+	}
+	return io.EOF
+}
+
+func (decoder *sortedDecoder) corrupt(reason string) error {
+	return fmt.Errorf("第%d条记录%s: %w", decoder.count+1, reason, ErrCorruptRecord)
+}
@@ -0,0 +1,207 @@
+package fio
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultBlockSize 默认缓存块大小
+	DefaultBlockSize = 32 * 1024
+	// DefaultReadAheadBlocks 顺序读取时默认预读的块数
+	DefaultReadAheadBlocks = 4
+)
+
+// blockKey 缓存块key 每个打开的文件分配一个唯一id 文件被合并替换后旧的缓存块不会被读取
+type blockKey struct {
+	fileId uint64
+	index  int64
+}
+
+type block struct {
+	key  blockKey
+	data []byte
+}
+
+// BlockCache 多个文件共享的块缓存 按固定大小的块缓存文件内容 使用LRU淘汰
+type BlockCache struct {
+	lock            *sync.Mutex
+	blockSize       int64
+	readAheadBlocks int
+	capacity        int64
+	size            int64
+	items           map[blockKey]*list.Element
+	list            *list.List
+	nextFileId      uint64
+}
+
+// NewBlockCache 创建块缓存 capacity为缓存最大字节数
+func NewBlockCache(capacity int64, blockSize int, readAheadBlocks int) *BlockCache {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if readAheadBlocks <= 0 {
+		readAheadBlocks = DefaultReadAheadBlocks
+	}
+
+	return &BlockCache{
+		lock:            new(sync.Mutex),
+		blockSize:       int64(blockSize),
+		readAheadBlocks: readAheadBlocks,
+		capacity:        capacity,
+		items:           make(map[blockKey]*list.Element),
+		list:            list.New(),
+	}
+}
+
+func (cache *BlockCache) get(key blockKey) ([]byte, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	cache.list.MoveToFront(element)
+	return element.Value.(*block).data, true
+}
+
+func (cache *BlockCache) put(key blockKey, data []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if _, ok := cache.items[key]; ok {
+		return
+	}
+	cache.items[key] = cache.list.PushFront(&block{key: key, data: data})
+	cache.size += int64(len(data))
+
+	for cache.size > cache.capacity && cache.list.Len() > 0 {
+		cache.removeElement(cache.list.Back())
+	}
+}
+
+// removeFile 删除文件对应的所有缓存块
+func (cache *BlockCache) removeFile(fileId uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key, element := range cache.items {
+		if key.fileId == fileId {
+			cache.removeElement(element)
+		}
+	}
+}
+
+func (cache *BlockCache) removeElement(element *list.Element) {
+	item := cache.list.Remove(element).(*block)
+	delete(cache.items, item.key)
+	cache.size -= int64(len(item.data))
+}
+
+// BlockCacheIO 带块缓存的文件读写 读取时以块为单位从缓存中读取 顺序读取时一次预读多个块
+// 数据文件只会追加写入 只缓存完整的块 未写满的末尾块每次都从文件中读取
+type BlockCacheIO struct {
+	IOManagement
+	cache  *BlockCache
+	fileId uint64
+	// 上次读取的块 用于判断是否为顺序读取
+	lastBlock int64
+}
+
+// NewBlockCacheIO 为文件读写对象添加块缓存
+func NewBlockCacheIO(file IOManagement, cache *BlockCache) *BlockCacheIO {
+	return &BlockCacheIO{
+		IOManagement: file,
+		cache:        cache,
+		fileId:       atomic.AddUint64(&cache.nextFileId, 1),
+		lastBlock:    -2,
+	}
+}
+
+func (blockIO *BlockCacheIO) Read(offset int64, buffer []byte) (int, error) {
+	blockSize := blockIO.cache.blockSize
+
+	readSize := 0
+	for readSize < len(buffer) {
+		pos := offset + int64(readSize)
+		blockIndex := pos / blockSize
+		data, err := blockIO.readBlock(blockIndex)
+		if err != nil {
+			if err == io.EOF && readSize > 0 {
+				break
+			}
+			return readSize, err
+		}
+
+		blockOffset := pos - blockIndex*blockSize
+		if blockOffset >= int64(len(data)) {
+			if readSize == 0 {
+				return 0, io.EOF
+			}
+			break
+		}
+		readSize += copy(buffer[readSize:], data[blockOffset:])
+
+		// 未写满的块表示已经到达文件末尾
+		if int64(len(data)) < blockSize {
+			break
+		}
+	}
+
+	return readSize, nil
+}
+
+// readBlock 读取指定的块 缓存中不存在时从文件中读取 顺序读取时预读后续的块
+func (blockIO *BlockCacheIO) readBlock(blockIndex int64) ([]byte, error) {
+	key := blockKey{fileId: blockIO.fileId, index: blockIndex}
+	if data, ok := blockIO.cache.get(key); ok {
+		atomic.StoreInt64(&blockIO.lastBlock, blockIndex)
+		return data, nil
+	}
+
+	blockCount := 1
+	lastBlock := atomic.SwapInt64(&blockIO.lastBlock, blockIndex)
+	if blockIndex == lastBlock || blockIndex == lastBlock+1 {
+		blockCount = blockIO.cache.readAheadBlocks
+	}
+
+	blockSize := blockIO.cache.blockSize
+	buffer := make([]byte, int64(blockCount)*blockSize)
+	readSize, err := blockIO.IOManagement.Read(blockIndex*blockSize, buffer)
+	if err != nil {
+		return nil, err
+	}
+	buffer = buffer[:readSize]
+
+	// 只缓存完整的块
+	var first []byte
+	for i := 0; int64(i)*blockSize < int64(len(buffer)); i++ {
+		end := int64(i+1) * blockSize
+		if end > int64(len(buffer)) {
+			end = int64(len(buffer))
+		}
+		data := make([]byte, end-int64(i)*blockSize)
+		copy(data, buffer[int64(i)*blockSize:end])
+		if i == 0 {
+			first = data
+		}
+		if int64(len(data)) == blockSize {
+			blockIO.cache.put(blockKey{fileId: blockIO.fileId, index: blockIndex + int64(i)}, data)
+		}
+	}
+
+	return first, nil
+}
+
+func (blockIO *BlockCacheIO) Close() error {
+	blockIO.cache.removeFile(blockIO.fileId)
+	return blockIO.IOManagement.Close()
+}
+
+func (blockIO *BlockCacheIO) Remove() error {
+	blockIO.cache.removeFile(blockIO.fileId)
+	return blockIO.IOManagement.Remove()
+}
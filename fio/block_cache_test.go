@@ -0,0 +1,53 @@
+package fio
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockCacheIO_Read(t *testing.T) {
+	fileIo, err := NewIOManagement(filepath.Join(t.TempDir(), "block.data"), NewBlockCache(1024, 64, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileIo.Close()
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if _, err := fileIo.Write(content[:500]); err != nil {
+		t.Fatal(err)
+	}
+
+	// 顺序读取所有数据 跨越多个块
+	buffer := make([]byte, 30)
+	for offset := 0; offset < 500; offset += 30 {
+		readSize, err := fileIo.Read(int64(offset), buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buffer[:readSize], content[offset:offset+readSize]) {
+			t.Fatalf("读取数据错误, offset:%d", offset)
+		}
+	}
+
+	// 追加写入后 未写满的末尾块需要读取到新数据
+	if _, err := fileIo.Write(content[500:]); err != nil {
+		t.Fatal(err)
+	}
+	buffer = make([]byte, 200)
+	readSize, err := fileIo.Read(450, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readSize != 200 || !bytes.Equal(buffer, content[450:650]) {
+		t.Fatal("追加写入后读取数据错误")
+	}
+
+	if _, err := fileIo.Read(1000, buffer); err != io.EOF {
+		t.Fatalf("读取到文件末尾需要返回EOF: %v", err)
+	}
+}
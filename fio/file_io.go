@@ -1,6 +1,7 @@
 package fio
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -27,13 +28,34 @@ func CreateFileIo(filePath string) (*FileIO, error) {
 	}, nil
 }
 
-func (fileIO *FileIO) Read(offset int64, buffer []byte) (int, error) {
-	_, err := fileIO.file.Seek(offset, 0)
+// OpenFileIoReadOnly 以只读方式打开已存在的文件
+func OpenFileIoReadOnly(filePath string) (*FileIO, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return fileIO.file.Read(buffer)
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &FileIO{
+		file:     file,
+		fileInfo: fileInfo,
+	}, nil
+}
+
+func (fileIO *FileIO) Read(offset int64, buffer []byte) (int, error) {
+	// 使用ReadAt读取 不修改文件指针 多个协程可以并发读取同一个文件
+	readSize, err := fileIO.file.ReadAt(buffer, offset)
+	// 读取到部分数据时与Read保持一致 不返回EOF
+	if err == io.EOF && readSize > 0 {
+		return readSize, nil
+	}
+
+	return readSize, err
 }
 
 func (fileIO *FileIO) Write(buffer []byte) (int, error) {
@@ -49,7 +71,12 @@ func (fileIO *FileIO) Close() error {
 }
 
 func (fileIO *FileIO) Size() int64 {
-	return fileIO.fileInfo.Size()
+	// 文件会持续追加写入 需要实时获取文件大小
+	fileInfo, err := fileIO.file.Stat()
+	if err != nil {
+		return fileIO.fileInfo.Size()
+	}
+	return fileInfo.Size()
 }
 
 func (fileIO *FileIO) FileName() string {
@@ -27,3 +27,29 @@ type IOManagement interface {
 	// Exits 校验文件是否存在
 	Exits() bool
 }
+
+// NewIOManagement 创建文件读写对象 blockCache不为空时读取经过块缓存
+func NewIOManagement(filePath string, blockCache *BlockCache) (IOManagement, error) {
+	fileIo, err := CreateFileIo(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockCache == nil {
+		return fileIo, nil
+	}
+	return NewBlockCacheIO(fileIo, blockCache), nil
+}
+
+// NewReadOnlyIOManagement 以只读方式打开已存在的文件 blockCache不为空时读取经过块缓存
+func NewReadOnlyIOManagement(filePath string, blockCache *BlockCache) (IOManagement, error) {
+	fileIo, err := OpenFileIoReadOnly(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if blockCache == nil {
+		return fileIo, nil
+	}
+	return NewBlockCacheIO(fileIo, blockCache), nil
+}
@@ -1,5 +1,10 @@
-module kv-database
+module github.com/RainbowSorcery/kv-project
 
-go 1.19
+go 1.20
 
-require github.com/google/btree v1.1.2
+require (
+	github.com/google/btree v1.1.2
+	golang.org/x/term v0.5.0
+)
+
+require golang.org/x/sys v0.5.0 // indirect
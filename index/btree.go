@@ -1,8 +1,8 @@
 package index
 
 import (
+	"github.com/RainbowSorcery/kv-project/data"
 	"github.com/google/btree"
-	"kv-database/data"
 	"sync"
 )
 
@@ -18,21 +18,27 @@ func NewBtree() *Btree {
 	}
 }
 
-func (btree *Btree) Put(key []byte, pos *data.LogRecordPos) bool {
+func (btree *Btree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	btree.lock.Lock()
 	item := &Item{
 		key: key,
 		pos: pos,
 	}
-	btree.tree.ReplaceOrInsert(item)
+	oldItem := btree.tree.ReplaceOrInsert(item)
 	btree.lock.Unlock()
 
-	return true
+	if oldItem == nil {
+		return nil
+	}
+
+	return oldItem.(*Item).pos
 }
 
 func (btree *Btree) Get(key []byte) *data.LogRecordPos {
 	item := &Item{key: key}
+	btree.lock.RLock()
 	getItem := btree.tree.Get(item)
+	btree.lock.RUnlock()
 
 	if getItem == nil {
 		return nil
@@ -41,24 +47,40 @@ func (btree *Btree) Get(key []byte) *data.LogRecordPos {
 	return getItem.(*Item).pos
 }
 
-func (btree *Btree) Delete(key []byte) bool {
+func (btree *Btree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	btree.lock.Lock()
 
 	item := &Item{
 		key: key,
 	}
-	btree.tree.Delete(item)
+	oldItem := btree.tree.Delete(item)
 
 	btree.lock.Unlock()
 
-	return true
+	if oldItem == nil {
+		return nil, false
+	}
+
+	return oldItem.(*Item).pos, true
 }
 
-func (btree *Btree) Iterate(reverse bool) Iterator {
-	btreeIterator := NewBtreeIterator(btree.tree, reverse)
+func (btree *Btree) Iterate(option IteratorOption) Iterator {
+	btreeIterator := NewBtreeIterator(btree, option)
 	return btreeIterator
 }
 
+// Clone 写时复制 复制本身不需要遍历所有key
+func (btree *Btree) Clone() Indexer {
+	btree.lock.Lock()
+	defer btree.lock.Unlock()
+	return &Btree{
+		tree: btree.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (btree *Btree) Size() int {
+	btree.lock.RLock()
+	defer btree.lock.RUnlock()
 	return btree.tree.Len()
 }
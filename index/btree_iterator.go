@@ -1,84 +1,147 @@
 package index
 
 import (
-	"errors"
+	"bytes"
+	"github.com/RainbowSorcery/kv-project/data"
 	"github.com/google/btree"
 	"io"
-	"kv-database/data"
 )
 
+// iteratorBatchSize 每次从btree中取出的key数量 迭代器占用的内存不随数据量增长
+const iteratorBatchSize = 64
+
+// BtreeIterator 按需遍历btree 每次在读锁内取出一批key 遍历完当前批次后从最后一个key继续向后取
 type BtreeIterator struct {
-	// 当前索引
+	// 索引
+	btree *Btree
+	// 遍历配置
+	option IteratorOption
+
+	// 当前批次的key
+	items []*Item
+	// 当前批次中的位置
 	currentIndex int
-	// 遍历顺序
-	reverse bool
-
-	// value列表
-	values []*Item
+	// 是否已经遍历到边界 为true时当前批次之后没有更多key
+	exhausted bool
 }
 
-func NewBtreeIterator(tree *btree.BTree, reverse bool) *BtreeIterator {
-	values := make([]*Item, tree.Len())
-
-	valueIndex := 0
-
-	saveValues := func(item btree.Item) bool {
-		values[valueIndex] = item.(*Item)
-		valueIndex++
-
-		return true
-	}
-
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
-	}
-
-	newIterator := &BtreeIterator{
-		currentIndex: 0,
-		reverse:      reverse,
-		values:       values,
+func NewBtreeIterator(btree *Btree, option IteratorOption) *BtreeIterator {
+	btreeIterator := &BtreeIterator{
+		btree:  btree,
+		option: option,
+		items:  make([]*Item, 0, iteratorBatchSize),
 	}
+	btreeIterator.Rewind()
 
-	return newIterator
+	return btreeIterator
 }
 
+// Rewind 回到迭代器起点 顺序遍历从下界开始 逆序遍历从上界开始
 func (btreeIterator *BtreeIterator) Rewind() {
-	btreeIterator.currentIndex = 0
+	if btreeIterator.option.Reverse {
+		btreeIterator.fill(btreeIterator.option.UpperBound, false)
+	} else {
+		btreeIterator.fill(btreeIterator.option.LowerBound, true)
+	}
 }
 
+// Seek 顺序遍历时定位到第一个大于等于key的位置 逆序遍历时定位到第一个小于等于key的位置
 func (btreeIterator *BtreeIterator) Seek(key []byte) bool {
-	//TODO 先不实现 不知道方法是在什么地方用到，用到的时候再实现
-	panic("implement me")
+	option := btreeIterator.option
+	if option.Reverse {
+		if option.UpperBound != nil && bytes.Compare(key, option.UpperBound) >= 0 {
+			btreeIterator.fill(option.UpperBound, false)
+		} else {
+			btreeIterator.fill(key, true)
+		}
+	} else {
+		if option.LowerBound != nil && bytes.Compare(key, option.LowerBound) < 0 {
+			key = option.LowerBound
+		}
+		btreeIterator.fill(key, true)
+	}
+
+	return btreeIterator.HasNext()
 }
 
 func (btreeIterator *BtreeIterator) Next() {
 	btreeIterator.currentIndex++
+	if btreeIterator.currentIndex < len(btreeIterator.items) || btreeIterator.exhausted {
+		return
+	}
+
+	// 当前批次遍历完毕 从最后一个key之后继续获取
+	lastKey := btreeIterator.items[len(btreeIterator.items)-1].key
+	btreeIterator.fill(lastKey, false)
 }
 
+// HasNext 判断当前位置是否还有key
 func (btreeIterator *BtreeIterator) HasNext() bool {
-	return len(btreeIterator.values) <= btreeIterator.currentIndex+1
+	return btreeIterator.currentIndex < len(btreeIterator.items)
 }
 
 func (btreeIterator *BtreeIterator) Key() ([]byte, error) {
-	if len(btreeIterator.values) < btreeIterator.currentIndex {
+	if !btreeIterator.HasNext() {
 		return nil, io.EOF
-	} else {
-		item := btreeIterator.values[btreeIterator.currentIndex]
-		if item == nil {
-			return nil, errors.New("key不存在")
-		}
-		return item.key, nil
 	}
+	return btreeIterator.items[btreeIterator.currentIndex].key, nil
 }
 
 func (btreeIterator *BtreeIterator) Value() (*data.LogRecordPos, error) {
-	item := btreeIterator.values[btreeIterator.currentIndex]
-	return item.pos, nil
+	if !btreeIterator.HasNext() {
+		return nil, io.EOF
+	}
+	return btreeIterator.items[btreeIterator.currentIndex].pos, nil
 }
 
 func (btreeIterator *BtreeIterator) Close() error {
-	btreeIterator.values = nil
+	btreeIterator.items = nil
+	btreeIterator.currentIndex = 0
+	btreeIterator.exhausted = true
 	return nil
 }
+
+// fill 从pivot开始按遍历方向取出一批key pivot为空表示从头开始 inclusive表示是否包含pivot本身
+func (btreeIterator *BtreeIterator) fill(pivot []byte, inclusive bool) {
+	option := btreeIterator.option
+	items := btreeIterator.items[:0]
+
+	collect := func(item btree.Item) bool {
+		current := item.(*Item)
+		if !inclusive && bytes.Equal(current.key, pivot) {
+			return true
+		}
+		// 超出边界后停止遍历
+		if option.Reverse {
+			if option.LowerBound != nil && bytes.Compare(current.key, option.LowerBound) < 0 {
+				return false
+			}
+		} else {
+			if option.UpperBound != nil && bytes.Compare(current.key, option.UpperBound) >= 0 {
+				return false
+			}
+		}
+		items = append(items, current)
+		return len(items) < iteratorBatchSize
+	}
+
+	btreeIterator.btree.lock.RLock()
+	if option.Reverse {
+		if pivot == nil {
+			btreeIterator.btree.tree.Descend(collect)
+		} else {
+			btreeIterator.btree.tree.DescendLessOrEqual(&Item{key: pivot}, collect)
+		}
+	} else {
+		if pivot == nil {
+			btreeIterator.btree.tree.Ascend(collect)
+		} else {
+			btreeIterator.btree.tree.AscendGreaterOrEqual(&Item{key: pivot}, collect)
+		}
+	}
+	btreeIterator.btree.lock.RUnlock()
+
+	btreeIterator.items = items
+	btreeIterator.currentIndex = 0
+	btreeIterator.exhausted = len(items) < iteratorBatchSize
+}
@@ -2,6 +2,7 @@ package index
 
 import (
 	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
 	"os"
 	"testing"
 )
@@ -30,3 +31,54 @@ func TestBtree_Put(t *testing.T) {
 	fmt.Println(writeString)
 	file.Sync()
 }
+
+func TestBtreeIterator(t *testing.T) {
+	bt := NewBtree()
+	for i := 0; i < 200; i++ {
+		bt.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{FileId: 1, Pos: int64(i)})
+	}
+
+	collect := func(iterator Iterator) []string {
+		keys := make([]string, 0)
+		for ; iterator.HasNext(); iterator.Next() {
+			key, err := iterator.Key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, string(key))
+		}
+		return keys
+	}
+
+	if keys := collect(bt.Iterate(IteratorOption{})); len(keys) != 200 || keys[0] != "key-000" || keys[199] != "key-199" {
+		t.Fatalf("顺序遍历错误: %d", len(keys))
+	}
+	if keys := collect(bt.Iterate(IteratorOption{Reverse: true})); len(keys) != 200 || keys[0] != "key-199" {
+		t.Fatalf("逆序遍历错误: %d", len(keys))
+	}
+
+	option := IteratorOption{LowerBound: []byte("key-050"), UpperBound: []byte("key-150")}
+	if keys := collect(bt.Iterate(option)); len(keys) != 100 || keys[0] != "key-050" || keys[99] != "key-149" {
+		t.Fatalf("范围遍历错误: %v", keys)
+	}
+	option.Reverse = true
+	if keys := collect(bt.Iterate(option)); len(keys) != 100 || keys[0] != "key-149" || keys[99] != "key-050" {
+		t.Fatalf("逆序范围遍历错误: %v", keys)
+	}
+
+	iterator := bt.Iterate(IteratorOption{})
+	if !iterator.Seek([]byte("key-100a")) {
+		t.Fatal("seek失败")
+	}
+	if key, _ := iterator.Key(); string(key) != "key-101" {
+		t.Fatalf("seek位置错误: %s", key)
+	}
+	iterator = bt.Iterate(IteratorOption{Reverse: true})
+	iterator.Seek([]byte("key-100a"))
+	if key, _ := iterator.Key(); string(key) != "key-100" {
+		t.Fatalf("逆序seek位置错误: %s", key)
+	}
+	if iterator.Seek([]byte("a")) {
+		t.Fatal("逆序seek越界后不能有key")
+	}
+}
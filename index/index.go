@@ -2,23 +2,26 @@ package index
 
 import (
 	"bytes"
+	"github.com/RainbowSorcery/kv-project/data"
 	"github.com/google/btree"
-	"kv-database/data"
 )
 
 type Indexer interface {
-	// Put 设置索引到内存中
-	Put(key []byte, pos *data.LogRecordPos) bool
+	// Put 设置索引到内存中 返回被覆盖的旧索引 不存在则返回nil
+	Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 	// Get 获取索引信息
 	Get(key []byte) *data.LogRecordPos
-	// Delete 删除索引
-	Delete(key []byte) bool
+	// Delete 删除索引 返回被删除的旧索引以及key是否存在
+	Delete(key []byte) (*data.LogRecordPos, bool)
 
 	// Iterate 获取迭代器
-	Iterate(reverse bool) Iterator
+	Iterate(option IteratorOption) Iterator
 
 	// Size 索引数
 	Size() int
+
+	// Clone 复制索引 复制后两份索引互不影响
+	Clone() Indexer
 }
 
 type Item struct {
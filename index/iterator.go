@@ -1,18 +1,28 @@
 package index
 
-import "kv-database/data"
+import "github.com/RainbowSorcery/kv-project/data"
+
+// IteratorOption 索引迭代器配置 下界包含在遍历范围内 上界不包含 为空表示不限制
+type IteratorOption struct {
+	// 是否逆序遍历
+	Reverse bool
+	// 遍历范围下界
+	LowerBound []byte
+	// 遍历范围上界
+	UpperBound []byte
+}
 
 type Iterator interface {
 	// Rewind 回到迭代器起点
 	Rewind()
 
-	// Seek 根据key所在位置继续遍历
+	// Seek 定位到key所在位置继续遍历 key不存在时定位到遍历方向上的下一个key 返回该位置是否有key
 	Seek(key []byte) bool
 
 	// Next 遍历下一个key
 	Next()
 
-	// HasNext 判断是否有下一个key用于遍历
+	// HasNext 判断当前位置是否还有key用于遍历
 	HasNext() bool
 
 	// Key 获取当前迭代器所在位置的key
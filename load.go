@@ -0,0 +1,138 @@
+package kv
+
+import (
+	"errors"
+	"github.com/RainbowSorcery/kv-project/data"
+	"os"
+	"sort"
+)
+
+// fileLoadResult 单个数据文件的解析结果
+type fileLoadResult struct {
+	// 文件中的记录 按写入顺序排列
+	records []*data.HintRecord
+	// 文件写入偏移 只有活动文件需要
+	offset int64
+	err    error
+}
+
+// loadIndex 并行解析所有数据文件 再按文件id顺序将解析结果重放到内存索引中
+func (db *Db) loadIndex() error {
+	// 按文件id顺序排列 保证后写入的数据覆盖先写入的数据 活动文件id最大 放在最后
+	files := make([]*data.FileData, 0, len(db.oldFile)+1)
+	for _, oldFileData := range db.oldFile {
+		files = append(files, oldFileData)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+	files = append(files, db.activeFile)
+
+	// 记录墓碑的序列号 挂载的批量导入文件中更早的记录不能覆盖之后的删除
+	db.tombstoneSeqs = make(map[string]uint64)
+	defer func() {
+		db.tombstoneSeqs = nil
+	}()
+
+	concurrency := db.option.LoadConcurrency
+
+	// 限制已解析但还未重放的文件数 避免所有文件的解析结果同时占用内存
+	results := make([]chan *fileLoadResult, len(files))
+	for i := range results {
+		results[i] = make(chan *fileLoadResult, 1)
+	}
+	semaphore := make(chan struct{}, concurrency)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i, fileData := range files {
+			select {
+			case semaphore <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int, fileData *data.FileData) {
+				results[i] <- db.parseFile(fileData, fileData == db.activeFile)
+			}(i, fileData)
+		}
+	}()
+
+	// 事务可能跨越多个数据文件 所有文件共用一个事务缓存
+	txCache := make(map[int64]map[string]*data.HintRecord)
+	for i := range files {
+		result := <-results[i]
+		<-semaphore
+		if result.err != nil {
+			return result.err
+		}
+
+		for _, record := range result.records {
+			db.loadRecord(record, txCache)
+		}
+
+		// 记录活动文件上次写入的位置
+		if files[i] == db.activeFile {
+			db.activeFile.WriteOffset = result.offset
+			db.activeHints = result.records
+		}
+	}
+
+	return nil
+}
+
+// parseFile 解析单个数据文件 非活动文件优先读取hint文件
+func (db *Db) parseFile(fileData *data.FileData, active bool) *fileLoadResult {
+	if !active {
+		// 判断数据文件对应的hint文件是否存在 存在则读取hint文件
+		// 旧版本写入的hint文件格式不同 与没有hint文件一样读取数据文件
+		_, err := os.Stat(db.option.DirPath + data.HintFileName(fileData.FileId))
+		if err == nil {
+			records, err := db.LoadHintFile(fileData)
+			if err == nil {
+				return &fileLoadResult{records: records, err: db.loadBloomFilter(fileData, records)}
+			}
+			if !errors.Is(err, data.ErrStaleHint) {
+				return &fileLoadResult{err: err}
+			}
+		}
+	}
+
+	offset, records, err := readFileData(fileData)
+	if err != nil {
+		return &fileLoadResult{err: err}
+	}
+
+	// 没有hint文件的非活动文件读取完成后补齐hint文件 下次启动时不需要再读取数据文件
+	// 只读模式下不写入文件 下次启动时仍需要读取数据文件
+	if !active && !db.option.ReadOnly {
+		db.option.Logger.Debug("hint file rebuilt", FileIdField(fileData.FileId), OffsetField(offset))
+		err = data.WriteHintFile(db.option.DirPath, fileData.FileId, records)
+	}
+	if !active && err == nil {
+		err = db.loadBloomFilter(fileData, records)
+	}
+
+	return &fileLoadResult{records: records, offset: offset, err: err}
+}
+
+// loadBloomFilter 读取非活动文件对应的布隆过滤器 不存在时根据文件中的记录重新生成
+func (db *Db) loadBloomFilter(fileData *data.FileData, records []*data.HintRecord) error {
+	filter, err := data.ReadBloomFile(db.option.DirPath, fileData.FileId)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if filter == nil {
+		filter = db.newBloomFilter(records)
+		if !db.option.ReadOnly {
+			err = data.WriteBloomFile(db.option.DirPath, fileData.FileId, filter)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	fileData.Filter = filter
+	return nil
+}
@@ -0,0 +1,57 @@
+package kv
+
+// Logger 日志接口 引擎内部的日志都通过该接口输出 默认不输出任何日志
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Field 结构化日志字段
+type Field struct {
+	Key   string
+	Value any
+}
+
+// 常用日志字段名称
+const (
+	FieldFileId = "file_id"
+	FieldOffset = "offset"
+	FieldPhase  = "phase"
+	FieldError  = "error"
+	FieldPath   = "path"
+	FieldCount  = "count"
+)
+
+// 合并阶段
+const (
+	MergePhaseRewrite = "rewrite"
+	MergePhaseSwap    = "swap"
+	MergePhaseRecover = "recover"
+	MergePhaseBlobGC  = "blob_gc"
+)
+
+func FileIdField(fileId uint32) Field {
+	return Field{Key: FieldFileId, Value: fileId}
+}
+
+func OffsetField(offset int64) Field {
+	return Field{Key: FieldOffset, Value: offset}
+}
+
+func PhaseField(phase string) Field {
+	return Field{Key: FieldPhase, Value: phase}
+}
+
+func ErrorField(err error) Field {
+	return Field{Key: FieldError, Value: err}
+}
+
+// NopLogger 不输出任何日志
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...Field) {}
+func (NopLogger) Info(string, ...Field)  {}
+func (NopLogger) Warn(string, ...Field)  {}
+func (NopLogger) Error(string, ...Field) {}
@@ -0,0 +1,49 @@
+//go:build go1.21
+
+package kv
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger 将日志输出到log/slog
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger 创建slog日志适配器 logger为空时使用slog默认logger
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{logger: logger}
+}
+
+func (logger *SlogLogger) Debug(msg string, fields ...Field) {
+	logger.log(slog.LevelDebug, msg, fields)
+}
+
+func (logger *SlogLogger) Info(msg string, fields ...Field) {
+	logger.log(slog.LevelInfo, msg, fields)
+}
+
+func (logger *SlogLogger) Warn(msg string, fields ...Field) {
+	logger.log(slog.LevelWarn, msg, fields)
+}
+
+func (logger *SlogLogger) Error(msg string, fields ...Field) {
+	logger.log(slog.LevelError, msg, fields)
+}
+
+func (logger *SlogLogger) log(level slog.Level, msg string, fields []Field) {
+	ctx := context.Background()
+	if !logger.logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		attrs = append(attrs, slog.Any(field.Key, field.Value))
+	}
+	logger.logger.LogAttrs(ctx, level, msg, attrs...)
+}
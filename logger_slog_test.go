@@ -0,0 +1,29 @@
+//go:build go1.21
+
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buffer, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	logger.Debug("ignored", FileIdField(1))
+	logger.Error("merge failed", PhaseField(MergePhaseSwap), FileIdField(3), ErrorField(errors.New("disk full")))
+
+	output := buffer.String()
+	if strings.Contains(output, "ignored") {
+		t.Fatal("低于日志级别的日志不能输出")
+	}
+	for _, expected := range []string{"level=ERROR", `msg="merge failed"`, "phase=swap", "file_id=3", `error="disk full"`} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("缺少日志内容 %q: %s", expected, output)
+		}
+	}
+}
@@ -1,173 +1,469 @@
-package main
+package kv
 
 import (
-	"errors"
-	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
 	"io"
-	"kv-database/data"
-	"log"
 	"os"
+	"sort"
+	"time"
 )
 
 const (
 	MergePath = "/merge/"
 )
 
+// mergeRecordPos 合并时被重写的记录 合并完成后根据旧的索引位置更新内存索引
+type mergeRecordPos struct {
+	key    []byte
+	oldPos *data.LogRecordPos
+	newPos *data.LogRecordPos
+}
+
 func (db *Db) Merge() error {
 	db.lock.Lock()
 
+	if err := db.checkWritable(); err != nil {
+		db.lock.Unlock()
+		return err
+	}
 	// 判断是否有在合并中 合并只能同时执行一次
 	if db.mergeIng {
-		return errors.New("正在合并中")
+		db.lock.Unlock()
+		return ErrMergeInProgress
 	}
-	defer db.lock.Unlock()
-	mergeDir := db.option.DirPath + MergePath
-	log.Println("合并文件目录:", mergeDir)
 
-	// 将上次合并的缓存文件清除
-	os.Remove(mergeDir)
-	os.Remove(db.option.DirPath + data.HintFileName)
+	// 1. 挑选可回收空间占比最高的非活动文件 也就是需要merge的文件
+	mergeFiles := db.pickMergeFiles()
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
 
-	// 判断合并文件是否存在
-	mergePath := db.getMergePath()
-	_, err := os.Stat(mergePath)
-	if err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(mergePath, 0644)
-		if err != nil {
-			return err
-		}
+	// 折叠引用了待合并文件的操作数 合并后的文件中只保留折叠后的普通记录
+	mergeFileIds := make(map[uint32]struct{}, len(mergeFiles))
+	for _, mergeFile := range mergeFiles {
+		mergeFileIds[mergeFile.FileId] = struct{}{}
+	}
+	if err := db.collapseOperandsInFiles(mergeFileIds); err != nil {
+		db.lock.Unlock()
+		return err
+	}
+	db.mergeIng = true
+	// 非活动文件只读 重写文件期间不需要持有锁
+	db.lock.Unlock()
+
+	start := time.Now()
+	err := db.mergeFiles(mergeFiles)
+	if err == nil && len(mergeFiles) > 0 {
+		db.metrics.mergeDuration.ObserveSince(start)
+	}
+
+	db.lock.Lock()
+	db.mergeIng = false
+	db.lock.Unlock()
+
+	return err
+}
+
+// mergeFiles 将指定的数据文件重写为只包含有效数据的同id文件 并替换原文件
+func (db *Db) mergeFiles(mergeFiles []*data.FileData) error {
+	if len(mergeFiles) == 0 {
+		return nil
 	}
 
+	mergePath := db.getMergePath()
+	db.option.Logger.Info("merge started", PhaseField(MergePhaseRewrite),
+		Field{Key: FieldPath, Value: mergePath}, Field{Key: FieldCount, Value: len(mergeFiles)})
+
 	// 清空上次合并的文件信息
-	err = os.RemoveAll(mergePath)
+	err := os.RemoveAll(mergePath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(mergePath, 0755)
 	if err != nil {
 		return err
 	}
 
-	// 1. 获取所有非活动文件 也就是需要merge的文件
-	oldFileMap := db.oldFile
-
-	// 创建合并实例
-	mergeDb, err := open(option{
-		DirPath:      mergePath,
-		FileDataSize: 1024,
-	})
-
-	// 4. 打开hint文件
-	hintFile, err := data.OpenHintFile(db.option.DirPath)
+	// 墓碑记录需要屏蔽更早的未合并文件中的旧数据 事务完成记录需要提交更早的未合并文件中的事务数据
+	// 只有比最早的未合并文件新的墓碑以及事务完成记录需要保留
+	mergeFileIds := make(map[uint32]struct{}, len(mergeFiles))
+	for _, mergeFile := range mergeFiles {
+		mergeFileIds[mergeFile.FileId] = struct{}{}
+	}
+	db.lock.RLock()
+	keepTombstoneAfter := db.activeFile.FileId
+	for fileId := range db.oldFile {
+		if _, ok := mergeFileIds[fileId]; !ok && fileId < keepTombstoneAfter {
+			keepTombstoneAfter = fileId
+		}
+	}
+	db.lock.RUnlock()
 
-	var mergerFinishFileIdList []uint32
+	var mergedRecords []*mergeRecordPos
+	mergeFilters := make(map[uint32]*data.BloomFilter, len(mergeFiles))
 
 	// 2. 遍历文件中的LogRecord
-	for oldFileKey := range oldFileMap {
-		oldFile := oldFileMap[oldFileKey]
-
+	for _, oldFile := range mergeFiles {
+		mergeFile, err := data.OpenFileData(mergePath, oldFile.FileId, nil)
 		if err != nil {
 			return err
 		}
-
+		hintRecords := make([]*data.HintRecord, 0)
 		var offset int64 = 0
 		for {
 			logRecord, size, err := oldFile.Read(offset)
 			if err == io.EOF {
 				break
+			} else if err != nil {
+				return err
 			}
 
-			if logRecord == nil {
-				return errors.New("logRecord解析错误")
+			oldPos := &data.LogRecordPos{
+				FileId: oldFile.FileId,
+				Pos:    offset,
+				Size:   uint32(size),
 			}
+			offset += size
 
-			_, realKey := DecodingTranKey(logRecord.Key)
-			pos := db.index.Get(realKey)
+			// 3. 判断LogRecord中的数据是否与内存索引一致 一致的数据以及仍需生效的墓碑需要保留
+			txNum, realKey := DecodingTranKey(logRecord.Key)
+			keep := false
+			if data.IsValueType(logRecord.Type) || logRecord.Type == data.MergeOperand {
+				// 被操作数引用的基础value以及操作数本身也需要保留
+				keep = samePos(db.index.Get(realKey), oldPos) || db.operandChainContains(realKey, oldPos)
+			} else if logRecord.Type == data.Deleted {
+				// 操作数作用在已删除的key上时 墓碑仍需屏蔽更早的value
+				deleted := db.index.Get(realKey) == nil || db.operandChainWithoutBase(realKey)
+				keep = deleted && oldFile.FileId > keepTombstoneAfter
+			} else if logRecord.Type == data.TxComplete {
+				keep = oldFile.FileId > keepTombstoneAfter
+			}
+			if !keep {
+				continue
+			}
 
-			// 3. 判断LogRecord中的数据是否与内存索引一致 如果一致则新建hint文件
-			if pos != nil && pos.Pos == offset && pos.FileId == oldFile.FileId {
-				pos, err = mergeDb.AppendLogRecord(logRecord)
-				if err != nil {
-					return err
-				}
-				err = hintFile.WriteHintRecord(logRecord.Key, pos)
-				if err != nil {
-					return err
-				}
+			// 保留的数据都是已提交的数据 重写后的记录统一按非事务记录写入 只有事务完成记录保留事务序列号
+			if logRecord.Type != data.TxComplete {
+				txNum = 0
+			}
+			mergeRecord := &data.LogRecord{
+				Key:   EncodingTranKey(realKey, txNum),
+				Value: logRecord.Value,
+				Type:  logRecord.Type,
+				Seq:   logRecord.Seq,
+			}
+			encodingData, recordSize := data.EncodingLogRecord(mergeRecord)
+			newPos := &data.LogRecordPos{
+				FileId: oldFile.FileId,
+				Pos:    mergeFile.WriteOffset,
+				Size:   uint32(recordSize),
+				Seq:    logRecord.Seq,
+			}
+			err = mergeFile.Write(encodingData)
+			if err != nil {
+				return err
 			}
 
-			offset += size
+			// 4. 写入hint文件 保留的墓碑以及事务完成记录也需要写入 启动时按顺序重放
+			hintRecord := &data.HintRecord{
+				Key:     realKey,
+				Type:    logRecord.Type,
+				TranNum: txNum,
+				Pos:     newPos,
+			}
+			if logRecord.Type == data.BlobIndex {
+				hintRecord.Value = logRecord.Value
+			}
+			hintRecords = append(hintRecords, hintRecord)
+			if !data.IsValueType(logRecord.Type) && logRecord.Type != data.MergeOperand {
+				continue
+			}
+
+			mergedRecords = append(mergedRecords, &mergeRecordPos{
+				key:    realKey,
+				oldPos: oldPos,
+				newPos: newPos,
+			})
+		}
+
+		// 每个合并后的数据文件对应一个hint文件
+		err = data.WriteHintFile(mergePath, oldFile.FileId, hintRecords)
+		if err != nil {
+			return err
+		}
+		// 根据保留的记录重新生成布隆过滤器
+		filter := db.newBloomFilter(hintRecords)
+		err = data.WriteBloomFile(mergePath, oldFile.FileId, filter)
+		if err != nil {
+			return err
+		}
+		mergeFilters[oldFile.FileId] = filter
+
+		err = db.syncFile(mergeFile.FileManage)
+		if err != nil {
+			return err
+		}
+		err = mergeFile.FileManage.Close()
+		if err != nil {
+			return err
 		}
 	}
 
 	// 5. 整个文件遍历完成后添加一条文件merge完成的记录
-	mergerFinishFileIdList = append(mergerFinishFileIdList, mergeDb.activeFile.FileId)
-	for fileId := range mergeDb.oldFile {
-		mergerFinishFileIdList = append(mergerFinishFileIdList, fileId)
-
+	mergerFinishFileIdList := make([]uint32, 0, len(mergeFiles))
+	for _, mergeFile := range mergeFiles {
+		mergerFinishFileIdList = append(mergerFinishFileIdList, mergeFile.FileId)
 	}
 
 	mergeRecount := &data.MergeFinishRecord{
-		FinishCount:         uint32(len(mergeDb.oldFile) + 1),
+		FinishCount:         uint32(len(mergerFinishFileIdList)),
 		MergerFinishFileIds: mergerFinishFileIdList,
 	}
 
-	// 将合并完成记录写入到文件中
-	mergeFinsFile, err := data.OpenFinishMergeFile(db.option.DirPath)
+	// 将合并完成记录写入到文件中 合并完成记录写入后即使替换过程中断 下次启动时也可以继续完成替换
+	mergeFinsFile, err := data.OpenFinishMergeFile(mergePath)
 	if err != nil {
 		return err
 	}
 
 	err = mergeFinsFile.WriteMergeFinishRecord(mergeRecount)
-
 	if err != nil {
 		return err
 	}
-
-	mergeDbFile := make([]*data.FileData, 0)
-	mergeDbFile = append(mergeDbFile, mergeDb.activeFile)
-	err = mergeDb.activeFile.FileManage.Close()
+	err = db.syncFile(mergeFinsFile.FileManage)
+	if err != nil {
+		return err
+	}
+	err = mergeFinsFile.FileManage.Close()
 	if err != nil {
 		return err
 	}
 
-	for oldMergeFileKey := range mergeDb.oldFile {
-		oldFile := mergeDb.oldFile[oldMergeFileKey]
+	// 替换数据文件期间需要阻塞读写
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.option.Logger.Info("merge files rewritten", PhaseField(MergePhaseSwap), Field{Key: FieldCount, Value: len(mergeFiles)})
+
+	// 使用合并后的文件替换旧的数据文件
+	for _, oldFile := range mergeFiles {
+		oldSize := oldFile.FileManage.Size()
 		err := oldFile.FileManage.Close()
 		if err != nil {
 			return err
 		}
-		mergeDbFile = append(mergeDbFile, oldFile)
-	}
 
-	// 删除旧的数据文件
-	for fileId := range db.oldFile {
-		oldFileData := db.oldFile[fileId]
-		err := oldFileData.FileManage.Remove()
+		err = moveMergeFile(mergePath, db.option.DirPath, oldFile.FileId)
+		if err != nil {
+			return err
+		}
+		fileData, err := data.OpenFileData(db.option.DirPath, oldFile.FileId, db.blockCache)
 		if err != nil {
 			return err
 		}
+		fileData.Filter = mergeFilters[oldFile.FileId]
+		if reclaimed := oldSize - fileData.FileManage.Size(); reclaimed > 0 {
+			db.metrics.mergeReclaimed.Add(uint64(reclaimed))
+		}
+		db.option.Logger.Debug("data file merged", PhaseField(MergePhaseSwap), FileIdField(oldFile.FileId),
+			OffsetField(fileData.FileManage.Size()))
+		// 合并后的文件会复用旧文件中的位置 需要清除旧文件的缓存
+		if db.valueCache != nil {
+			db.valueCache.RemoveFile(oldFile.FileId)
+		}
+		db.oldFile[oldFile.FileId] = fileData
+		// 保留的墓碑仍需生效 合并后的文件不计入可回收空间
+		db.reclaimable[oldFile.FileId] = 0
+	}
+
+	err = os.Rename(mergePath+data.MergeFinishFileName, db.option.DirPath+data.MergeFinishFileName)
+	if err != nil {
+		return err
+	}
+	db.mergeCompleteFileId = make(map[uint32]struct{}, len(mergerFinishFileIdList))
+	for _, fileId := range mergerFinishFileIdList {
+		db.mergeCompleteFileId[fileId] = struct{}{}
 	}
+	db.lastMergeTime = time.Now()
 
-	// 移动新的合并文件
-	for index := range mergeDbFile {
-		mergeFileData := mergeDbFile[index]
-		err := os.Rename(mergeDir+fmt.Sprintf("%09d", mergeFileData.FileId)+".data", db.option.DirPath+fmt.Sprintf("%09d", mergeFileData.FileId)+".data")
+	// 重新设置内存索引 合并期间被覆盖或者删除的key不需要更新 重写后的记录直接计入可回收空间
+	for _, record := range mergedRecords {
+		referenced := db.remapOperandChain(record.key, record.oldPos, record.newPos)
+		if samePos(db.index.Get(record.key), record.oldPos) {
+			db.index.Put(record.key, record.newPos)
+			referenced = true
+		}
+		if !referenced {
+			db.reclaimable[record.newPos.FileId] += int64(record.newPos.Size)
+		}
+	}
+
+	return os.RemoveAll(mergePath)
+}
+
+// recoverMerge 启动时处理上次合并遗留的文件 合并完成记录存在时继续替换数据文件 否则丢弃合并结果
+func (db *Db) recoverMerge() error {
+	mergePath := db.getMergePath()
+	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+		return nil
+	}
+	// 只读模式不修改数据目录 合并后的文件逐个连同hint文件替换 未替换的文件仍然完整
+	if db.option.ReadOnly {
+		db.option.Logger.Warn("interrupted merge not recovered in read only mode", PhaseField(MergePhaseRecover),
+			Field{Key: FieldPath, Value: mergePath})
+		return nil
+	}
+
+	_, err := os.Stat(mergePath + data.MergeFinishFileName)
+	if err == nil {
+		finishFile, err := data.OpenFinishMergeFile(mergePath)
 		if err != nil {
 			return err
 		}
-		fileData, err := data.OpenFileData(db.option.DirPath, mergeFileData.FileId)
+		mergeRecord, err := finishFile.ReadMergeFinishRecord()
+		if err != nil {
+			return err
+		}
+		err = finishFile.FileManage.Close()
 		if err != nil {
 			return err
 		}
-		db.oldFile[mergeFileData.FileId] = fileData
-	}
 
-	// 重新加载索引信息
-	err = db.LoadHintFile(nil)
-	if err != nil {
-		return err
+		for _, fileId := range mergeRecord.MergerFinishFileIds {
+			err = moveMergeFile(mergePath, db.option.DirPath, fileId)
+			if err != nil {
+				return err
+			}
+		}
+		db.option.Logger.Info("interrupted merge completed", PhaseField(MergePhaseRecover),
+			Field{Key: FieldCount, Value: mergeRecord.FinishCount})
+
+		err = os.Rename(mergePath+data.MergeFinishFileName, db.option.DirPath+data.MergeFinishFileName)
+		if err != nil {
+			return err
+		}
+	} else {
+		db.option.Logger.Warn("unfinished merge discarded", PhaseField(MergePhaseRecover), Field{Key: FieldPath, Value: mergePath})
 	}
 
+	return os.RemoveAll(mergePath)
+}
+
+// moveMergeFile 将合并后的数据文件、hint文件以及布隆过滤器文件移动到数据目录 已经移动过的文件直接跳过
+func moveMergeFile(mergePath string, dirPath string, fileId uint32) error {
+	fileNames := []string{data.DataFileName(fileId), data.HintFileName(fileId), data.BloomFileName(fileId)}
+	for _, fileName := range fileNames {
+		err := os.Rename(mergePath+fileName, dirPath+fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-func (db Db) getMergePath() string {
+// pickMergeFiles 按可回收空间占比从高到低挑选需要合并的非活动文件 调用方需要持有锁
+func (db *Db) pickMergeFiles() []*data.FileData {
+	type mergeCandidate struct {
+		fileData *data.FileData
+		ratio    float64
+	}
+
+	candidates := make([]*mergeCandidate, 0, len(db.oldFile))
+	for fileId, oldFile := range db.oldFile {
+		fileSize := oldFile.FileManage.Size()
+		reclaimableSize := db.reclaimable[fileId]
+		if fileSize == 0 || reclaimableSize <= 0 {
+			continue
+		}
+
+		ratio := float64(reclaimableSize) / float64(fileSize)
+		if ratio < db.option.MergeRatio {
+			continue
+		}
+		candidates = append(candidates, &mergeCandidate{fileData: oldFile, ratio: ratio})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ratio > candidates[j].ratio
+	})
+	if db.option.MergeMaxFiles > 0 && len(candidates) > db.option.MergeMaxFiles {
+		candidates = candidates[:db.option.MergeMaxFiles]
+	}
+
+	mergeFiles := make([]*data.FileData, 0, len(candidates))
+	for _, candidate := range candidates {
+		mergeFiles = append(mergeFiles, candidate.fileData)
+	}
+	return mergeFiles
+}
+
+// autoMerge 后台定时检查可回收空间 达到阈值时自动触发合并以及blob文件回收
+func (db *Db) autoMerge() {
+	defer db.backgroundWait.Done()
+
+	ticker := time.NewTicker(db.option.MergeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case now := <-ticker.C:
+			if !db.inMergeWindow(now) {
+				continue
+			}
+			if db.option.MergeRatio > 0 && db.needMerge() {
+				if err := db.Merge(); err != nil {
+					db.option.Logger.Error("auto merge failed", PhaseField(MergePhaseRewrite), ErrorField(err))
+				}
+			}
+			if db.needBlobGC() {
+				if err := db.BlobGC(); err != nil {
+					db.option.Logger.Error("blob gc failed", PhaseField(MergePhaseBlobGC), ErrorField(err))
+				}
+			}
+		}
+	}
+}
+
+// needMerge 判断可回收空间占比达到阈值的文件是否足够触发自动合并
+func (db *Db) needMerge() bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.mergeIng {
+		return false
+	}
+
+	mergeFiles := db.pickMergeFiles()
+	if len(mergeFiles) == 0 {
+		return false
+	}
+
+	var reclaimableSize int64
+	for _, mergeFile := range mergeFiles {
+		reclaimableSize += db.reclaimable[mergeFile.FileId]
+	}
+
+	return reclaimableSize >= db.option.MergeMinBytes
+}
+
+// inMergeWindow 判断当前时间是否在允许自动合并的时间窗口内
+func (db *Db) inMergeWindow(now time.Time) bool {
+	start, end := db.option.MergeWindowStart, db.option.MergeWindowEnd
+	if start == end {
+		return true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	// 时间窗口跨越零点 例如22:00 - 04:00
+	if start > end {
+		return offset >= start || offset < end
+	}
+	return offset >= start && offset < end
+}
+
+func (db *Db) getMergePath() string {
 	return db.option.DirPath + MergePath
 }
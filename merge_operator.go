@@ -0,0 +1,297 @@
+package kv
+
+import (
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"strconv"
+)
+
+// MergeOperator 合并操作符 读取时将key之前的value与操作数按写入顺序依次合并 需要满足结合律
+type MergeOperator interface {
+	// Merge 合并value与操作数 key不存在时existingValue为nil
+	Merge(key []byte, existingValue []byte, operand []byte) ([]byte, error)
+}
+
+// Int64AddOperator 计数器合并操作符 value与操作数均为十进制整数 合并结果为两者之和
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Merge(key []byte, existingValue []byte, operand []byte) ([]byte, error) {
+	var value int64
+	if existingValue != nil {
+		var err error
+		value, err = strconv.ParseInt(string(existingValue), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %q %w", existingValue, ErrNotInteger)
+		}
+	}
+	delta, err := strconv.ParseInt(string(operand), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("操作数 %q %w", operand, ErrNotInteger)
+	}
+	return strconv.AppendInt(nil, value+delta, 10), nil
+}
+
+// operandChain 尚未合并的操作数 内存索引指向最后一个操作数
+type operandChain struct {
+	// 第一个操作数之前的value位置 key不存在时为nil
+	base *data.LogRecordPos
+	// 操作数位置 按写入顺序排列
+	operands []*data.LogRecordPos
+	// 基础value与所有操作数合并后的value 追加操作数后需要重新合并 只在持有写锁时更新 读取时持有读锁
+	merged    []byte
+	hasMerged bool
+}
+
+// MergeValue 追加一个操作数 不需要先读取value 读取时与之前的value合并 合并文件时折叠为普通记录
+// 注册了二级索引时需要根据合并后的value更新索引条目 直接合并后按普通写入处理
+func (db *Db) MergeValue(key []byte, operand []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if db.option.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return db.mergeValue(key, operand)
+}
+
+// mergeValue 追加操作数 调用方需要持有锁
+// 覆盖数据结构时成员需要在同一个事务中删除 与注册了二级索引时一样合并后按普通写入处理
+func (db *Db) mergeValue(key []byte, operand []byte) error {
+	if len(db.secondaryIndexes) > 0 || db.hasMembers(key) {
+		var existingValue []byte
+		if pos := db.index.Get(key); pos != nil {
+			record, err := db.posByLogRecord(key, pos)
+			if err != nil {
+				return err
+			}
+			existingValue = record.Value
+		}
+		value, err := db.option.MergeOperator.Merge(key, existingValue, operand)
+		if err != nil {
+			return err
+		}
+		return db.put(key, value, 0)
+	}
+
+	pos, err := db.AppendLogRecord(&data.LogRecord{
+		Key:   EncodingTranKey(key, 0),
+		Value: operand,
+		Type:  data.MergeOperand,
+	})
+	if err != nil {
+		return err
+	}
+
+	db.indexPutOperand(key, pos)
+
+	return nil
+}
+
+// Incr 将key对应的整数value加上delta并返回结果 value为十进制整数 key不存在时从0开始
+// 返回结果需要当前value 配置了Int64AddOperator时只追加操作数 合并结果保存在内存中 连续自增不需要读取磁盘
+// 未配置时读取当前value后写入完整的value
+func (db *Db) Incr(key []byte, delta int64) (int64, error) {
+	if err := validateKey(key); err != nil {
+		return 0, err
+	}
+
+	// 读取与写入在同一次加锁中完成 并发自增不会丢失更新
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	var value int64
+	if pos := db.index.Get(key); pos != nil {
+		record, err := db.posByLogRecord(key, pos)
+		if err != nil {
+			return 0, err
+		}
+		value, err = strconv.ParseInt(string(record.Value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value %q %w", record.Value, ErrNotInteger)
+		}
+	}
+
+	value += delta
+	if _, ok := db.option.MergeOperator.(Int64AddOperator); ok {
+		if err := db.mergeValue(key, strconv.AppendInt(nil, delta, 10)); err != nil {
+			return 0, err
+		}
+		// 注册了二级索引时按普通写入处理 不存在操作数
+		if chain := db.operandChains[string(key)]; chain != nil {
+			chain.merged, chain.hasMerged = strconv.AppendInt(nil, value, 10), true
+		}
+		return value, nil
+	}
+	if err := db.put(key, strconv.AppendInt(nil, value, 10), 0); err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// indexPutOperand 记录新的操作数 之前的value仍然需要参与合并 不计入可回收空间
+func (db *Db) indexPutOperand(key []byte, pos *data.LogRecordPos) {
+	chain := db.operandChains[string(key)]
+	if chain == nil {
+		chain = &operandChain{base: db.index.Get(key)}
+		db.operandChains[string(key)] = chain
+	}
+	chain.operands = append(chain.operands, pos)
+	chain.merged, chain.hasMerged = nil, false
+	db.index.Put(key, pos)
+}
+
+// dropOperandChain key被覆盖或删除时 基础value以及之前的操作数计入可回收空间 最后一个操作数由内存索引更新时计入
+func (db *Db) dropOperandChain(key []byte) {
+	chain := db.operandChains[string(key)]
+	if chain == nil {
+		return
+	}
+	delete(db.operandChains, string(key))
+
+	if chain.base != nil {
+		db.reclaimable[chain.base.FileId] += int64(chain.base.Size)
+	}
+	for _, pos := range chain.operands[:len(chain.operands)-1] {
+		db.reclaimable[pos.FileId] += int64(pos.Size)
+	}
+}
+
+// foldOperands 将基础value与所有操作数依次合并 调用方需要持有锁
+// 读取时只持有读锁 并发读取同一个key 合并结果不保存在操作数链中
+func (db *Db) foldOperands(key []byte) (*data.LogRecord, error) {
+	if db.option.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	chain := db.operandChains[string(key)]
+	if chain == nil {
+		return nil, fmt.Errorf("操作数不存在: %w", ErrKeyNotFound)
+	}
+	// 合并结果的序列号为最后一个操作数的序列号
+	seq := chain.operands[len(chain.operands)-1].Seq
+	// 合并结果保存在操作数链中 返回副本避免调用方修改
+	if chain.hasMerged {
+		return &data.LogRecord{Key: key, Value: append([]byte{}, chain.merged...), Type: data.Normal, Seq: seq}, nil
+	}
+
+	var value []byte
+	if chain.base != nil {
+		record, err := db.readLogRecord(key, chain.base)
+		if err != nil {
+			return nil, err
+		}
+		value = record.Value
+	}
+	for _, pos := range chain.operands {
+		record, err := db.readLogRecord(key, pos)
+		if err != nil {
+			return nil, err
+		}
+		value, err = db.option.MergeOperator.Merge(key, value, record.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &data.LogRecord{
+		Key:   key,
+		Value: append([]byte{}, value...),
+		Type:  data.Normal,
+		Seq:   seq,
+	}, nil
+}
+
+// collapseOperands 将合并结果写为普通记录 之前的value以及操作数全部失效 调用方需要持有锁
+func (db *Db) collapseOperands(key []byte) error {
+	record, err := db.foldOperands(key)
+	if err != nil {
+		return err
+	}
+	// value没有变化 保留最后一个操作数的序列号
+	return db.put(key, record.Value, record.Seq)
+}
+
+// collapseOperandsInFiles 折叠引用了指定文件中记录的操作数 合并文件前调用 调用方需要持有锁
+func (db *Db) collapseOperandsInFiles(fileIds map[uint32]struct{}) error {
+	keys := make([]string, 0)
+	for key, chain := range db.operandChains {
+		if chain.references(fileIds) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		if err := db.collapseOperands([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// references 判断基础value或者操作数是否位于指定文件中
+func (chain *operandChain) references(fileIds map[uint32]struct{}) bool {
+	if chain.base != nil {
+		if _, ok := fileIds[chain.base.FileId]; ok {
+			return true
+		}
+	}
+	for _, pos := range chain.operands {
+		if _, ok := fileIds[pos.FileId]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// operandChainContains 判断记录是否仍被未合并的操作数引用 合并文件时这些记录需要保留
+func (db *Db) operandChainContains(key []byte, pos *data.LogRecordPos) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	chain := db.operandChains[string(key)]
+	if chain == nil {
+		return false
+	}
+	if samePos(chain.base, pos) {
+		return true
+	}
+	for _, operandPos := range chain.operands {
+		if samePos(operandPos, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// operandChainWithoutBase 判断key的操作数是否作用在不存在的value上 此时之前的墓碑记录需要保留
+func (db *Db) operandChainWithoutBase(key []byte) bool {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	chain := db.operandChains[string(key)]
+	return chain != nil && chain.base == nil
+}
+
+// remapOperandChain 合并文件后更新操作数引用的记录位置 调用方需要持有锁
+func (db *Db) remapOperandChain(key []byte, oldPos *data.LogRecordPos, newPos *data.LogRecordPos) bool {
+	chain := db.operandChains[string(key)]
+	if chain == nil {
+		return false
+	}
+	if samePos(chain.base, oldPos) {
+		chain.base = newPos
+		return true
+	}
+	for i, operandPos := range chain.operands {
+		if samePos(operandPos, oldPos) {
+			chain.operands[i] = newPos
+			return true
+		}
+	}
+	return false
+}
+
+func samePos(pos *data.LogRecordPos, other *data.LogRecordPos) bool {
+	return pos != nil && other != nil && pos.FileId == other.FileId && pos.Pos == other.Pos
+}
@@ -0,0 +1,144 @@
+package kv
+
+import (
+	"github.com/RainbowSorcery/kv-project/fio"
+	"github.com/RainbowSorcery/kv-project/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// dbMetrics 数据库运行指标
+type dbMetrics struct {
+	putLatency    *metrics.Histogram
+	getLatency    *metrics.Histogram
+	deleteLatency *metrics.Histogram
+	syncLatency   *metrics.Histogram
+	mergeDuration *metrics.Histogram
+	batchSize     *metrics.Histogram
+	// 合并回收的字节数
+	mergeReclaimed metrics.Counter
+	// 每个数据文件追加写入的字节数 写入时持有db锁
+	fileBytesWritten map[uint32]uint64
+}
+
+func newDbMetrics() *dbMetrics {
+	return &dbMetrics{
+		putLatency:       metrics.NewHistogram(metrics.LatencyBuckets),
+		getLatency:       metrics.NewHistogram(metrics.LatencyBuckets),
+		deleteLatency:    metrics.NewHistogram(metrics.LatencyBuckets),
+		syncLatency:      metrics.NewHistogram(metrics.LatencyBuckets),
+		mergeDuration:    metrics.NewHistogram(metrics.DurationBuckets),
+		batchSize:        metrics.NewHistogram(metrics.SizeBuckets),
+		fileBytesWritten: make(map[uint32]uint64),
+	}
+}
+
+// Metrics 数据库运行指标快照
+type Metrics struct {
+	// Put、Get、Delete延迟 单位秒
+	PutLatency    metrics.HistogramSnapshot
+	GetLatency    metrics.HistogramSnapshot
+	DeleteLatency metrics.HistogramSnapshot
+	// 刷盘延迟 单位秒
+	SyncLatency metrics.HistogramSnapshot
+	// 合并耗时 单位秒
+	MergeDuration metrics.HistogramSnapshot
+	// 批量写入提交的记录数
+	BatchCommitSize metrics.HistogramSnapshot
+	// 合并回收的字节数
+	MergeReclaimedBytes uint64
+	// 每个数据文件追加写入的字节数
+	FileBytesWritten map[uint32]uint64
+	// 内存索引中的key数量 包括内部key
+	IndexSize int
+	// 打开的数据文件以及blob文件数量
+	OpenFiles int
+	// value缓存命中次数以及未命中次数
+	CacheHits   uint64
+	CacheMisses uint64
+	// value缓存命中率 没有访问时为0
+	CacheHitRate float64
+}
+
+// Metrics 获取数据库运行指标快照
+func (db *Db) Metrics() *Metrics {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	snapshot := &Metrics{
+		PutLatency:          db.metrics.putLatency.Snapshot(),
+		GetLatency:          db.metrics.getLatency.Snapshot(),
+		DeleteLatency:       db.metrics.deleteLatency.Snapshot(),
+		SyncLatency:         db.metrics.syncLatency.Snapshot(),
+		MergeDuration:       db.metrics.mergeDuration.Snapshot(),
+		BatchCommitSize:     db.metrics.batchSize.Snapshot(),
+		MergeReclaimedBytes: db.metrics.mergeReclaimed.Value(),
+		FileBytesWritten:    make(map[uint32]uint64, len(db.metrics.fileBytesWritten)),
+		IndexSize:           db.index.Size(),
+		OpenFiles:           len(db.oldFile) + 1 + len(db.blobFiles),
+	}
+	for fileId, size := range db.metrics.fileBytesWritten {
+		snapshot.FileBytesWritten[fileId] = size
+	}
+	if db.valueCache != nil {
+		stat := db.valueCache.Stat()
+		snapshot.CacheHits, snapshot.CacheMisses = stat.Hits, stat.Misses
+		if total := stat.Hits + stat.Misses; total > 0 {
+			snapshot.CacheHitRate = float64(stat.Hits) / float64(total)
+		}
+	}
+
+	return snapshot
+}
+
+// WritePrometheus 按prometheus文本格式输出指标
+func (snapshot *Metrics) WritePrometheus(writer io.Writer) error {
+	histogram := func(name string, help string, value metrics.HistogramSnapshot) metrics.Family {
+		return metrics.Family{Name: name, Help: help, Type: metrics.TypeHistogram, Samples: []metrics.Sample{{Histogram: &value}}}
+	}
+	value := func(name string, help string, metricType metrics.Type, value float64) metrics.Family {
+		return metrics.Family{Name: name, Help: help, Type: metricType, Samples: []metrics.Sample{{Value: value}}}
+	}
+
+	fileBytes := metrics.Family{Name: "kv_file_bytes_written_total", Help: "Bytes appended to each data file.", Type: metrics.TypeCounter}
+	for fileId, size := range snapshot.FileBytesWritten {
+		fileBytes.Samples = append(fileBytes.Samples, metrics.Sample{
+			Labels: map[string]string{"file_id": strconv.FormatUint(uint64(fileId), 10)},
+			Value:  float64(size),
+		})
+	}
+
+	return metrics.WritePrometheus(writer, []metrics.Family{
+		histogram("kv_put_duration_seconds", "Latency of Put calls.", snapshot.PutLatency),
+		histogram("kv_get_duration_seconds", "Latency of Get calls.", snapshot.GetLatency),
+		histogram("kv_delete_duration_seconds", "Latency of Delete calls.", snapshot.DeleteLatency),
+		histogram("kv_fsync_duration_seconds", "Latency of file syncs.", snapshot.SyncLatency),
+		histogram("kv_merge_duration_seconds", "Duration of merges.", snapshot.MergeDuration),
+		histogram("kv_batch_commit_size", "Number of records in each batch commit.", snapshot.BatchCommitSize),
+		value("kv_merge_reclaimed_bytes_total", "Bytes reclaimed by merges.", metrics.TypeCounter, float64(snapshot.MergeReclaimedBytes)),
+		fileBytes,
+		value("kv_index_keys", "Number of keys in the in-memory index.", metrics.TypeGauge, float64(snapshot.IndexSize)),
+		value("kv_open_files", "Number of open data and blob files.", metrics.TypeGauge, float64(snapshot.OpenFiles)),
+		value("kv_value_cache_hits_total", "Value cache hits.", metrics.TypeCounter, float64(snapshot.CacheHits)),
+		value("kv_value_cache_misses_total", "Value cache misses.", metrics.TypeCounter, float64(snapshot.CacheMisses)),
+		value("kv_value_cache_hit_ratio", "Value cache hit ratio.", metrics.TypeGauge, snapshot.CacheHitRate),
+	})
+}
+
+// MetricsHandler prometheus指标http处理器 可以注册到/metrics路径
+func (db *Db) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := db.Metrics().WritePrometheus(writer); err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// syncFile 将文件刷到磁盘 并记录刷盘耗时
+func (db *Db) syncFile(fileManage fio.IOManagement) error {
+	defer db.metrics.syncLatency.ObserveSince(time.Now())
+	return fileManage.Sync()
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// LatencyBuckets 延迟直方图的默认分桶 单位秒
+	LatencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	// DurationBuckets 合并等耗时较长操作的默认分桶 单位秒
+	DurationBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+	// SizeBuckets 批量写入记录数的默认分桶
+	SizeBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 500, 1000, 10000}
+)
+
+// Counter 单调递增的计数器
+type Counter struct {
+	value uint64
+}
+
+func (counter *Counter) Add(delta uint64) {
+	atomic.AddUint64(&counter.value, delta)
+}
+
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+// Histogram 直方图 统计落在每个分桶中的观测值数量
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Bucket 直方图分桶 Count为小于等于UpperBound的观测值数量
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// HistogramSnapshot 直方图快照
+type HistogramSnapshot struct {
+	// 分桶计数 为累计值 最后一个分桶的上界为+Inf
+	Buckets []Bucket
+	// 观测次数
+	Count uint64
+	// 观测值总和
+	Sum float64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)+1),
+	}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	index := sort.SearchFloat64s(histogram.buckets, value)
+
+	histogram.lock.Lock()
+	histogram.counts[index]++
+	histogram.count++
+	histogram.sum += value
+	histogram.lock.Unlock()
+}
+
+// ObserveSince 记录从start开始到现在的耗时 单位秒
+func (histogram *Histogram) ObserveSince(start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
+
+func (histogram *Histogram) Snapshot() HistogramSnapshot {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	snapshot := HistogramSnapshot{
+		Buckets: make([]Bucket, 0, len(histogram.counts)),
+		Count:   histogram.count,
+		Sum:     histogram.sum,
+	}
+	var cumulative uint64
+	for i, count := range histogram.counts {
+		cumulative += count
+		upperBound := math.Inf(1)
+		if i < len(histogram.buckets) {
+			upperBound = histogram.buckets[i]
+		}
+		snapshot.Buckets = append(snapshot.Buckets, Bucket{UpperBound: upperBound, Count: cumulative})
+	}
+	return snapshot
+}
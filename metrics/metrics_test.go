@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	histogram := NewHistogram([]float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	snapshot := histogram.Snapshot()
+
+	var counter Counter
+	counter.Add(3)
+
+	buffer := &bytes.Buffer{}
+	err := WritePrometheus(buffer, []Family{
+		{Name: "kv_put_seconds", Help: "put延迟", Type: TypeHistogram, Samples: []Sample{{Histogram: &snapshot}}},
+		{Name: "kv_bytes_total", Help: "写入字节数", Type: TypeCounter, Samples: []Sample{
+			{Labels: map[string]string{"file_id": "1"}, Value: float64(counter.Value())},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# TYPE kv_put_seconds histogram",
+		`kv_put_seconds_bucket{le="0.1"} 1`,
+		`kv_put_seconds_bucket{le="1"} 2`,
+		`kv_put_seconds_bucket{le="+Inf"} 3`,
+		"kv_put_seconds_sum 2.55",
+		"kv_put_seconds_count 3",
+		`kv_bytes_total{file_id="1"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Fatalf("缺少指标 %q:\n%s", line, buffer.String())
+		}
+	}
+}
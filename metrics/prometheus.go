@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type 指标类型
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// Sample 一个带标签的指标值 直方图使用Histogram 其他类型使用Value
+type Sample struct {
+	Labels    map[string]string
+	Value     float64
+	Histogram *HistogramSnapshot
+}
+
+// Family 同名指标 对应prometheus中的一组HELP以及TYPE
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// WritePrometheus 按prometheus文本格式输出指标
+func WritePrometheus(writer io.Writer, families []Family) error {
+	buffer := bufio.NewWriter(writer)
+	for _, family := range families {
+		fmt.Fprintf(buffer, "# HELP %s %s\n", family.Name, escapeHelp(family.Help))
+		fmt.Fprintf(buffer, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, sample := range family.Samples {
+			if family.Type != TypeHistogram || sample.Histogram == nil {
+				fmt.Fprintf(buffer, "%s%s %s\n", family.Name, formatLabels(sample.Labels, "", ""), formatValue(sample.Value))
+				continue
+			}
+			for _, bucket := range sample.Histogram.Buckets {
+				labels := formatLabels(sample.Labels, "le", formatValue(bucket.UpperBound))
+				fmt.Fprintf(buffer, "%s_bucket%s %d\n", family.Name, labels, bucket.Count)
+			}
+			labels := formatLabels(sample.Labels, "", "")
+			fmt.Fprintf(buffer, "%s_sum%s %s\n", family.Name, labels, formatValue(sample.Histogram.Sum))
+			fmt.Fprintf(buffer, "%s_count%s %d\n", family.Name, labels, sample.Histogram.Count)
+		}
+	}
+	return buffer.Flush()
+}
+
+// formatLabels 按标签名排序输出 extraName不为空时追加一个额外标签
+func formatLabels(labels map[string]string, extraName string, extraValue string) string {
+	if len(labels) == 0 && extraName == "" {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(labels[name]))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
@@ -1,10 +1,205 @@
-package main
+package kv
 
-type option struct {
+import (
+	"errors"
+	"github.com/RainbowSorcery/kv-project/cache"
+	"github.com/RainbowSorcery/kv-project/fio"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Options 数据库配置 零值配置项使用默认值
+type Options struct {
 	// 文件存储目录
 	DirPath string
 	// 单数据文件大小阈值
 	FileDataSize int64
+	// 启动时并行解析数据文件的协程数 默认为cpu核数
+	LoadConcurrency int
+	// 非活动文件布隆过滤器的误判率 默认为0.01
+	BloomFalsePositive float64
+	// value缓存大小 单位字节 为0表示不开启缓存
+	ValueCacheSize int64
+	// value缓存淘汰策略 可选lru、tinylfu 默认lru
+	ValueCachePolicy string
+	// 数据文件块缓存大小 单位字节 为0表示不开启块缓存
+	BlockCacheSize int64
+	// 缓存块大小 默认32KB
+	BlockSize int
+	// 顺序读取时预读的块数 默认4
+	ReadAheadBlocks int
+
+	// 只读模式 写入、合并以及blob回收返回ErrReadOnly 打开时不补齐hint文件以及布隆过滤器文件
+	// 不修改数据目录 所有文件以只读方式打开 目录不存在或者没有数据文件时返回错误
+	ReadOnly bool
+
+	// 日志输出 为空时不输出日志
+	Logger Logger
+
+	// 二级索引 key为索引名称 value为字段提取函数 打开数据库时注册
+	Indexes map[string]IndexExtractor
+
+	// 合并操作符 用于MergeValue写入的操作数 为空时不允许写入操作数
+	MergeOperator MergeOperator
+
+	// 大value阈值 value长度达到该值时单独存放到blob文件中 为0表示不分离
+	BlobThreshold int64
+	// 单个blob文件大小阈值 默认256MB
+	BlobFileSize int64
+	// blob文件回收阈值 blob文件中可回收空间占比达到该值时自动回收 为0表示不自动回收
+	BlobGCRatio float64
+
+	// 自动合并阈值 非活动文件中可回收空间占比达到该值时才会被合并 为0表示不自动合并
+	MergeRatio float64
+	// 单次合并最多重写的文件数 优先合并可回收空间占比高的文件 为0表示不限制
+	MergeMaxFiles int
+	// 自动合并时可回收空间的最小字节数 可回收空间小于该值时不触发合并
+	MergeMinBytes int64
+	// 自动合并检查间隔 默认一分钟
+	MergeCheckInterval time.Duration
+	// 自动合并允许执行的时间窗口 以距离当天零点的时长表示 开始与结束相等表示不限制
+	MergeWindowStart time.Duration
+	MergeWindowEnd   time.Duration
+}
+
+// DefaultOptions 默认配置 没有默认的数据目录 需要通过WithDirPath指定 其余零值配置项打开时使用这里的值
+var DefaultOptions = Options{
+	DirPath:            "",
+	FileDataSize:       256 * 1024 * 1024,
+	LoadConcurrency:    runtime.NumCPU(),
+	BloomFalsePositive: 0.01,
+	ValueCachePolicy:   cache.PolicyLRU,
+	BlockSize:          fio.DefaultBlockSize,
+	ReadAheadBlocks:    fio.DefaultReadAheadBlocks,
+	BlobFileSize:       DefaultBlobFileSize,
+	MergeCheckInterval: time.Minute,
+}
+
+// Option 修改配置的函数 打开数据库时在Options基础上依次执行
+type Option func(options *Options)
+
+// WithDirPath 设置文件存储目录
+func WithDirPath(dirPath string) Option {
+	return func(options *Options) {
+		options.DirPath = dirPath
+	}
+}
+
+// WithFileDataSize 设置单数据文件大小阈值
+func WithFileDataSize(size int64) Option {
+	return func(options *Options) {
+		options.FileDataSize = size
+	}
+}
+
+// WithReadOnly 以只读模式打开
+func WithReadOnly() Option {
+	return func(options *Options) {
+		options.ReadOnly = true
+	}
+}
+
+// WithLogger 设置日志输出
+func WithLogger(logger Logger) Option {
+	return func(options *Options) {
+		options.Logger = logger
+	}
+}
+
+// WithValueCache 开启value缓存 policy为空时使用lru
+func WithValueCache(size int64, policy string) Option {
+	return func(options *Options) {
+		options.ValueCacheSize = size
+		options.ValueCachePolicy = policy
+	}
+}
+
+// WithBlockCache 开启数据文件块缓存
+func WithBlockCache(size int64) Option {
+	return func(options *Options) {
+		options.BlockCacheSize = size
+	}
+}
+
+// WithBlobThreshold 设置大value阈值 value长度达到该值时单独存放到blob文件中
+func WithBlobThreshold(threshold int64) Option {
+	return func(options *Options) {
+		options.BlobThreshold = threshold
+	}
+}
+
+// WithAutoMerge 开启自动合并 可回收空间占比达到ratio时合并
+func WithAutoMerge(ratio float64, checkInterval time.Duration) Option {
+	return func(options *Options) {
+		options.MergeRatio = ratio
+		options.MergeCheckInterval = checkInterval
+	}
+}
+
+// WithIndex 注册二级索引
+func WithIndex(name string, extractor IndexExtractor) Option {
+	return func(options *Options) {
+		indexes := make(map[string]IndexExtractor, len(options.Indexes)+1)
+		for indexName, indexExtractor := range options.Indexes {
+			indexes[indexName] = indexExtractor
+		}
+		indexes[name] = extractor
+		options.Indexes = indexes
+	}
+}
+
+// WithMergeOperator 设置合并操作符
+func WithMergeOperator(operator MergeOperator) Option {
+	return func(options *Options) {
+		options.MergeOperator = operator
+	}
+}
+
+// buildOptions 依次执行opts修改配置 校验配置并补齐默认值
+func buildOptions(options Options, opts ...Option) (Options, error) {
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// 校验option配置是否合法
+	if len(options.DirPath) == 0 {
+		return options, errors.New("目录为空")
+	}
+	// 零值以及不合法的配置项使用默认值 其他地方不再单独处理
+	if options.FileDataSize <= 0 {
+		options.FileDataSize = DefaultOptions.FileDataSize
+	}
+	if options.LoadConcurrency <= 0 {
+		options.LoadConcurrency = DefaultOptions.LoadConcurrency
+	}
+	if options.BloomFalsePositive <= 0 || options.BloomFalsePositive >= 1 {
+		options.BloomFalsePositive = DefaultOptions.BloomFalsePositive
+	}
+	if options.ValueCachePolicy == "" {
+		options.ValueCachePolicy = DefaultOptions.ValueCachePolicy
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultOptions.BlockSize
+	}
+	if options.ReadAheadBlocks <= 0 {
+		options.ReadAheadBlocks = DefaultOptions.ReadAheadBlocks
+	}
+	if options.BlobFileSize <= 0 {
+		options.BlobFileSize = DefaultOptions.BlobFileSize
+	}
+	if options.MergeCheckInterval <= 0 {
+		options.MergeCheckInterval = DefaultOptions.MergeCheckInterval
+	}
+	if options.Logger == nil {
+		options.Logger = NopLogger{}
+	}
+	// 文件路径通过字符串拼接生成 目录需要以分隔符结尾
+	if !strings.HasSuffix(options.DirPath, "/") && !strings.HasSuffix(options.DirPath, string(os.PathSeparator)) {
+		options.DirPath += string(os.PathSeparator)
+	}
+	return options, nil
 }
 
 type IteratorOption struct {
@@ -13,4 +208,10 @@ type IteratorOption struct {
 
 	// 遍历key为指定前缀的内容 默认为空
 	Prefix []byte
+
+	// 遍历范围下界 包含下界本身 默认为空表示不限制
+	LowerBound []byte
+
+	// 遍历范围上界 不包含上界本身 默认为空表示不限制
+	UpperBound []byte
 }
@@ -0,0 +1,383 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"github.com/RainbowSorcery/kv-project/index"
+	"strings"
+)
+
+const (
+	// internalKeyPrefix 内部key前缀 用户写入的key不能使用该前缀 遍历时会跳过内部key
+	internalKeyPrefix = "\x00\x00kv:"
+	// indexKeyPrefix 二级索引条目前缀 格式为: 前缀 + 索引名称 + 0 + 转义后的字段值 + 结束符 + 主键
+	indexKeyPrefix = internalKeyPrefix + "idx:"
+	// indexMetaPrefix 二级索引元数据前缀 存在时表示索引已经建立
+	indexMetaPrefix = internalKeyPrefix + "idxmeta:"
+
+	// indexRebuildBatchSize 重建索引时每个事务处理的key数量
+	indexRebuildBatchSize = 1024
+)
+
+// IndexExtractor 从value中提取需要建立索引的字段值 一个value可以对应多个字段值
+type IndexExtractor func(value []byte) [][]byte
+
+// SecondaryIndex 二级索引 根据字段值查找主键
+type SecondaryIndex struct {
+	db   *Db
+	name string
+}
+
+// IndexEntry 二级索引条目
+type IndexEntry struct {
+	// 字段值
+	Value []byte
+	// 主键
+	Key []byte
+}
+
+// isInternalKey 判断是否为内部key
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(internalKeyPrefix))
+}
+
+// validateKey 校验用户写入的key是否合法
+func validateKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if isInternalKey(key) {
+		return ErrInternalKey
+	}
+	return nil
+}
+
+// RegisterIndex 注册二级索引 索引第一次注册时根据已有数据建立 之后由Put、Delete以及BatchWrite在同一个事务中维护
+// 索引条目保存在数据文件中 重启后需要重新注册提取函数 未注册期间写入的数据需要调用Rebuild重建
+func (db *Db) RegisterIndex(name string, extractor IndexExtractor) error {
+	if len(name) == 0 || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("索引名称 %q 不合法: %w", name, ErrInvalidIndex)
+	}
+	if extractor == nil {
+		return fmt.Errorf("索引提取函数为空: %w", ErrInvalidIndex)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.index.Get(indexMetaKey(name)) != nil {
+		db.secondaryIndexes[name] = extractor
+		return nil
+	}
+	// 只读模式下不能写入索引条目
+	if db.option.ReadOnly {
+		return fmt.Errorf("索引%s尚未建立: %w", name, ErrReadOnly)
+	}
+	db.secondaryIndexes[name] = extractor
+	return db.rebuildIndex(name)
+}
+
+// Index 获取已注册的二级索引
+func (db *Db) Index(name string) *SecondaryIndex {
+	return &SecondaryIndex{db: db, name: name}
+}
+
+// Get 根据字段值获取主键列表
+func (secondaryIndex *SecondaryIndex) Get(value []byte) ([][]byte, error) {
+	prefix := indexValuePrefix(secondaryIndex.name, value)
+	entries, err := secondaryIndex.scan(prefix, prefixUpperBound(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys, nil
+}
+
+// Scan 按字段值顺序获取[start, end)范围内的索引条目 start、end为空表示不限制 limit小于等于0表示不限制数量
+func (secondaryIndex *SecondaryIndex) Scan(start []byte, end []byte, limit int) ([]*IndexEntry, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return nil, ErrInvalidRange
+	}
+
+	prefix := indexNamePrefix(secondaryIndex.name)
+	lowerBound, upperBound := prefix, prefixUpperBound(prefix)
+	if start != nil {
+		lowerBound = append(append([]byte{}, prefix...), escapeIndexValue(start)...)
+	}
+	if end != nil {
+		upperBound = append(append([]byte{}, prefix...), escapeIndexValue(end)...)
+	}
+	return secondaryIndex.scan(lowerBound, upperBound, limit)
+}
+
+// Rebuild 删除索引的所有条目后根据当前数据重新建立 提取函数变化后调用
+func (secondaryIndex *SecondaryIndex) Rebuild() error {
+	db := secondaryIndex.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.secondaryIndexes[secondaryIndex.name] == nil {
+		return fmt.Errorf("索引 %q: %w", secondaryIndex.name, ErrIndexNotFound)
+	}
+	return db.rebuildIndex(secondaryIndex.name)
+}
+
+func (secondaryIndex *SecondaryIndex) scan(lowerBound []byte, upperBound []byte, limit int) ([]*IndexEntry, error) {
+	db := secondaryIndex.db
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.secondaryIndexes[secondaryIndex.name] == nil {
+		return nil, fmt.Errorf("索引 %q: %w", secondaryIndex.name, ErrIndexNotFound)
+	}
+
+	iterate := db.index.Iterate(index.IteratorOption{LowerBound: lowerBound, UpperBound: upperBound})
+	defer iterate.Close()
+
+	namePrefixSize := len(indexNamePrefix(secondaryIndex.name))
+	entries := make([]*IndexEntry, 0)
+	for ; iterate.HasNext(); iterate.Next() {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		key, err := iterate.Key()
+		if err != nil {
+			return nil, err
+		}
+		value, primaryKey, ok := unescapeIndexValue(key[namePrefixSize:])
+		if !ok {
+			return nil, fmt.Errorf("索引条目解析失败: %w", ErrCorruptRecord)
+		}
+		entries = append(entries, &IndexEntry{Value: value, Key: primaryKey})
+	}
+	return entries, nil
+}
+
+// rebuildIndex 重新建立索引 每批key在一个事务中写入 调用方需要持有锁
+func (db *Db) rebuildIndex(name string) error {
+	extractor := db.secondaryIndexes[name]
+
+	// 删除旧的索引条目
+	prefix := indexNamePrefix(name)
+	writes := make(map[string]*data.LogRecord)
+	if err := db.rangeKeys(prefix, prefixUpperBound(prefix), func(key []byte, pos *data.LogRecordPos) error {
+		writes[string(key)] = &data.LogRecord{Key: key, Type: data.Deleted}
+		if len(writes) < indexRebuildBatchSize {
+			return nil
+		}
+		err := db.commit(writes, false, false)
+		writes = make(map[string]*data.LogRecord)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	// 根据当前数据写入索引条目
+	visit := func(key []byte, pos *data.LogRecordPos) error {
+		if isInternalKey(key) {
+			return nil
+		}
+		record, err := db.posByLogRecord(key, pos)
+		if err != nil {
+			return err
+		}
+		for _, value := range extractor(record.Value) {
+			indexKey := encodeIndexKey(name, value, key)
+			writes[string(indexKey)] = &data.LogRecord{Key: indexKey, Type: data.Normal}
+		}
+		if len(writes) < indexRebuildBatchSize {
+			return nil
+		}
+		err = db.commit(writes, false, false)
+		writes = make(map[string]*data.LogRecord)
+		return err
+	}
+	if err := db.rangeKeys(nil, nil, visit); err != nil {
+		return err
+	}
+
+	metaKey := indexMetaKey(name)
+	writes[string(metaKey)] = &data.LogRecord{Key: metaKey, Type: data.Normal}
+	return db.commit(writes, false, false)
+}
+
+// rangeKeys 先收集范围内的key再依次处理 处理过程中可以修改内存索引 调用方需要持有锁
+func (db *Db) rangeKeys(lowerBound []byte, upperBound []byte, fun func(key []byte, pos *data.LogRecordPos) error) error {
+	for {
+		iterate := db.index.Iterate(index.IteratorOption{LowerBound: lowerBound, UpperBound: upperBound})
+		keys := make([][]byte, 0, indexRebuildBatchSize)
+		positions := make([]*data.LogRecordPos, 0, indexRebuildBatchSize)
+		for ; iterate.HasNext() && len(keys) < indexRebuildBatchSize; iterate.Next() {
+			key, _ := iterate.Key()
+			pos, _ := iterate.Value()
+			keys = append(keys, key)
+			positions = append(positions, pos)
+		}
+		_ = iterate.Close()
+
+		for i, key := range keys {
+			if err := fun(key, positions[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < indexRebuildBatchSize {
+			return nil
+		}
+		// 从最后一个key之后继续
+		lowerBound = append(append([]byte{}, keys[len(keys)-1]...), 0)
+	}
+}
+
+// indexWrites 计算写入对应的索引条目变化 返回包含索引条目的写入集合 调用方需要持有锁
+func (db *Db) indexWrites(writes map[string]*data.LogRecord) (map[string]*data.LogRecord, error) {
+	result := make(map[string]*data.LogRecord, len(writes))
+	for key, record := range writes {
+		result[key] = record
+	}
+
+	for key, record := range writes {
+		if isInternalKey([]byte(key)) {
+			continue
+		}
+
+		var oldValue []byte
+		if pos := db.index.Get([]byte(key)); pos != nil {
+			oldRecord, err := db.posByLogRecord([]byte(key), pos)
+			if err != nil {
+				return nil, err
+			}
+			oldValue = oldRecord.Value
+		}
+
+		for name, extractor := range db.secondaryIndexes {
+			oldKeys := make(map[string]struct{})
+			if oldValue != nil {
+				for _, value := range extractor(oldValue) {
+					oldKeys[string(encodeIndexKey(name, value, []byte(key)))] = struct{}{}
+				}
+			}
+			if record.Type == data.Normal {
+				for _, value := range extractor(record.Value) {
+					indexKey := encodeIndexKey(name, value, []byte(key))
+					if _, ok := oldKeys[string(indexKey)]; ok {
+						delete(oldKeys, string(indexKey))
+						continue
+					}
+					result[string(indexKey)] = &data.LogRecord{Key: indexKey, Type: data.Normal}
+				}
+			}
+			for indexKey := range oldKeys {
+				result[indexKey] = &data.LogRecord{Key: []byte(indexKey), Type: data.Deleted}
+			}
+		}
+	}
+	return result, nil
+}
+
+// userKeyIterator 只遍历用户key的迭代器 内部key是连续的一段范围 遇到时整体跳过
+type userKeyIterator struct {
+	index.Iterator
+	reverse bool
+}
+
+func (db *Db) userKeyIterator(option index.IteratorOption) index.Iterator {
+	return newUserKeyIterator(db.index, option)
+}
+
+func newUserKeyIterator(indexer index.Indexer, option index.IteratorOption) index.Iterator {
+	iterate := &userKeyIterator{
+		Iterator: indexer.Iterate(option),
+		reverse:  option.Reverse,
+	}
+	iterate.skipInternalKeys()
+	return iterate
+}
+
+func (iterate *userKeyIterator) Rewind() {
+	iterate.Iterator.Rewind()
+	iterate.skipInternalKeys()
+}
+
+func (iterate *userKeyIterator) Seek(key []byte) bool {
+	iterate.Iterator.Seek(key)
+	iterate.skipInternalKeys()
+	return iterate.HasNext()
+}
+
+func (iterate *userKeyIterator) Next() {
+	iterate.Iterator.Next()
+	iterate.skipInternalKeys()
+}
+
+// skipInternalKeys 迭代器位于内部key上时跳过整个内部key范围
+func (iterate *userKeyIterator) skipInternalKeys() {
+	if !iterate.HasNext() {
+		return
+	}
+	key, err := iterate.Key()
+	if err != nil || !isInternalKey(key) {
+		return
+	}
+	if iterate.reverse {
+		// 内部前缀本身不会被写入 逆序定位到前缀之前的key
+		iterate.Iterator.Seek([]byte(internalKeyPrefix))
+	} else {
+		iterate.Iterator.Seek(prefixUpperBound([]byte(internalKeyPrefix)))
+	}
+}
+
+func indexNamePrefix(name string) []byte {
+	return []byte(indexKeyPrefix + name + "\x00")
+}
+
+func indexMetaKey(name string) []byte {
+	return []byte(indexMetaPrefix + name)
+}
+
+func indexValuePrefix(name string, value []byte) []byte {
+	prefix := indexNamePrefix(name)
+	prefix = append(prefix, escapeIndexValue(value)...)
+	return append(prefix, 0x00, 0x01)
+}
+
+func encodeIndexKey(name string, value []byte, primaryKey []byte) []byte {
+	return append(indexValuePrefix(name, value), primaryKey...)
+}
+
+// escapeIndexValue 转义字段值 0转义为0 0xff 结束符为0 1 转义后的字段值保持原有顺序并且不会互为前缀
+func escapeIndexValue(value []byte) []byte {
+	escaped := make([]byte, 0, len(value)+2)
+	for _, b := range value {
+		if b == 0x00 {
+			escaped = append(escaped, 0x00, 0xff)
+		} else {
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+// unescapeIndexValue 解析转义后的字段值 返回字段值以及剩余部分的主键
+func unescapeIndexValue(buffer []byte) ([]byte, []byte, bool) {
+	value := make([]byte, 0, len(buffer))
+	for i := 0; i < len(buffer); i++ {
+		if buffer[i] != 0x00 {
+			value = append(value, buffer[i])
+			continue
+		}
+		if i+1 >= len(buffer) {
+			return nil, nil, false
+		}
+		if buffer[i+1] == 0x01 {
+			return value, buffer[i+2:], true
+		}
+		value = append(value, 0x00)
+		i++
+	}
+	return nil, nil, false
+}
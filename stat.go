@@ -0,0 +1,73 @@
+package kv
+
+import (
+	"github.com/RainbowSorcery/kv-project/cache"
+	"time"
+)
+
+// Stat 数据库统计信息
+type Stat struct {
+	// key数量
+	KeyNum int
+	// 数据文件数量
+	DataFileNum int
+	// 数据文件总大小
+	DiskSize int64
+	// 可回收空间大小 被覆盖以及被删除的记录占用的字节数
+	ReclaimableSize int64
+	// 有效数据大小 数据文件总大小减去可回收空间
+	LiveSize int64
+	// 每个数据文件的可回收空间大小
+	FileReclaimableSize map[uint32]int64
+	// 活动文件id
+	ActiveFileId uint32
+	// 活动文件写入偏移
+	ActiveFileOffset int64
+	// 最近一次合并完成的时间 没有合并过时为零值
+	LastMergeTime time.Time
+	// 是否正在合并
+	MergeIng bool
+	// value缓存统计信息 包括命中次数以及未命中次数
+	ValueCache cache.Stat
+	// blob文件数量
+	BlobFileNum int
+	// blob文件总大小
+	BlobSize int64
+	// blob文件可回收空间大小
+	BlobReclaimableSize int64
+}
+
+// Stat 获取数据库统计信息
+func (db *Db) Stat() *Stat {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	stat := &Stat{
+		KeyNum:              db.index.Size() - db.internalKeyNum,
+		DataFileNum:         len(db.oldFile) + 1,
+		DiskSize:            db.activeFile.FileManage.Size(),
+		FileReclaimableSize: make(map[uint32]int64, len(db.reclaimable)),
+		ActiveFileId:        db.activeFile.FileId,
+		ActiveFileOffset:    db.activeFile.WriteOffset,
+		LastMergeTime:       db.lastMergeTime,
+		MergeIng:            db.mergeIng,
+	}
+	for _, oldFile := range db.oldFile {
+		stat.DiskSize += oldFile.FileManage.Size()
+	}
+	for fileId, reclaimableSize := range db.reclaimable {
+		stat.ReclaimableSize += reclaimableSize
+		stat.FileReclaimableSize[fileId] = reclaimableSize
+	}
+	stat.LiveSize = stat.DiskSize - stat.ReclaimableSize
+	if db.valueCache != nil {
+		stat.ValueCache = db.valueCache.Stat()
+	}
+	stat.BlobFileNum = len(db.blobFiles)
+	for fileId, blobFile := range db.blobFiles {
+		stat.BlobSize += blobFile.WriteOffset
+		stat.BlobReclaimableSize += db.blobReclaimable[fileId]
+	}
+
+	return stat
+}
@@ -0,0 +1,157 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/RainbowSorcery/kv-project/data"
+	"io"
+	"os"
+)
+
+// maxIndexedStreamSize 注册了二级索引时流式写入的value上限 提取字段需要完整的value 只能读入内存
+const maxIndexedStreamSize = 64 * 1024 * 1024
+
+// PutReader 从reader中流式写入size字节作为value 不需要把value整体放入内存
+// 小于blob阈值的value读入内存后按Put写入 其余value先写入临时文件 再追加到活动blob文件
+// 读取reader期间不持有锁 读取缓慢不会阻塞其他读写 写入完成后加锁更新内存索引
+// 注册了二级索引时需要完整的value提取字段 value读入内存后按Put写入 超过maxIndexedStreamSize时返回ErrValueTooLarge
+func (db *Db) PutReader(key []byte, reader io.Reader, size int64) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("value长度不合法")
+	}
+
+	db.lock.RLock()
+	indexed := len(db.secondaryIndexes) > 0
+	db.lock.RUnlock()
+	if size < db.option.BlobThreshold || indexed {
+		value, err := readStreamValue(reader, size, indexed)
+		if err != nil {
+			return err
+		}
+		return db.Put(key, value)
+	}
+
+	// 写入临时文件 写入完成前不会被读取、回收或者加入检查点 中断遗留的临时文件在启动时删除
+	spool, err := os.CreateTemp(db.option.DirPath, "*"+data.BlobTmpFileSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spool.Name())
+	}()
+	if _, err := io.CopyN(spool, reader, size); err != nil {
+		return fmt.Errorf("读取value失败: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// 写入期间可能注册了二级索引 需要按普通写入处理
+	if len(db.secondaryIndexes) > 0 {
+		value, err := readStreamValue(spool, size, true)
+		if err != nil {
+			return err
+		}
+		if err := db.checkWritable(); err != nil {
+			return err
+		}
+		return db.put(key, value, 0)
+	}
+
+	blobFile, err := db.getActiveBlobFile()
+	if err != nil {
+		return err
+	}
+	offset := blobFile.WriteOffset
+	blobPos, err := blobFile.WriteFrom(key, spool, size)
+	if err != nil {
+		db.blobReclaimable[blobFile.FileId] += blobFile.WriteOffset - offset
+		return err
+	}
+	// value刷盘后再写入数据文件中的BlobIndex记录
+	if err := db.syncFile(blobFile.FileManage); err != nil {
+		db.blobReclaimable[blobPos.FileId] += blobPos.Size
+		return err
+	}
+
+	if err := db.putBlobIndex(key, blobPos); err != nil {
+		db.blobReclaimable[blobPos.FileId] += blobPos.Size
+		return err
+	}
+	return nil
+}
+
+// readStreamValue 将reader中的value读入内存 limited为true时value不能超过maxIndexedStreamSize
+func readStreamValue(reader io.Reader, size int64, limited bool) ([]byte, error) {
+	if limited && size > maxIndexedStreamSize {
+		return nil, fmt.Errorf("注册了二级索引时流式写入的value不能超过%d字节: %w", maxIndexedStreamSize, ErrValueTooLarge)
+	}
+	value := make([]byte, size)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return nil, fmt.Errorf("读取value失败: %w", err)
+	}
+	return value, nil
+}
+
+// putBlobIndex 写入指向blob文件的记录并更新内存索引 覆盖数据结构时与成员的删除在同一个事务中写入 调用方需要持有锁
+func (db *Db) putBlobIndex(key []byte, blobPos *data.BlobPos) error {
+	writes, err := db.withMemberDeletes(map[string]*data.LogRecord{
+		string(key): {Key: key, Value: data.EncodingBlobPos(blobPos), Type: data.BlobIndex},
+	})
+	if err != nil {
+		return err
+	}
+	if len(writes) > 1 {
+		return db.commit(writes, false, false)
+	}
+
+	logRecordPos, err := db.AppendLogRecord(&data.LogRecord{
+		Key:   EncodingTranKey(key, 0),
+		Value: data.EncodingBlobPos(blobPos),
+		Type:  data.BlobIndex,
+	})
+	if err != nil {
+		return err
+	}
+	db.indexPut(key, logRecordPos, blobPos)
+	return nil
+}
+
+// GetReader 流式读取key对应的value 读到末尾时校验crc 使用完毕后需要调用Close
+// blob文件中的value打开独立的文件句柄读取 读取期间文件被回收删除也不影响读取
+func (db *Db) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	pos := db.index.Get(key)
+	if pos == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	// blobRefs中记录了key当前引用的blob 不需要读取数据文件 存在操作数时需要先合并
+	if blobPos, ok := db.blobRefs[string(key)]; ok && db.operandChains[string(key)] == nil {
+		return data.OpenBlobReader(db.option.DirPath, blobPos)
+	}
+
+	// 数据文件中保存的value都小于blob阈值 直接读取
+	record, err := db.posByLogRecord(key, pos)
+	if err != nil {
+		return nil, err
+	}
+	if record.Type == data.Deleted {
+		return nil, ErrKeyNotFound
+	}
+	return io.NopCloser(bytes.NewReader(record.Value)), nil
+}